@@ -0,0 +1,155 @@
+// Package admin serves an HTTP API for operating wg-manager locally over a unix socket, along with a client for it
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Server serves the admin API on a unix socket, so that access is controlled by the permissions of the socket
+type Server struct {
+	path string
+	mux  *http.ServeMux
+}
+
+// errorResponse is the body of responses to failed requests
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// New returns a new Server listening on the socket at the given path once it's served
+func New(path string) *Server {
+	return &Server{
+		path: path,
+		mux:  http.NewServeMux(),
+	}
+}
+
+// HandleFunc registers the handler for the given pattern
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Serve starts serving the API in the background, until the context is canceled
+func (s *Server) Serve(ctx context.Context) error {
+	// A socket left behind by a previous run would make listening fail
+	err := os.Remove(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(s.path, 0660)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: s.mux}
+	go server.Serve(listener)
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	return nil
+}
+
+// ParseJSON decodes the body of a request into v
+func ParseJSON(r *http.Request, v interface{}) error {
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// WriteJSON writes a successful response with the value encoded as JSON
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes a failed response with the given status code
+func WriteError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+// Client is a client for the admin API
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a client for the admin API served on the socket at the given path
+func NewClient(path string) *Client {
+	return &Client{
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Get requests the given path, and decodes the response into v
+func (c *Client) Get(path string, v interface{}) error {
+	return c.do("GET", path, nil, v)
+}
+
+// Post sends the body encoded as JSON to the given path, and decodes the response into v
+func (c *Client) Post(path string, body interface{}, v interface{}) error {
+	return c.do("POST", path, body, v)
+}
+
+func (c *Client) do(method string, path string, body interface{}, v interface{}) error {
+	var buffer bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buffer).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The host is ignored, as every request goes to the socket
+	req, err := http.NewRequest(method, "http://admin"+path, &buffer)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var e errorResponse
+		err = json.NewDecoder(response.Body).Decode(&e)
+		if err != nil || e.Error == "" {
+			return fmt.Errorf("request failed with status %d", response.StatusCode)
+		}
+
+		return errors.New(e.Error)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
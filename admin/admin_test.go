@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(filepath.Join(dir, "admin.sock"))
+	s.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		err := ParseJSON(r, &body)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		WriteJSON(w, body)
+	})
+	s.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusConflict, errors.New("failed"))
+	})
+
+	err = s.Serve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(filepath.Join(dir, "admin.sock"))
+
+	var response map[string]string
+	err = c.Post("/echo", map[string]string{"hello": "world"}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response["hello"] != "world" {
+		t.Errorf("got unexpected response %v", response)
+	}
+
+	err = c.Get("/fail", nil)
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("got unexpected error %v", err)
+	}
+}
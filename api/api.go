@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // API is a utility for communicating with the Mullvad API
@@ -22,8 +24,93 @@ type WireguardPeerList []WireguardPeer
 type WireguardPeer struct {
 	IPv4   string `json:"ipv4"`
 	IPv6   string `json:"ipv6"`
-	Ports  []int  `json:"ports"`
+	Ports  []Port `json:"ports"`
 	Pubkey string `json:"pubkey"`
+	// Exit is the relay exit the ports are forwarded on, empty for the default one
+	Exit string `json:"exit,omitempty"`
+}
+
+// Port is a port forwarded to a peer
+// In JSON it's either a plain port number, forwarded as-is over both TCP and UDP, or an object mapping an external port to an internal one
+type Port struct {
+	External int `json:"external"`
+	// Internal is the port on the peer to forward to, 0 means the same as External
+	Internal int `json:"internal,omitempty"`
+	// Protocol is either "tcp" or "udp", empty means both
+	Protocol string `json:"protocol,omitempty"`
+	// Expires is when the lease of the port runs out, nil if it never does
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// port is Port without its JSON methods, to avoid recursing into them
+type port Port
+
+// UnmarshalJSON accepts both a plain port number and a port mapping object
+// The protocol is lowercased, other invalid values are kept so that they can be reported by Validate
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var number int
+	if err := json.Unmarshal(data, &number); err == nil {
+		*p = Port{External: number}
+		return nil
+	}
+
+	if err := json.Unmarshal(data, (*port)(p)); err != nil {
+		return err
+	}
+
+	p.Protocol = strings.ToLower(p.Protocol)
+	return nil
+}
+
+// MarshalJSON encodes ports that aren't mapped as plain port numbers, so that the original format is kept where possible
+func (p Port) MarshalJSON() ([]byte, error) {
+	if !p.IsMapped() && p.Protocol == "" && p.Expires == nil {
+		return json.Marshal(p.External)
+	}
+
+	return json.Marshal(port(p))
+}
+
+// InternalPort returns the port on the peer that the port is forwarded to
+func (p Port) InternalPort() int {
+	if p.Internal == 0 {
+		return p.External
+	}
+
+	return p.Internal
+}
+
+// IsMapped checks whether the port is forwarded to a different port on the peer
+func (p Port) IsMapped() bool {
+	return p.InternalPort() != p.External
+}
+
+// IsExpired checks whether the lease of the port ran out before the given time
+func (p Port) IsExpired(now time.Time) bool {
+	return p.Expires != nil && !now.Before(*p.Expires)
+}
+
+// Validate checks that the ports are within 1-65535, and that the protocol is either "tcp", "udp" or empty
+func (p Port) Validate() error {
+	if p.External < 1 || p.External > 65535 {
+		return fmt.Errorf("external port %d out of range", p.External)
+	}
+
+	if p.Internal < 0 || p.Internal > 65535 {
+		return fmt.Errorf("internal port %d out of range", p.Internal)
+	}
+
+	switch p.Protocol {
+	case "", "tcp", "udp":
+		return nil
+	default:
+		return fmt.Errorf("unsupported protocol %q", p.Protocol)
+	}
+}
+
+// HasProtocol checks whether the port is forwarded for the given protocol
+func (p Port) HasProtocol(protocol string) bool {
+	return p.Protocol == "" || p.Protocol == protocol
 }
 
 // GetWireguardPeers fetches a list of wireguard peers from the API and returns it
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/mullvad/wg-manager/api"
 )
@@ -16,7 +17,7 @@ var fixture = api.WireguardPeerList{
 	api.WireguardPeer{
 		IPv4:   "10.99.0.1/32",
 		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
-		Ports:  []int{1234, 4321},
+		Ports:  []api.Port{{External: 1234}, {External: 4321}},
 		Pubkey: strings.Repeat("a", 44),
 	},
 }
@@ -46,3 +47,53 @@ func TestAPI(t *testing.T) {
 		t.Errorf("got unexpected result, wanted %+v, got %+v", peers, fixture)
 	}
 }
+
+func TestPortJSON(t *testing.T) {
+	var peer api.WireguardPeer
+	err := json.Unmarshal([]byte(`{"ports": [1234, {"external": 51234, "internal": 8080, "protocol": "tcp"}, {"external": 4321}, {"external": 5678, "expires": "2020-05-01T12:00:00Z"}]}`), &peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	expected := []api.Port{
+		{External: 1234},
+		{External: 51234, Internal: 8080, Protocol: "tcp"},
+		{External: 4321},
+		{External: 5678, Expires: &expires},
+	}
+	if !reflect.DeepEqual(peer.Ports, expected) {
+		t.Fatalf("got unexpected result, wanted %+v, got %+v", expected, peer.Ports)
+	}
+
+	bytes, err := json.Marshal(peer.Ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bytes) != `[1234,{"external":51234,"internal":8080,"protocol":"tcp"},4321,{"external":5678,"expires":"2020-05-01T12:00:00Z"}]` {
+		t.Fatalf("got unexpected json %s", bytes)
+	}
+
+	if peer.Ports[3].IsExpired(expires.Add(-time.Second)) || !peer.Ports[3].IsExpired(expires) || peer.Ports[0].IsExpired(expires) {
+		t.Fatal("got unexpected expiry")
+	}
+}
+
+func TestPortValidate(t *testing.T) {
+	var ports []api.Port
+	err := json.Unmarshal([]byte(`[{"external": 1234, "protocol": "TCP"}, {"external": 1234, "protocol": "sctp"}, 0, 65536, {"external": 1234, "internal": 70000}, {"external": 65535, "internal": 1, "protocol": "udp"}]`), &ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ports[0].Protocol != "tcp" {
+		t.Errorf("expected the protocol to be lowercased, got %q", ports[0].Protocol)
+	}
+
+	for i, valid := range []bool{true, false, false, false, false, true} {
+		if err := ports[i].Validate(); (err == nil) != valid {
+			t.Errorf("port %+v: expected valid to be %t, got error %v", ports[i], valid, err)
+		}
+	}
+}
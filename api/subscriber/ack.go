@@ -0,0 +1,99 @@
+package subscriber
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// AckStatus is the outcome of handling an event
+type AckStatus string
+
+const (
+	// AckSuccess means the event was applied
+	AckSuccess AckStatus = "success"
+	// AckFailure means applying the event failed
+	AckFailure AckStatus = "failure"
+	// AckSuperseded means the event was coalesced with a later event for the same peer, and never applied on its own
+	AckSuperseded AckStatus = "superseded"
+	// AckResync means the event was dropped, and will be applied by a full synchronization instead
+	AckResync AckStatus = "resync"
+)
+
+// Acknowledgement is sent back to the message-queue after an event has been handled
+type Acknowledgement struct {
+	Action    string    `json:"action"`
+	EventID   string    `json:"event_id"`
+	RelayID   string    `json:"relay_id"`
+	Status    AckStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+}
+
+// How many acknowledgements to buffer per channel while waiting for a connection
+const ackBufferSize = 1000
+
+// How long to wait for an acknowledgement to be written
+const ackTimeout = time.Second * 10
+
+// Acknowledge sends the outcome of handling an event back on the channel it was received on, without blocking
+// Events without an ID, and acknowledgements that don't fit in the buffer, are dropped
+func (s *Subscriber) Acknowledge(event WireguardEvent, status AckStatus, err error, latency time.Duration) {
+	if event.ID == "" {
+		return
+	}
+
+	sub, ok := s.subscriptions[event.Channel]
+	if !ok {
+		return
+	}
+
+	ack := Acknowledgement{
+		Action:    "ACK",
+		EventID:   event.ID,
+		RelayID:   s.RelayID,
+		Status:    status,
+		LatencyMs: int64(latency / time.Millisecond),
+	}
+
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	select {
+	case sub.acks <- ack:
+	default:
+		sub.metrics.Increment("ack_dropped")
+	}
+}
+
+// writeAcks sends buffered acknowledgements over the connection until it's closed
+// Anything left in the buffer is sent once the channel has reconnected
+func (s *subscription) writeAcks(ctx context.Context, conn conn) {
+	for {
+		select {
+		case ack := <-s.acks:
+			writeCtx, cancel := context.WithTimeout(ctx, ackTimeout)
+			err := conn.write(writeCtx, ack)
+			cancel()
+
+			if err == errNoWrite {
+				s.unsupportedAcks.Do(func() {
+					log.Printf("not sending acknowledgements on message-queue channel %s, the transport can't send messages", s.name)
+				})
+				s.metrics.Increment("ack_unsupported")
+				continue
+			}
+
+			if err != nil {
+				log.Printf("error sending acknowledgement on message-queue channel %s %s", s.name, err)
+				s.metrics.Increment("ack_error")
+				continue
+			}
+
+			s.metrics.Increment("ack_sent")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
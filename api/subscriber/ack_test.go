@@ -0,0 +1,98 @@
+package subscriber_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api/subscriber"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestAcknowledge(t *testing.T) {
+	acks := make(chan subscriber.Acknowledgement, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		event := fixture
+		event.ID = "event-1"
+
+		err = wsjson.Write(ctx, c, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ack subscriber.Acknowledgement
+		err = wsjson.Read(ctx, c, &ack)
+		if err != nil {
+			return
+		}
+
+		acks <- ack
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:  "ws://" + parsedURL.Host,
+		Channels: []string{"test"},
+		Metrics:  metrics,
+		RelayID:  "relay-1",
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-channel
+	s.Acknowledge(event, subscriber.AckFailure, errors.New("failed"), time.Millisecond*5)
+
+	expected := subscriber.Acknowledgement{
+		Action:    "ACK",
+		EventID:   "event-1",
+		RelayID:   "relay-1",
+		Status:    subscriber.AckFailure,
+		Error:     "failed",
+		LatencyMs: 5,
+	}
+
+	select {
+	case ack := <-acks:
+		if diff := cmp.Diff(expected, ack); diff != "" {
+			t.Fatalf("unexpected acknowledgement (-want +got):\n%s", diff)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for acknowledgement")
+	}
+}
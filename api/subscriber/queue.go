@@ -0,0 +1,157 @@
+package subscriber
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+)
+
+// Queue is a bounded buffer between a Subscriber and the event handler
+// Pending events for the same public key are coalesced into the latest one, as only the final state matters
+// If the queue fills up, all pending events are dropped and the consumer is told to run a full synchronization instead
+type Queue struct {
+	size    int
+	metrics *statsd.Client
+	discard func(WireguardEvent, AckStatus)
+
+	mu         sync.Mutex
+	events     map[string]queuedEvent
+	sequence   uint64
+	overflowed bool
+	ready      chan struct{}
+}
+
+type queuedEvent struct {
+	event    WireguardEvent
+	sequence uint64
+	queued   time.Time
+}
+
+// NewQueue returns a new Queue holding at most size pending events
+// discard is called for every event that won't be returned by Drain, along with the reason why, it may be nil and must not block
+func NewQueue(size int, metrics *statsd.Client, discard func(WireguardEvent, AckStatus)) *Queue {
+	if discard == nil {
+		discard = func(WireguardEvent, AckStatus) {}
+	}
+
+	return &Queue{
+		size:    size,
+		metrics: metrics,
+		discard: discard,
+		events:  make(map[string]queuedEvent),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Consume pushes events from the given channel onto the queue until the channel is closed or the context is canceled
+func (q *Queue) Consume(ctx context.Context, channel <-chan WireguardEvent) {
+	for {
+		select {
+		case event, ok := <-channel:
+			if !ok {
+				return
+			}
+
+			q.Push(event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push adds an event to the queue without blocking
+func (q *Queue) Push(event WireguardEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// A full synchronization is already pending, which will cover this event as well
+	if q.overflowed {
+		q.discard(event, AckResync)
+		return
+	}
+
+	q.sequence++
+
+	if existing, ok := q.events[event.Peer.Pubkey]; ok {
+		// Keep the time the first event was queued, so that the latency metric reflects how long the key has been waiting
+		q.events[event.Peer.Pubkey] = queuedEvent{
+			event:    event,
+			sequence: q.sequence,
+			queued:   existing.queued,
+		}
+		q.discard(existing.event, AckSuperseded)
+		q.metrics.Increment("event_queue_coalesced")
+		q.signal()
+		return
+	}
+
+	if len(q.events) >= q.size {
+		for _, e := range q.events {
+			q.discard(e.event, AckResync)
+		}
+		q.discard(event, AckResync)
+
+		q.events = make(map[string]queuedEvent)
+		q.overflowed = true
+		q.metrics.Increment("event_queue_overflow")
+		q.metrics.Gauge("event_queue_depth", 0)
+		q.signal()
+		return
+	}
+
+	q.events[event.Peer.Pubkey] = queuedEvent{
+		event:    event,
+		sequence: q.sequence,
+		queued:   time.Now(),
+	}
+	q.metrics.Gauge("event_queue_depth", len(q.events))
+	q.signal()
+}
+
+// Ready returns a channel that receives a value whenever there are pending events to drain
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Drain removes and returns all pending events in the order they were last updated
+// If the queue overflowed since the last drain, no events are returned and overflowed is true
+func (q *Queue) Drain() (events []WireguardEvent, overflowed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.overflowed {
+		q.overflowed = false
+		return nil, true
+	}
+
+	pending := make([]queuedEvent, 0, len(q.events))
+	for _, e := range q.events {
+		pending = append(pending, e)
+	}
+
+	sort.Slice(pending, func(i int, j int) bool {
+		return pending[i].sequence < pending[j].sequence
+	})
+
+	events = make([]WireguardEvent, len(pending))
+	for i, e := range pending {
+		q.metrics.Timing("event_queue_latency", time.Since(e.queued))
+		events[i] = e.event
+	}
+
+	q.events = make(map[string]queuedEvent)
+	q.metrics.Gauge("event_queue_depth", 0)
+
+	return events, false
+}
+
+// Wake up the consumer, unless a wake up is already pending
+func (q *Queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package subscriber_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func event(action string, key string) subscriber.WireguardEvent {
+	return subscriber.WireguardEvent{
+		Action: action,
+		Peer: api.WireguardPeer{
+			IPv4:   "10.99.0.1/32",
+			IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+			Pubkey: strings.Repeat(key, 44),
+		},
+	}
+}
+
+func TestQueue(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("coalesce events", func(t *testing.T) {
+		var discarded []subscriber.AckStatus
+		q := subscriber.NewQueue(10, metrics, func(event subscriber.WireguardEvent, status subscriber.AckStatus) {
+			discarded = append(discarded, status)
+		})
+		q.Push(event("ADD", "a"))
+		q.Push(event("ADD", "b"))
+		q.Push(event("REMOVE", "a"))
+
+		select {
+		case <-q.Ready():
+		default:
+			t.Fatal("queue not ready")
+		}
+
+		events, overflowed := q.Drain()
+		if overflowed {
+			t.Fatal("unexpected overflow")
+		}
+
+		expected := []subscriber.WireguardEvent{
+			event("ADD", "b"),
+			event("REMOVE", "a"),
+		}
+
+		if diff := cmp.Diff(expected, events); diff != "" {
+			t.Fatalf("unexpected events (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]subscriber.AckStatus{subscriber.AckSuperseded}, discarded); diff != "" {
+			t.Fatalf("unexpected discarded events (-want +got):\n%s", diff)
+		}
+
+		events, _ = q.Drain()
+		if len(events) != 0 {
+			t.Fatalf("queue not empty after drain, got %d events", len(events))
+		}
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		var discarded int
+		q := subscriber.NewQueue(2, metrics, func(event subscriber.WireguardEvent, status subscriber.AckStatus) {
+			if status == subscriber.AckResync {
+				discarded++
+			}
+		})
+		q.Push(event("ADD", "a"))
+		q.Push(event("ADD", "b"))
+
+		// Coalesced events don't take up any extra space
+		q.Push(event("REMOVE", "b"))
+
+		q.Push(event("ADD", "c"))
+		q.Push(event("ADD", "d"))
+
+		events, overflowed := q.Drain()
+		if !overflowed {
+			t.Fatal("expected overflow")
+		}
+
+		if len(events) != 0 {
+			t.Fatalf("expected no events on overflow, got %d", len(events))
+		}
+
+		// Everything pending at the time of the overflow, and anything pushed after it, is dropped
+		if discarded != 4 {
+			t.Fatalf("expected 4 events to be dropped for resync, got %d", discarded)
+		}
+
+		// The queue is usable again after the overflow has been drained
+		q.Push(event("ADD", "e"))
+
+		events, overflowed = q.Drain()
+		if overflowed {
+			t.Fatal("unexpected overflow")
+		}
+
+		if diff := cmp.Diff([]subscriber.WireguardEvent{event("ADD", "e")}, events); diff != "" {
+			t.Fatalf("unexpected events (-want +got):\n%s", diff)
+		}
+	})
+}
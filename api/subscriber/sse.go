@@ -0,0 +1,131 @@
+package subscriber
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// sseTransport receives events as a text/event-stream, for environments where websockets don't make it through proxies
+type sseTransport struct {
+	client *http.Client
+}
+
+type sseConn struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	cancel context.CancelFunc
+
+	// Set whenever anything, including heartbeat comments, has been received
+	received int32
+}
+
+func (t sseTransport) dial(ctx context.Context, url string, header http.Header) (conn, error) {
+	// The request lives as long as the connection, so it gets its own context
+	ctx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	response, err := t.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected status code %d from event stream", response.StatusCode)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/event-stream" {
+		response.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected content type %s from event stream", response.Header.Get("Content-Type"))
+	}
+
+	return &sseConn{
+		body:   response.Body,
+		reader: bufio.NewReader(response.Body),
+		cancel: cancel,
+	}, nil
+}
+
+func (s *sseConn) read(ctx context.Context, v *WireguardEvent) error {
+	var eventType string
+	var data []string
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		atomic.StoreInt32(&s.received, 1)
+		line = strings.TrimRight(line, "\r\n")
+
+		// A blank line dispatches the event
+		if line == "" {
+			if len(data) > 0 && (eventType == "" || eventType == "message") {
+				return json.Unmarshal([]byte(strings.Join(data, "\n")), v)
+			}
+
+			eventType = ""
+			data = nil
+			continue
+		}
+
+		// Lines starting with a colon are comments, usually sent as heartbeats
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+		default: // id and retry aren't used
+		}
+	}
+}
+
+// There's no way to ping over an event stream, so instead this reports whether anything has been received since the last ping
+func (s *sseConn) ping(ctx context.Context) error {
+	if atomic.SwapInt32(&s.received, 0) == 1 {
+		return nil
+	}
+
+	return errNoPing
+}
+
+// Event streams are receive-only, so acknowledgements can't be sent
+func (s *sseConn) write(ctx context.Context, v interface{}) error {
+	return errNoWrite
+}
+
+func (s *sseConn) close() error {
+	s.cancel()
+	return s.body.Close()
+}
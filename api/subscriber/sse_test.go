@@ -0,0 +1,95 @@
+package subscriber_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func TestSubscriberSSE(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != username || p != password {
+			t.Fatal("invalid credentials")
+		}
+
+		if r.URL.Path != "/channel/test" {
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+
+		data, err := json.Marshal(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		// Heartbeats and events of other types should be skipped
+		fmt.Fprint(w, ": heartbeat\n\n")
+		fmt.Fprint(w, "event: other\ndata: {}\n\n")
+		fmt.Fprintf(w, "id: 1\ndata: %s\n\n", data)
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:  server.URL,
+		Channels: []string{"test"},
+		Username: username,
+		Password: password,
+		Metrics:  metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are tagged with the channel they were received on
+	expected := fixture
+	expected.Channel = "test"
+
+	// Try to recieve two messages
+	// This will also test the reconnection logic, as the mock server ends the stream after sending the message
+	for i := 0; i < 2; i++ {
+		msg := <-channel
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, msg)
+		}
+	}
+}
+
+func TestSubscriberInvalidScheme(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:  "ftp://localhost",
+		Channels: []string{"test"},
+		Metrics:  metrics,
+	}
+
+	err = s.Subscribe(context.Background(), make(chan subscriber.WireguardEvent))
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
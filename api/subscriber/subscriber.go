@@ -3,14 +3,17 @@ package subscriber
 import (
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/infosum/statsd"
 	"github.com/mullvad/wg-manager/api"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // Subscriber is a utility for receiving wireguard key events from a message-queue server
@@ -18,30 +21,105 @@ type Subscriber struct {
 	Username string
 	Password string
 	BaseURL  string
-	Channel  string
+	Channels []string
 	Metrics  *statsd.Client
+
+	// RelayID identifies this relay in acknowledgements sent back to the message-queue
+	RelayID string
+
+	// PingInterval is how often to check that the connection is alive, zero disables the check
+	PingInterval time.Duration
+	// IdleTimeout is how long the connection may go without receiving a message or pong before it's considered dead
+	// It's checked every PingInterval, zero disables the check
+	IdleTimeout time.Duration
+
+	subscriptions map[string]*subscription
 }
 
 // WireguardEvent is a wireguard key event
 type WireguardEvent struct {
+	ID     string            `json:"id,omitempty"`
 	Action string            `json:"action"`
 	Peer   api.WireguardPeer `json:"peer"`
+
+	// Channel is the message-queue channel the event was received on
+	Channel string `json:"-"`
 }
 
-const subProtocol = "message-queue-v1"
+// subscription is the connection to a single message-queue channel
+type subscription struct {
+	*Subscriber
+	name    string
+	metrics *statsd.Client
+	acks    chan Acknowledgement
+	// unsupportedAcks logs once that acknowledgements can't be sent over the transport
+	unsupportedAcks sync.Once
+}
+
+// ParseChannels parses a comma delimited list of message-queue channels, ignoring whitespace around the names and repeated names
+func ParseChannels(s string) ([]string, error) {
+	var channels []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty message-queue channel name in %q", s)
+		}
+
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		channels = append(channels, name)
+	}
+
+	return channels, nil
+}
 
-// Subscribe establishes a websocket connection for a message-queue channel, and emits messages on the given channel
+// Subscribe connects to each of the message-queue channels, and emits messages from all of them on the given channel
+// The transport is selected by the scheme of BaseURL, ws:// and wss:// use websockets, http:// and https:// use server-sent events
+// Each connection is reconnected independently if it fails after the initial connection has been established
 func (s *Subscriber) Subscribe(ctx context.Context, channel chan<- WireguardEvent) error {
-	err := s.connect(ctx, channel)
+	if len(s.Channels) == 0 {
+		return errors.New("no message-queue channels configured")
+	}
 
-	if err != nil {
-		return err
+	// Set up all subscriptions before connecting, as acknowledgements can be sent as soon as the first event arrives
+	s.subscriptions = make(map[string]*subscription)
+	for _, name := range s.Channels {
+		if name == "" {
+			return errors.New("empty message-queue channel name")
+		}
+
+		if _, ok := s.subscriptions[name]; ok {
+			return fmt.Errorf("message-queue channel %s is configured more than once", name)
+		}
+
+		s.subscriptions[name] = &subscription{
+			Subscriber: s,
+			name:       name,
+			metrics:    s.Metrics.Clone(statsd.Tags("channel", name)),
+			acks:       make(chan Acknowledgement, ackBufferSize),
+		}
+	}
+
+	for _, name := range s.Channels {
+		err := s.subscriptions[name].connect(ctx, channel)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s *Subscriber) connect(ctx context.Context, channel chan<- WireguardEvent) error {
+func (s *subscription) connect(ctx context.Context, channel chan<- WireguardEvent) error {
+	t, err := newTransport(s.BaseURL)
+	if err != nil {
+		return err
+	}
+
 	header := http.Header{}
 
 	if s.Username != "" && s.Password != "" {
@@ -50,31 +128,37 @@ func (s *Subscriber) connect(ctx context.Context, channel chan<- WireguardEvent)
 
 	header.Set("Access-Control-Allow-Origin","*")
 
-	log.Print(s.BaseURL+"/channel/"+s.Channel)
-	conn, _, err := websocket.Dial(ctx, s.BaseURL+"/channel/"+s.Channel, &websocket.DialOptions{
-		Subprotocols: []string{subProtocol},
-		HTTPHeader:   header,
-	})
-
+	log.Print(s.BaseURL+"/channel/"+s.name)
+	conn, err := t.dial(ctx, s.BaseURL+"/channel/"+s.name, header)
 	if err != nil {
 		return err
 	}
 
-	go s.read(ctx, channel, conn)
+	s.metrics.Gauge("websocket_connected", 1)
+
+	// Stops the keepalive and acknowledgements when the connection is done being read from
+	connCtx, cancel := context.WithCancel(ctx)
+	lastActivity := time.Now().UnixNano()
+
+	go s.keepalive(connCtx, conn, &lastActivity)
+	go s.writeAcks(connCtx, conn)
+	go s.read(ctx, cancel, channel, conn, &lastActivity)
 
 	return nil
 }
 
-func (s *Subscriber) read(ctx context.Context, channel chan<- WireguardEvent, conn *websocket.Conn) {
+func (s *subscription) read(ctx context.Context, cancel context.CancelFunc, channel chan<- WireguardEvent, conn conn, lastActivity *int64) {
 	for {
 		v := WireguardEvent{}
-		err := wsjson.Read(ctx, conn, &v)
+		err := conn.read(ctx, &v)
 		if err != nil {
-			log.Println("error reading from websocket, reconnecting", err)
-			s.Metrics.Increment("websocket_error")
+			log.Printf("error reading from message-queue channel %s, reconnecting %s", s.name, err)
+			s.metrics.Increment("websocket_error")
+			s.metrics.Gauge("websocket_connected", 0)
+			cancel()
 
 			// Make sure the connection is closed
-			conn.Close(websocket.StatusInternalError, "")
+			conn.close()
 
 			// Start attempting to reconnect
 			go s.reconnect(ctx, channel)
@@ -82,21 +166,69 @@ func (s *Subscriber) read(ctx context.Context, channel chan<- WireguardEvent, co
 			return
 		}
 
+		atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+		v.Channel = s.name
 		channel <- v
 	}
 }
 
-func (s *Subscriber) reconnect(ctx context.Context, channel chan<- WireguardEvent) {
+// keepalive pings the server periodically, and closes the connection if it has been idle for too long
+// This detects half-open connections, which would otherwise block reading forever
+func (s *subscription) keepalive(ctx context.Context, conn conn, lastActivity *int64) {
+	if s.PingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		// A successful ping means the connection is alive
+		// Transports that can't tell return errNoPing, and we rely on the idle timeout alone
+		pingCtx, cancel := context.WithTimeout(ctx, s.PingInterval)
+		err := conn.ping(pingCtx)
+		cancel()
+		if err == nil {
+			atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+		} else if err == errNoPing {
+			err = nil
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		idle := s.IdleTimeout > 0 && time.Since(time.Unix(0, atomic.LoadInt64(lastActivity))) >= s.IdleTimeout
+		if err == nil && !idle {
+			continue
+		}
+
+		// The read loop will notice the connection closing and reconnect
+		log.Printf("message-queue channel %s is unresponsive, reconnecting %v", s.name, err)
+		s.metrics.Increment("websocket_half_open")
+		conn.close()
+
+		return
+	}
+}
+
+func (s *subscription) reconnect(ctx context.Context, channel chan<- WireguardEvent) {
 	// Sleep
 	time.Sleep(time.Second)
 
 	// Attempt to create a new connection
 	err := s.connect(ctx, channel)
 	if err != nil {
-		s.Metrics.Increment("websocket_reconnect_error")
+		s.metrics.Increment("websocket_reconnect_error")
 		go s.reconnect(ctx, channel)
 	} else {
-		log.Println("successfully reconnected to websocket")
-		s.Metrics.Increment("websocket_reconnect_success")
+		log.Printf("successfully reconnected to message-queue channel %s", s.name)
+		s.metrics.Increment("websocket_reconnect_success")
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,7 +23,7 @@ var fixture = subscriber.WireguardEvent{
 	Peer: api.WireguardPeer{
 		IPv4:   "10.99.0.1/32",
 		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
-		Ports:  []int{1234, 4321},
+		Ports:  []api.Port{{External: 1234}, {External: 4321}},
 		Pubkey: strings.Repeat("a", 44),
 	},
 }
@@ -68,7 +69,7 @@ func TestSubscriber(t *testing.T) {
 
 	s := subscriber.Subscriber{
 		BaseURL:  "ws://" + parsedURL.Host,
-		Channel:  "test",
+		Channels: []string{"test"},
 		Username: username,
 		Password: password,
 		Metrics:  metrics,
@@ -85,12 +86,184 @@ func TestSubscriber(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Events are tagged with the channel they were received on
+	expected := fixture
+	expected.Channel = "test"
+
 	// Try to recieve two messages
 	// This will also test the reconnection logic, as the mock server closes the connection after sending the message
 	for i := 0; i < 2; i++ {
 		msg := <-channel
-		if !reflect.DeepEqual(msg, fixture) {
-			t.Errorf("got unexpected result, wanted %+v, got %+v", msg, fixture)
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, msg)
+		}
+	}
+}
+
+func TestSubscriberIdleTimeout(t *testing.T) {
+	var connections int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		// Simulate a half-open connection by never reading, which means pings are never answered
+		if atomic.AddInt32(&connections, 1) == 1 {
+			<-ctx.Done()
+			return
+		}
+
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:      "ws://" + parsedURL.Host,
+		Channels:     []string{"test"},
+		Metrics:      metrics,
+		PingInterval: time.Millisecond * 100,
+		IdleTimeout:  time.Millisecond * 200,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fixture
+	expected.Channel = "test"
+
+	select {
+	case msg := <-channel:
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for reconnect")
+	}
+}
+
+func TestSubscriberMultipleChannels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		// Send a different event on each channel, so we can tell them apart
+		event := fixture
+		event.Action = strings.TrimPrefix(r.URL.Path, "/channel/")
+
+		err = wsjson.Write(ctx, c, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:  "ws://" + parsedURL.Host,
+		Channels: []string{"global", "relay"},
+		Metrics:  metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(map[string]bool)
+	for len(received) < 2 {
+		select {
+		case msg := <-channel:
+			received[msg.Action] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for events, got %v", received)
+		}
+	}
+
+	if !received["global"] || !received["relay"] {
+		t.Errorf("got events from unexpected channels %v", received)
+	}
+}
+
+func TestParseChannels(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []string
+		err      bool
+	}{
+		{input: "main", expected: []string{"main"}},
+		{input: "main, relay-1", expected: []string{"main", "relay-1"}},
+		{input: "main,relay-1,main", expected: []string{"main", "relay-1"}},
+		{input: "", err: true},
+		{input: "main,", err: true},
+		{input: "main,,relay-1", err: true},
+		{input: "main, ,relay-1", err: true},
+	} {
+		channels, err := subscriber.ParseChannels(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %v", tc.input, channels)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(channels, tc.expected) {
+			t.Errorf("got %v for %q, wanted %v", channels, tc.input, tc.expected)
 		}
 	}
 }
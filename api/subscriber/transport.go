@@ -0,0 +1,48 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// transport establishes connections to a message-queue channel
+type transport interface {
+	dial(ctx context.Context, url string, header http.Header) (conn, error)
+}
+
+// conn is a connection to a message-queue channel
+type conn interface {
+	// read blocks until the next event has been received
+	read(ctx context.Context, v *WireguardEvent) error
+	// ping checks whether the connection is alive, returning errNoPing if the transport can't tell
+	ping(ctx context.Context) error
+	// write sends a message to the server, returning errNoWrite if the transport is receive-only
+	write(ctx context.Context, v interface{}) error
+	close() error
+}
+
+// errNoPing is returned by conn.ping when the transport has no way of checking the connection
+var errNoPing = errors.New("ping not supported")
+
+// errNoWrite is returned by conn.write when the transport can't send messages to the server
+var errNoWrite = errors.New("write not supported")
+
+// newTransport picks a transport based on the scheme of the given url
+func newTransport(baseURL string) (transport, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return websocketTransport{}, nil
+	case "http", "https":
+		return sseTransport{client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported message-queue url scheme %s", u.Scheme)
+	}
+}
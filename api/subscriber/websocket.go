@@ -0,0 +1,48 @@
+package subscriber
+
+import (
+	"context"
+	"net/http"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const subProtocol = "message-queue-v1"
+
+// websocketTransport receives events over a message-queue-v1 websocket
+type websocketTransport struct{}
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func (websocketTransport) dial(ctx context.Context, url string, header http.Header) (conn, error) {
+	c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols: []string{subProtocol},
+		HTTPHeader:   header,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocketConn{conn: c}, nil
+}
+
+func (w *websocketConn) read(ctx context.Context, v *WireguardEvent) error {
+	return wsjson.Read(ctx, w.conn, v)
+}
+
+// Ping blocks until the pong has been read by the read loop
+func (w *websocketConn) ping(ctx context.Context) error {
+	return w.conn.Ping(ctx)
+}
+
+func (w *websocketConn) write(ctx context.Context, v interface{}) error {
+	return wsjson.Write(ctx, w.conn, v)
+}
+
+func (w *websocketConn) close() error {
+	return w.conn.Close(websocket.StatusInternalError, "")
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mullvad/wg-manager/admin"
+	"github.com/mullvad/wg-manager/index"
+	"github.com/mullvad/wg-manager/ipam"
+	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/reconcile"
+)
+
+// portPoolRequest is the body of requests to allocate and release ports
+type portPoolRequest struct {
+	Pubkey string `json:"pubkey"`
+	Port   int    `json:"port,omitempty"`
+}
+
+// lookupResult is a peer found by a lookup, along with the ports forwarded to it
+type lookupResult struct {
+	index.Peer
+	Forwards []portforward.Forward `json:"forwards"`
+}
+
+// registerHandlers adds the handlers of the admin API
+func registerHandlers(s *admin.Server) {
+	s.HandleFunc("/portpool", func(w http.ResponseWriter, r *http.Request) {
+		allocations := pf.Allocations()
+		if allocations == nil {
+			allocations = []portforward.Allocation{}
+		}
+
+		admin.WriteJSON(w, allocations)
+	})
+
+	s.HandleFunc("/portpool/allocate", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := parsePortPoolRequest(w, r)
+		if !ok {
+			return
+		}
+
+		port, err := pf.AllocatePort(req.Pubkey)
+		if err != nil {
+			admin.WriteError(w, http.StatusConflict, err)
+			return
+		}
+
+		admin.WriteJSON(w, portPoolRequest{Pubkey: req.Pubkey, Port: port})
+	})
+
+	s.HandleFunc("/portpool/release", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := parsePortPoolRequest(w, r)
+		if !ok {
+			return
+		}
+
+		err := pf.ReleasePort(req.Pubkey, req.Port)
+		if err != nil {
+			admin.WriteError(w, http.StatusConflict, err)
+			return
+		}
+
+		admin.WriteJSON(w, req)
+	})
+
+	s.HandleFunc("/ipam", func(w http.ResponseWriter, r *http.Request) {
+		admin.WriteJSON(w, addresses.Problems())
+	})
+
+	s.HandleFunc("/ipam/allocate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		allocation, err := addresses.Allocate()
+		if err != nil {
+			admin.WriteError(w, http.StatusConflict, err)
+			return
+		}
+
+		admin.WriteJSON(w, allocation)
+	})
+
+	s.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		admin.WriteJSON(w, reconciler.Pending())
+	})
+
+	s.HandleFunc("/lookup", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+
+		results, err := lookup(query)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(results) == 0 {
+			admin.WriteError(w, http.StatusNotFound, fmt.Errorf("no peer found for %s", query))
+			return
+		}
+
+		admin.WriteJSON(w, results)
+	})
+}
+
+// lookup finds the peer with a tunnel address, or the peers a port is forwarded to, from the last applied peers and rules
+func lookup(query string) ([]lookupResult, error) {
+	if addr, err := netip.ParseAddr(query); err == nil {
+		peer, ok := peerIndex.Address(addr)
+		if !ok {
+			return nil, nil
+		}
+
+		result := lookupResult{Peer: peer, Forwards: []portforward.Forward{}}
+		for _, forward := range pf.Forwards() {
+			if forward.Pubkey == peer.Pubkey {
+				result.Forwards = append(result.Forwards, forward)
+			}
+		}
+
+		return []lookupResult{result}, nil
+	}
+
+	port, err := strconv.Atoi(query)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("%s is neither an address nor a port", query)
+	}
+
+	var results []lookupResult
+	positions := make(map[string]int)
+	for _, forward := range pf.Forwards() {
+		if forward.Port != port {
+			continue
+		}
+
+		i, ok := positions[forward.Pubkey]
+		if !ok {
+			// Peers with mapped ports are always in the index, but fall back to the public key in case it was just removed
+			peer, found := peerIndex.Peer(forward.Pubkey)
+			if !found {
+				peer = index.Peer{Pubkey: forward.Pubkey}
+			}
+
+			i = len(results)
+			positions[forward.Pubkey] = i
+			results = append(results, lookupResult{Peer: peer})
+		}
+
+		results[i].Forwards = append(results[i].Forwards, forward)
+	}
+
+	return results, nil
+}
+
+func parsePortPoolRequest(w http.ResponseWriter, r *http.Request) (portPoolRequest, bool) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return portPoolRequest{}, false
+	}
+
+	var req portPoolRequest
+	err := admin.ParseJSON(r, &req)
+	if err != nil || req.Pubkey == "" {
+		admin.WriteError(w, http.StatusBadRequest, errors.New("a pubkey is required"))
+		return portPoolRequest{}, false
+	}
+
+	return req, true
+}
+
+// runCommand runs an admin command against a running instance, and returns the exit code
+func runCommand(args []string, socket string) int {
+	c := admin.NewClient(socket)
+
+	var err error
+	switch {
+	case len(args) == 2 && args[0] == "portpool" && args[1] == "list":
+		err = listPortPool(c)
+	case len(args) == 3 && args[0] == "portpool" && args[1] == "allocate":
+		var response portPoolRequest
+		err = c.Post("/portpool/allocate", portPoolRequest{Pubkey: args[2]}, &response)
+		if err == nil {
+			fmt.Println(response.Port)
+		}
+	case (len(args) == 3 || len(args) == 4) && args[0] == "portpool" && args[1] == "release":
+		req := portPoolRequest{Pubkey: args[2]}
+		if len(args) == 4 {
+			req.Port, err = strconv.Atoi(args[3])
+			if err != nil {
+				err = fmt.Errorf("invalid port %s", args[3])
+				break
+			}
+		}
+
+		err = c.Post("/portpool/release", req, nil)
+	case len(args) == 2 && args[0] == "ipam" && args[1] == "problems":
+		err = listIPAMProblems(c)
+	case len(args) == 2 && args[0] == "ipam" && args[1] == "allocate":
+		var allocation ipam.Allocation
+		err = c.Post("/ipam/allocate", nil, &allocation)
+		if err == nil {
+			for _, address := range []string{allocation.IPv4, allocation.IPv6} {
+				if address != "" {
+					fmt.Println(address)
+				}
+			}
+		}
+	case len(args) == 2 && args[0] == "lookup":
+		err = printLookup(c, args[1])
+	case len(args) == 1 && args[0] == "pending":
+		err = listPending(c)
+	default:
+		fmt.Fprintln(os.Stderr, "usage:")
+		fmt.Fprintln(os.Stderr, "  wg-manager portpool list")
+		fmt.Fprintln(os.Stderr, "  wg-manager portpool allocate <pubkey>")
+		fmt.Fprintln(os.Stderr, "  wg-manager portpool release <pubkey> [port]")
+		fmt.Fprintln(os.Stderr, "  wg-manager ipam problems")
+		fmt.Fprintln(os.Stderr, "  wg-manager ipam allocate")
+		fmt.Fprintln(os.Stderr, "  wg-manager lookup <ip|port>")
+		fmt.Fprintln(os.Stderr, "  wg-manager pending")
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func listPortPool(c *admin.Client) error {
+	var allocations []portforward.Allocation
+	err := c.Get("/portpool", &allocations)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tEXIT\tPUBKEY")
+	for _, allocation := range allocations {
+		exit := allocation.Exit
+		if exit == "" {
+			exit = "-"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\n", allocation.Port, exit, allocation.Pubkey)
+	}
+
+	return w.Flush()
+}
+
+func listIPAMProblems(c *admin.Client) error {
+	var problems []ipam.Problem
+	err := c.Get("/ipam", &problems)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tREASON\tPUBKEY\tOTHER")
+	for _, problem := range problems {
+		other := problem.Other
+		if other == "" {
+			other = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", problem.Address, problem.Reason, problem.Pubkey, other)
+	}
+
+	return w.Flush()
+}
+
+func listPending(c *admin.Client) error {
+	var pending []reconcile.Pending
+	err := c.Get("/pending", &pending)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBKEY\tACTION\tATTEMPTS\tSINCE\tNEXT RETRY\tERROR")
+	for _, p := range pending {
+		pubkey := p.Pubkey
+		if pubkey == "" {
+			pubkey = "all"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", pubkey, p.Action, p.Attempts, p.Since.Format(time.RFC3339), p.NextRetry.Format(time.RFC3339), p.Error)
+	}
+
+	return w.Flush()
+}
+
+func printLookup(c *admin.Client, query string) error {
+	var results []lookupResult
+	err := c.Get("/lookup?q="+url.QueryEscape(query), &results)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, result := range results {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		exit := result.Exit
+		if exit == "" {
+			exit = "-"
+		}
+
+		fmt.Fprintf(w, "PUBKEY\t%s\n", result.Pubkey)
+		fmt.Fprintf(w, "IPV4\t%s\n", result.IPv4)
+		fmt.Fprintf(w, "IPV6\t%s\n", result.IPv6)
+		fmt.Fprintf(w, "INTERFACES\t%s\n", strings.Join(result.Interfaces, ","))
+		fmt.Fprintf(w, "EXIT\t%s\n", exit)
+		if !result.Since.IsZero() {
+			fmt.Fprintf(w, "SINCE\t%s\n", result.Since.Format(time.RFC3339))
+		}
+
+		for _, forward := range result.Forwards {
+			expires := ""
+			if forward.Expires != nil {
+				expires = " until " + forward.Expires.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "FORWARD\t%s %d -> %s port %d%s\n", forward.Protocol, forward.Port, forward.Destination, forward.ToPort, expires)
+		}
+	}
+
+	return w.Flush()
+}
@@ -1,22 +1,32 @@
 module github.com/mullvad/wg-manager
 
-go 1.13
+go 1.18
 
 require (
 	github.com/DMarby/jitter v0.0.0-20190312004500-d77fd504dcfa
 	github.com/coreos/go-iptables v0.4.1
 	github.com/digineo/go-ipset/v2 v2.2.1
 	github.com/google/go-cmp v0.3.1
+	github.com/google/nftables v0.0.0-20200316075819-7127d9d22474
 	github.com/infosum/statsd v2.1.2+incompatible
 	github.com/jamiealquiza/envy v1.1.0
-	github.com/jsimonetti/rtnetlink v0.0.0-20190830100107-3784a6c7c552 // indirect
 	github.com/mdlayher/netlink v0.0.0-20191009155606-de872b0d824b
-	github.com/spf13/cobra v0.0.5 // indirect
-	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/ti-mo/netfilter v0.2.0
-	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf // indirect
-	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c // indirect
+	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20191028205011-23406de29c08
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	nhooyr.io/websocket v1.7.2
 )
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/jsimonetti/rtnetlink v0.0.0-20190830100107-3784a6c7c552 // indirect
+	github.com/koneu/natend v0.0.0-20150829182554-ec0926ea948d // indirect
+	github.com/mdlayher/genetlink v0.0.0-20191008151445-a2cadeac9a63 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/spf13/cobra v0.0.5 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/stretchr/objx v0.2.0 // indirect
+	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf // indirect
+	golang.org/x/net v0.0.0-20191028085509-fe3aa8a45271 // indirect
+	golang.zx2c4.com/wireguard v0.0.20191012 // indirect
+)
@@ -0,0 +1,154 @@
+// Package index keeps track of which peer has which tunnel address, so that traffic seen from an address can be traced back to a peer
+package index
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/iputil"
+)
+
+// Peer is a peer as last applied to the wireguard interfaces
+type Peer struct {
+	Pubkey string `json:"pubkey"`
+	IPv4   string `json:"ipv4"`
+	IPv6   string `json:"ipv6"`
+	// Exit is the exit the ports of the peer are forwarded on, empty for the default one
+	Exit       string   `json:"exit,omitempty"`
+	Interfaces []string `json:"interfaces"`
+	// Since is when the peer was first applied with its current addresses by this instance
+	Since time.Time `json:"since"`
+}
+
+// Index maps tunnel addresses to the peers they were last applied to
+type Index struct {
+	interfaces []string
+
+	mu        sync.RWMutex
+	peers     map[string]*Peer
+	addresses iputil.Trie[*Peer]
+}
+
+// New returns an empty Index for peers applied to the given interfaces
+func New(interfaces []string) *Index {
+	return &Index{
+		interfaces: interfaces,
+		peers:      make(map[string]*Peer),
+	}
+}
+
+// SetPeers replaces the peers with the last applied list of peers
+// Peers that kept their addresses keep the time they were first applied with them
+func (i *Index) SetPeers(peers api.WireguardPeerList) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	previous := i.peers
+
+	i.peers = make(map[string]*Peer)
+	i.addresses = iputil.Trie[*Peer]{}
+	for _, peer := range peers {
+		i.addPeer(peer, previous[peer.Pubkey], now)
+	}
+}
+
+// AddPeer adds or replaces a single peer
+func (i *Index) AddPeer(peer api.WireguardPeer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	previous := i.peers[peer.Pubkey]
+	i.removePeer(peer.Pubkey)
+	i.addPeer(peer, previous, time.Now())
+}
+
+// RemovePeer removes a single peer
+func (i *Index) RemovePeer(peer api.WireguardPeer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.removePeer(peer.Pubkey)
+}
+
+// Address returns the peer with the tunnel address
+func (i *Index) Address(addr netip.Addr) (Peer, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	_, peer, ok := i.addresses.Lookup(addr)
+	if !ok {
+		return Peer{}, false
+	}
+
+	return *peer, true
+}
+
+// Peer returns the peer with the public key
+func (i *Index) Peer(pubkey string) (Peer, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	peer, ok := i.peers[pubkey]
+	if !ok {
+		return Peer{}, false
+	}
+
+	return *peer, true
+}
+
+// Len returns the number of peers in the index
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.peers)
+}
+
+func (i *Index) addPeer(peer api.WireguardPeer, previous *Peer, now time.Time) {
+	entry := &Peer{
+		Pubkey:     peer.Pubkey,
+		IPv4:       peer.IPv4,
+		IPv6:       peer.IPv6,
+		Exit:       peer.Exit,
+		Interfaces: i.interfaces,
+		Since:      now,
+	}
+
+	if previous != nil && previous.IPv4 == peer.IPv4 && previous.IPv6 == peer.IPv6 {
+		entry.Since = previous.Since
+	}
+
+	i.peers[peer.Pubkey] = entry
+
+	// A peer with an address that can't be parsed is still found by its public key
+	for _, address := range []string{peer.IPv4, peer.IPv6} {
+		prefix, err := netip.ParsePrefix(address)
+		if err == nil {
+			i.addresses.Insert(prefix, entry)
+		}
+	}
+}
+
+func (i *Index) removePeer(pubkey string) {
+	peer, ok := i.peers[pubkey]
+	if !ok {
+		return
+	}
+
+	delete(i.peers, pubkey)
+
+	for _, address := range []string{peer.IPv4, peer.IPv6} {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			continue
+		}
+
+		// The address may have been handed to another peer since
+		if owner, ok := i.addresses.Get(prefix); ok && owner == peer {
+			i.addresses.Delete(prefix)
+		}
+	}
+}
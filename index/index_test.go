@@ -0,0 +1,59 @@
+package index_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/index"
+)
+
+func TestIndex(t *testing.T) {
+	i := index.New([]string{"wg0", "wg1"})
+	i.SetPeers(api.WireguardPeerList{
+		{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::1/128", Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: "bbbb", Exit: "se-1"},
+	})
+
+	peer, ok := i.Address(netip.MustParseAddr("fc00:bbbb:bbbb:bb01::2"))
+	if !ok || peer.Pubkey != "bbbb" || peer.Exit != "se-1" || len(peer.Interfaces) != 2 {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+
+	if _, ok := i.Address(netip.MustParseAddr("10.99.0.3")); ok {
+		t.Error("got a peer for an unassigned address")
+	}
+
+	since := peer.Since
+
+	// Peers keep the time they got their addresses at until the addresses change
+	i.SetPeers(api.WireguardPeerList{
+		{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: "bbbb", Exit: "se-1"},
+	})
+
+	if peer, _ := i.Peer("bbbb"); !peer.Since.Equal(since) {
+		t.Errorf("got since %s, expected %s", peer.Since, since)
+	}
+
+	if _, ok := i.Address(netip.MustParseAddr("10.99.0.1")); ok {
+		t.Error("got a peer for an address that was moved")
+	}
+
+	// An address handed to another peer stays with it when the previous peer is removed
+	i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.4/32", IPv6: "fc00:bbbb:bbbb:bb01::4/128", Pubkey: "bbbb"})
+	i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: "cccc"})
+	i.RemovePeer(api.WireguardPeer{Pubkey: "bbbb"})
+
+	if peer, ok := i.Address(netip.MustParseAddr("10.99.0.2")); !ok || peer.Pubkey != "cccc" {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+
+	if _, ok := i.Address(netip.MustParseAddr("10.99.0.4")); ok {
+		t.Error("got a peer for an address of a removed peer")
+	}
+
+	if i.Len() != 2 {
+		t.Errorf("got %d peers, expected 2", i.Len())
+	}
+}
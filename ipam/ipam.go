@@ -0,0 +1,475 @@
+// Package ipam keeps track of the tunnel addresses of the peers, so that peers with addresses that would break routing are never configured
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/iputil"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reasons a peer is rejected
+const (
+	ReasonInvalid     = "invalid"
+	ReasonInvalidKey  = "invalid-key"
+	ReasonOutsidePool = "outside-pool"
+	ReasonReserved    = "reserved"
+	ReasonDuplicate   = "duplicate"
+	ReasonOverlapping = "overlapping"
+)
+
+// allocationTimeout is how long an address handed out by Allocate is held back, if no peer with it is reported
+const allocationTimeout = time.Hour
+
+// Config is the configuration for the address management
+type Config struct {
+	// IPv4 and IPv6 are the tunnel address pools of the relay, peer addresses aren't checked against a pool if it's nil
+	IPv4 *net.IPNet
+	IPv6 *net.IPNet
+	// Reserved are addresses in the pools that peers can't have, such as the addresses of the wireguard interfaces
+	Reserved []net.IP
+	// Metrics is the client to send metrics to, if nil no metrics are sent
+	Metrics *statsd.Client
+}
+
+// Problem is an address of a peer that kept it from being configured, or its key if that couldn't be parsed
+type Problem struct {
+	Pubkey  string `json:"pubkey"`
+	Address string `json:"address,omitempty"`
+	Reason  string `json:"reason"`
+	// Other is the other peer with the same address, for duplicates, or with an overlapping one
+	Other string `json:"other,omitempty"`
+}
+
+// String describes why the peer isn't configured
+func (p Problem) String() string {
+	if p.Reason == ReasonInvalidKey {
+		return fmt.Sprintf("not configuring peer %q, the key is invalid", p.Pubkey)
+	}
+
+	return fmt.Sprintf("not configuring peer %s, address %s is %s", p.Pubkey, p.Address, p.Reason)
+}
+
+// Allocation is a pair of free tunnel addresses
+type Allocation struct {
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// IPAM validates the tunnel addresses of the peers, and hands out free ones
+type IPAM struct {
+	cfg     Config
+	metrics *statsd.Client
+
+	mu sync.Mutex
+	// owners maps the addresses of the configured peers to their public keys, and claimed holds the same addresses to find overlapping ones
+	owners   map[string]string
+	claimed  iputil.Trie[string]
+	problems []Problem
+	// handedOut are the addresses returned by Allocate that no peer was reported with yet, and when they stop being held back
+	handedOut map[string]time.Time
+}
+
+// New validates the configuration and returns a new IPAM
+func New(cfg Config) (*IPAM, error) {
+	if cfg.IPv4 != nil && cfg.IPv4.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 pool %s", cfg.IPv4.String())
+	}
+
+	if cfg.IPv6 != nil && cfg.IPv6.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid ipv6 pool %s", cfg.IPv6.String())
+	}
+
+	metrics := cfg.Metrics
+	if metrics == nil {
+		var err error
+		metrics, err = statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &IPAM{
+		cfg:       cfg,
+		metrics:   metrics,
+		owners:    make(map[string]string),
+		handedOut: make(map[string]time.Time),
+	}, nil
+}
+
+// SetPeers replaces the known peers, and returns the ones that are safe to configure
+// Peers with addresses that are invalid, outside of the pools or reserved are left out,
+// as are all peers sharing an address, since wireguard would silently move the address to whichever peer is configured last,
+// and all peers with overlapping addresses, since the shared addresses are only routed to one of them
+func (i *IPAM) SetPeers(peers api.WireguardPeerList) api.WireguardPeerList {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var problems []Problem
+	rejected := make(map[string]struct{})
+	claims := make(map[string][]string)
+
+	for _, peer := range peers {
+		addresses, problem := i.check(peer)
+		if problem != nil {
+			problems = append(problems, *problem)
+			rejected[peer.Pubkey] = struct{}{}
+			continue
+		}
+
+		for _, address := range addresses {
+			claims[address] = appendUnique(claims[address], peer.Pubkey)
+		}
+	}
+
+	duplicates := 0
+	for address, pubkeys := range claims {
+		if len(pubkeys) < 2 {
+			continue
+		}
+
+		duplicates++
+		sort.Strings(pubkeys)
+		for j, pubkey := range pubkeys {
+			problems = append(problems, Problem{
+				Pubkey:  pubkey,
+				Address: address,
+				Reason:  ReasonDuplicate,
+				Other:   pubkeys[(j+1)%len(pubkeys)],
+			})
+			rejected[pubkey] = struct{}{}
+		}
+	}
+
+	// Overlapping addresses are found by adding them from the shortest prefix, so that the prefixes containing each one are already added
+	prefixes := make([]netip.Prefix, 0, len(claims))
+	for address := range claims {
+		prefixes = append(prefixes, netip.MustParsePrefix(address))
+	}
+
+	sort.Slice(prefixes, func(a, b int) bool {
+		if prefixes[a].Bits() != prefixes[b].Bits() {
+			return prefixes[a].Bits() < prefixes[b].Bits()
+		}
+
+		return prefixes[a].Addr().Less(prefixes[b].Addr())
+	})
+
+	overlapping := 0
+	var added iputil.Trie[string]
+	for _, prefix := range prefixes {
+		address := prefix.String()
+		added.WalkOverlapping(prefix, func(_ netip.Prefix, other string) bool {
+			overlapping++
+			for _, pair := range [][2]string{{address, other}, {other, address}} {
+				for _, pubkey := range claims[pair[0]] {
+					problems = append(problems, Problem{
+						Pubkey:  pubkey,
+						Address: pair[0],
+						Reason:  ReasonOverlapping,
+						Other:   claims[pair[1]][0],
+					})
+					rejected[pubkey] = struct{}{}
+				}
+			}
+
+			return true
+		})
+
+		added.Insert(prefix, address)
+	}
+
+	var valid api.WireguardPeerList
+	i.owners = make(map[string]string)
+	i.claimed = iputil.Trie[string]{}
+	for _, peer := range peers {
+		addresses, _ := i.check(peer)
+		i.report(addresses)
+
+		if _, ok := rejected[peer.Pubkey]; ok {
+			continue
+		}
+
+		valid = append(valid, peer)
+		for _, address := range addresses {
+			i.own(address, peer.Pubkey)
+		}
+	}
+
+	sort.Slice(problems, func(a, b int) bool {
+		if problems[a].Address != problems[b].Address {
+			return problems[a].Address < problems[b].Address
+		}
+
+		return problems[a].Pubkey < problems[b].Pubkey
+	})
+
+	for _, problem := range problems {
+		log.Print(problem)
+	}
+
+	i.problems = problems
+	i.metrics.Gauge("ipam_rejected_peers", len(rejected))
+	i.metrics.Gauge("ipam_duplicate_addresses", duplicates)
+	i.metrics.Gauge("ipam_overlapping_addresses", overlapping)
+
+	return valid
+}
+
+// AddPeer adds a peer, and returns an error if it isn't safe to configure
+func (i *IPAM) AddPeer(peer api.WireguardPeer) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	addresses, problem := i.check(peer)
+	for _, address := range addresses {
+		if problem != nil {
+			break
+		}
+
+		i.claimed.WalkOverlapping(netip.MustParsePrefix(address), func(prefix netip.Prefix, owner string) bool {
+			if owner == peer.Pubkey {
+				return true
+			}
+
+			problem = &Problem{Pubkey: peer.Pubkey, Address: address, Reason: ReasonOverlapping, Other: owner}
+			if prefix.String() == address {
+				problem.Reason = ReasonDuplicate
+			}
+
+			return false
+		})
+	}
+
+	if problem != nil {
+		i.metrics.Increment("ipam_rejected_events")
+		return errors.New(problem.String())
+	}
+
+	i.removePeer(peer.Pubkey)
+	i.report(addresses)
+	for _, address := range addresses {
+		i.own(address, peer.Pubkey)
+	}
+
+	return nil
+}
+
+// RemovePeer releases the addresses of a peer
+func (i *IPAM) RemovePeer(peer api.WireguardPeer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.removePeer(peer.Pubkey)
+}
+
+func (i *IPAM) removePeer(pubkey string) {
+	for address, owner := range i.owners {
+		if owner == pubkey {
+			delete(i.owners, address)
+			i.claimed.Delete(netip.MustParsePrefix(address))
+		}
+	}
+}
+
+// own records the owner of an address
+func (i *IPAM) own(address string, pubkey string) {
+	i.owners[address] = pubkey
+	i.claimed.Insert(netip.MustParsePrefix(address), pubkey)
+}
+
+// report stops holding back handed out addresses that a peer was reported with
+func (i *IPAM) report(addresses []string) {
+	for _, address := range addresses {
+		delete(i.handedOut, address)
+	}
+}
+
+// Problems returns the problems found the last time the peers were set
+func (i *IPAM) Problems() []Problem {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	problems := make([]Problem, len(i.problems))
+	copy(problems, i.problems)
+
+	return problems
+}
+
+// Allocate returns the first free address of each pool, for peers that aren't managed through the API
+// The addresses are held back from later allocations until a peer with them is reported, or for an hour if none is
+func (i *IPAM) Allocate() (Allocation, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.cfg.IPv4 == nil && i.cfg.IPv6 == nil {
+		return Allocation{}, fmt.Errorf("no tunnel address pools are configured")
+	}
+
+	now := time.Now()
+	for address, expires := range i.handedOut {
+		if !now.Before(expires) {
+			delete(i.handedOut, address)
+		}
+	}
+
+	var allocation Allocation
+	if i.cfg.IPv4 != nil {
+		address, ok := i.allocate(i.cfg.IPv4)
+		if !ok {
+			return Allocation{}, fmt.Errorf("the ipv4 pool %s is exhausted", i.cfg.IPv4.String())
+		}
+
+		allocation.IPv4 = address
+	}
+
+	if i.cfg.IPv6 != nil {
+		address, ok := i.allocate(i.cfg.IPv6)
+		if !ok {
+			return Allocation{}, fmt.Errorf("the ipv6 pool %s is exhausted", i.cfg.IPv6.String())
+		}
+
+		allocation.IPv6 = address
+	}
+
+	for _, address := range []string{allocation.IPv4, allocation.IPv6} {
+		if address != "" {
+			i.handedOut[address] = now.Add(allocationTimeout)
+		}
+	}
+
+	return allocation, nil
+}
+
+// allocate returns the first host address in the pool that isn't used, handed out already, reserved, the network address or the ipv4 broadcast address
+func (i *IPAM) allocate(pool *net.IPNet) (string, bool) {
+	ones, bits := pool.Mask.Size()
+	network := pool.IP.Mask(pool.Mask)
+
+	ip := next(network)
+	for pool.Contains(ip) {
+		address := hostNet(ip, bits).String()
+		addr, _ := netip.AddrFromSlice(ip)
+		_, _, used := i.claimed.Lookup(addr)
+		_, handedOut := i.handedOut[address]
+		if !used && !handedOut && !i.reserved(ip) && !(bits == 32 && ones < 31 && isBroadcast(ip, pool)) {
+			return address, true
+		}
+
+		ip = next(ip)
+		if ip.Equal(network) {
+			// Wrapped around the end of the address space
+			break
+		}
+	}
+
+	return "", false
+}
+
+// check parses the addresses of a peer, and returns the problem with the first address that can't be configured
+func (i *IPAM) check(peer api.WireguardPeer) ([]string, *Problem) {
+	// A peer with a key wireguard can't parse is never configured, so it would only be retried forever
+	_, err := wgtypes.ParseKey(peer.Pubkey)
+	if err != nil {
+		return nil, &Problem{Pubkey: peer.Pubkey, Reason: ReasonInvalidKey}
+	}
+
+	var addresses []string
+	for _, family := range []struct {
+		address string
+		pool    *net.IPNet
+		ipv4    bool
+	}{
+		{peer.IPv4, i.cfg.IPv4, true},
+		{peer.IPv6, i.cfg.IPv6, false},
+	} {
+		ip, ipNet, err := net.ParseCIDR(family.address)
+		if err != nil || (ip.To4() != nil) != family.ipv4 {
+			return nil, &Problem{Pubkey: peer.Pubkey, Address: family.address, Reason: ReasonInvalid}
+		}
+
+		address := ipNet.String()
+
+		if family.pool != nil {
+			poolOnes, _ := family.pool.Mask.Size()
+			ones, _ := ipNet.Mask.Size()
+			if ones < poolOnes || !family.pool.Contains(ipNet.IP) {
+				return nil, &Problem{Pubkey: peer.Pubkey, Address: address, Reason: ReasonOutsidePool}
+			}
+		}
+
+		for _, reserved := range i.cfg.Reserved {
+			if ipNet.Contains(reserved) {
+				return nil, &Problem{Pubkey: peer.Pubkey, Address: address, Reason: ReasonReserved}
+			}
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+func (i *IPAM) reserved(ip net.IP) bool {
+	for _, reserved := range i.cfg.Reserved {
+		if reserved.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// next returns the address after the given one
+func next(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+
+	for j := len(n) - 1; j >= 0; j-- {
+		n[j]++
+		if n[j] != 0 {
+			break
+		}
+	}
+
+	return n
+}
+
+// hostNet returns the network containing only the given address
+func hostNet(ip net.IP, bits int) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func isBroadcast(ip net.IP, pool *net.IPNet) bool {
+	ip = ip.To4()
+	for j := range ip {
+		if ip[j]|pool.Mask[j] != 0xff {
+			return false
+		}
+	}
+
+	return true
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+
+	return append(list, s)
+}
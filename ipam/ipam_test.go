@@ -0,0 +1,220 @@
+package ipam_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/ipam"
+)
+
+// Placeholder public keys, which are valid base64 encoded wireguard keys
+var (
+	keyA = testKey("a")
+	keyB = testKey("b")
+	keyC = testKey("c")
+	keyD = testKey("d")
+	keyE = testKey("e")
+	keyF = testKey("f")
+	keyG = testKey("g")
+)
+
+func testKey(s string) string {
+	return strings.Repeat(s, 43) + "="
+}
+
+func newTestIPAM(t *testing.T) *ipam.IPAM {
+	_, ipv4, _ := net.ParseCIDR("10.99.0.0/29")
+	_, ipv6, _ := net.ParseCIDR("fc00:bbbb:bbbb:bb01::/64")
+
+	i, err := ipam.New(ipam.Config{
+		IPv4:     ipv4,
+		IPv6:     ipv6,
+		Reserved: []net.IP{net.ParseIP("10.99.0.1"), net.ParseIP("fc00:bbbb:bbbb:bb01::1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func TestSetPeers(t *testing.T) {
+	i := newTestIPAM(t)
+
+	peers := api.WireguardPeerList{
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: keyA},
+		{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: keyB},
+		{IPv4: "10.98.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: keyC},
+		{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::4/128", Pubkey: keyD},
+		{IPv4: "10.99.0.3/32", IPv6: "invalid", Pubkey: keyE},
+		{IPv4: "10.99.0.0/29", IPv6: "fc00:bbbb:bbbb:bb01::5/128", Pubkey: keyF},
+		{IPv4: "10.99.0.4/32", IPv6: "fc00:bbbb:bbbb:bb01::6/128", Pubkey: keyG},
+		{IPv4: "10.99.0.5/32", IPv6: "fc00:bbbb:bbbb:bb01::7/128", Pubkey: "invalid"},
+	}
+
+	valid := i.SetPeers(peers)
+	if diff := cmp.Diff(api.WireguardPeerList{peers[6]}, valid); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	expected := []ipam.Problem{
+		{Pubkey: "invalid", Reason: ipam.ReasonInvalidKey},
+		{Pubkey: keyC, Address: "10.98.0.2/32", Reason: ipam.ReasonOutsidePool},
+		{Pubkey: keyF, Address: "10.99.0.0/29", Reason: ipam.ReasonReserved},
+		{Pubkey: keyD, Address: "10.99.0.1/32", Reason: ipam.ReasonReserved},
+		{Pubkey: keyA, Address: "fc00:bbbb:bbbb:bb01::2/128", Reason: ipam.ReasonDuplicate, Other: keyB},
+		{Pubkey: keyB, Address: "fc00:bbbb:bbbb:bb01::2/128", Reason: ipam.ReasonDuplicate, Other: keyA},
+		{Pubkey: keyE, Address: "invalid", Reason: ipam.ReasonInvalid},
+	}
+
+	if diff := cmp.Diff(expected, i.Problems()); diff != "" {
+		t.Errorf("unexpected problems (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	i := newTestIPAM(t)
+	i.SetPeers(api.WireguardPeerList{
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: keyA},
+	})
+
+	err := i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: keyB})
+	if err == nil {
+		t.Error("expected an error for a duplicate address")
+	}
+
+	// Peers can be added again, and move to new addresses
+	err = i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: keyA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: keyB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i.RemovePeer(api.WireguardPeer{Pubkey: keyA})
+	err = i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: keyC})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	i := newTestIPAM(t)
+	i.SetPeers(api.WireguardPeerList{
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: keyA},
+	})
+
+	// The network, reserved and used addresses are skipped
+	allocation, err := i.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ipam.Allocation{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128"}
+	if diff := cmp.Diff(expected, allocation); diff != "" {
+		t.Errorf("unexpected allocation (-want +got):\n%s", diff)
+	}
+
+	err = i.AddPeer(api.WireguardPeer{IPv4: allocation.IPv4, IPv6: allocation.IPv6, Pubkey: keyB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ipv6 pool has plenty of room left, but both pools need a free address
+	for _, peer := range []api.WireguardPeer{
+		{IPv4: "10.99.0.4/32", IPv6: "fc00:bbbb:bbbb:bb01::4/128", Pubkey: keyC},
+		{IPv4: "10.99.0.5/32", IPv6: "fc00:bbbb:bbbb:bb01::5/128", Pubkey: keyD},
+		{IPv4: "10.99.0.6/32", IPv6: "fc00:bbbb:bbbb:bb01::6/128", Pubkey: keyE},
+	} {
+		err = i.AddPeer(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = i.Allocate()
+	if err == nil {
+		t.Error("expected an error for an exhausted pool")
+	}
+}
+
+func TestSetPeersOverlapping(t *testing.T) {
+	i := newTestIPAM(t)
+
+	peers := api.WireguardPeerList{
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::102/128", Pubkey: keyA},
+		{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::100/120", Pubkey: keyB},
+		{IPv4: "10.99.0.4/32", IPv6: "fc00:bbbb:bbbb:bb01::1:2/128", Pubkey: keyC},
+	}
+
+	valid := i.SetPeers(peers)
+	if diff := cmp.Diff(api.WireguardPeerList{peers[2]}, valid); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	expected := []ipam.Problem{
+		{Pubkey: keyB, Address: "fc00:bbbb:bbbb:bb01::100/120", Reason: ipam.ReasonOverlapping, Other: keyA},
+		{Pubkey: keyA, Address: "fc00:bbbb:bbbb:bb01::102/128", Reason: ipam.ReasonOverlapping, Other: keyB},
+	}
+
+	if diff := cmp.Diff(expected, i.Problems()); diff != "" {
+		t.Errorf("unexpected problems (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddPeerOverlapping(t *testing.T) {
+	i := newTestIPAM(t)
+	i.SetPeers(api.WireguardPeerList{
+		{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::102/128", Pubkey: keyA},
+	})
+
+	err := i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::100/120", Pubkey: keyB})
+	if err == nil {
+		t.Error("expected an error for an overlapping address")
+	}
+
+	// A peer's own addresses don't overlap with its new ones
+	err = i.AddPeer(api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::100/120", Pubkey: keyA})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateHoldsAddresses(t *testing.T) {
+	i := newTestIPAM(t)
+	i.SetPeers(nil)
+
+	first, err := i.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := i.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ipam.Allocation{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128"}
+	if diff := cmp.Diff(expected, second); diff != "" {
+		t.Errorf("unexpected allocation (-want +got):\n%s", diff)
+	}
+
+	// Addresses that a peer was reported with and removed again are free
+	i.SetPeers(api.WireguardPeerList{{IPv4: first.IPv4, IPv6: first.IPv6, Pubkey: keyA}})
+	i.RemovePeer(api.WireguardPeer{Pubkey: keyA})
+
+	third, err := i.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(first, third); diff != "" {
+		t.Errorf("unexpected allocation (-want +got):\n%s", diff)
+	}
+}
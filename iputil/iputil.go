@@ -5,7 +5,18 @@ import (
 	"sort"
 )
 
-// EqualIPNet checks whether two slices of IPNet are equal
+// Ranges that aren't reachable from the internet, in addition to loopback, link-local and multicast addresses
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// EqualIPNet checks whether two slices of IPNet have the same networks in any order, without modifying them
+// Unlike a PrefixSet, it also compares networks with masks that aren't a prefix length
 func EqualIPNet(a []net.IPNet, b []net.IPNet) bool {
 	if (a == nil) != (b == nil) {
 		return false
@@ -15,6 +26,8 @@ func EqualIPNet(a []net.IPNet, b []net.IPNet) bool {
 		return false
 	}
 
+	a = append([]net.IPNet(nil), a...)
+	b = append([]net.IPNet(nil), b...)
 	sort.Slice(a, compareIPNet(a))
 	sort.Slice(b, compareIPNet(b))
 
@@ -27,8 +40,37 @@ func EqualIPNet(a []net.IPNet, b []net.IPNet) bool {
 	return true
 }
 
+// IsPublic checks whether an address is a global unicast address outside of the private and shared address ranges
+func IsPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func compareIPNet(ips []net.IPNet) func(i int, j int) bool {
 	return func(i int, j int) bool {
 		return ips[i].String() < ips[j].String()
 	}
 }
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets[i] = n
+	}
+
+	return nets
+}
@@ -50,4 +50,36 @@ func TestEqualIPNet(t *testing.T) {
 			t.Errorf("%s: got %v, expected %v", test.Name, matches, test.ExpectedResult)
 		}
 	}
+
+	// The slices are left in the order they were in
+	if !tests[0].IPNet[0].IP.Equal(net.ParseIP("2.2.2.2")) {
+		t.Errorf("the slice was sorted in place: %v", tests[0].IPNet)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		IP             string
+		ExpectedResult bool
+	}{
+		{"185.65.135.1", true},
+		{"2a03:1b20::1", true},
+		{"10.64.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.0.1", false},
+		{"fc00:bbbb:bbbb:bb01::1", false},
+		{"fe80::1", false},
+		{"::1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		result := iputil.IsPublic(net.ParseIP(test.IP))
+		if result != test.ExpectedResult {
+			t.Errorf("%s: got %v, expected %v", test.IP, result, test.ExpectedResult)
+		}
+	}
 }
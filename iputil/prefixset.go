@@ -0,0 +1,213 @@
+package iputil
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// PrefixSet is an immutable set of prefixes, such as the allowed IPs of a peer
+// Prefixes are stored masked, so 10.0.0.1/8 and 10.0.0.0/8 are the same element
+type PrefixSet struct {
+	// prefixes are sorted and free of duplicates
+	prefixes []netip.Prefix
+}
+
+// NewPrefixSet returns a set of the given prefixes, invalid prefixes are left out
+func NewPrefixSet(prefixes ...netip.Prefix) PrefixSet {
+	s := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			s = append(s, p.Masked())
+		}
+	}
+
+	return newSorted(s)
+}
+
+// PrefixSetFromIPNets returns a set of the given networks, without modifying them
+func PrefixSetFromIPNets(nets []net.IPNet) (PrefixSet, error) {
+	prefixes := make([]netip.Prefix, len(nets))
+	for i, n := range nets {
+		p, err := PrefixFromIPNet(n)
+		if err != nil {
+			return PrefixSet{}, err
+		}
+
+		prefixes[i] = p
+	}
+
+	return NewPrefixSet(prefixes...), nil
+}
+
+// PrefixFromIPNet converts a network to a prefix, networks with masks that aren't a prefix length are invalid
+func PrefixFromIPNet(n net.IPNet) (netip.Prefix, error) {
+	addr, ok := netip.AddrFromSlice(n.IP)
+	ones, bits := n.Mask.Size()
+	if !ok || bits == 0 {
+		return netip.Prefix{}, fmt.Errorf("invalid network %s", n.String())
+	}
+
+	// Like the net package, ipv4 addresses in the ipv6 form are treated as ipv4 addresses, and so are the masks
+	addr = addr.Unmap()
+	if addr.Is4() && bits == 128 {
+		ones, bits = ones-96, 32
+	}
+
+	p := netip.PrefixFrom(addr, ones)
+	if addr.BitLen() != bits || !p.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid network %s", n.String())
+	}
+
+	return p.Masked(), nil
+}
+
+// Prefixes returns the prefixes in the set, sorted
+func (s PrefixSet) Prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(s.prefixes))
+	copy(prefixes, s.prefixes)
+
+	return prefixes
+}
+
+// IPNets returns the prefixes in the set as networks, sorted
+func (s PrefixSet) IPNets() []net.IPNet {
+	nets := make([]net.IPNet, len(s.prefixes))
+	for i, p := range s.prefixes {
+		nets[i] = net.IPNet{
+			IP:   net.IP(p.Addr().AsSlice()),
+			Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+		}
+	}
+
+	return nets
+}
+
+// Len returns the number of prefixes in the set
+func (s PrefixSet) Len() int {
+	return len(s.prefixes)
+}
+
+// Equal checks whether two sets have the same prefixes
+func (s PrefixSet) Equal(o PrefixSet) bool {
+	if len(s.prefixes) != len(o.prefixes) {
+		return false
+	}
+
+	for i := range s.prefixes {
+		if s.prefixes[i] != o.prefixes[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Union returns the prefixes in either set
+func (s PrefixSet) Union(o PrefixSet) PrefixSet {
+	prefixes := make([]netip.Prefix, 0, len(s.prefixes)+len(o.prefixes))
+	prefixes = append(prefixes, s.prefixes...)
+	prefixes = append(prefixes, o.prefixes...)
+
+	return newSorted(prefixes)
+}
+
+// Difference returns the prefixes in the set that aren't in the other one
+func (s PrefixSet) Difference(o PrefixSet) PrefixSet {
+	var prefixes []netip.Prefix
+	for _, p := range s.prefixes {
+		if !o.Has(p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return PrefixSet{prefixes: prefixes}
+}
+
+// Has checks whether the prefix is in the set
+func (s PrefixSet) Has(p netip.Prefix) bool {
+	p = p.Masked()
+	i := sort.Search(len(s.prefixes), func(i int) bool {
+		return !lessPrefix(s.prefixes[i], p)
+	})
+
+	return i < len(s.prefixes) && s.prefixes[i] == p
+}
+
+// Contains checks whether any prefix in the set contains the address
+func (s PrefixSet) Contains(addr netip.Addr) bool {
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContainsPrefix checks whether any prefix in the set contains every address of the given prefix
+func (s PrefixSet) ContainsPrefix(p netip.Prefix) bool {
+	for _, q := range s.prefixes {
+		if q.Bits() <= p.Bits() && q.Contains(p.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Overlaps checks whether any prefix in the set shares addresses with the given prefix
+func (s PrefixSet) Overlaps(p netip.Prefix) bool {
+	for _, q := range s.prefixes {
+		if q.Overlaps(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OverlapsSet checks whether any prefix in the set shares addresses with any prefix in the other set
+func (s PrefixSet) OverlapsSet(o PrefixSet) bool {
+	for _, p := range o.prefixes {
+		if s.Overlaps(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s PrefixSet) String() string {
+	return fmt.Sprint(s.prefixes)
+}
+
+// newSorted sorts and removes duplicates from prefixes that are already masked
+func newSorted(prefixes []netip.Prefix) PrefixSet {
+	sort.Slice(prefixes, func(i int, j int) bool {
+		return lessPrefix(prefixes[i], prefixes[j])
+	})
+
+	unique := prefixes[:0]
+	for _, p := range prefixes {
+		if len(unique) == 0 || p != unique[len(unique)-1] {
+			unique = append(unique, p)
+		}
+	}
+
+	if len(unique) == 0 {
+		return PrefixSet{}
+	}
+
+	return PrefixSet{prefixes: unique}
+}
+
+// lessPrefix orders prefixes by address, then by length
+func lessPrefix(a netip.Prefix, b netip.Prefix) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+
+	return a.Bits() < b.Bits()
+}
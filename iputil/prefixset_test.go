@@ -0,0 +1,103 @@
+package iputil_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/iputil"
+)
+
+func prefixes(s ...string) []netip.Prefix {
+	p := make([]netip.Prefix, len(s))
+	for i, prefix := range s {
+		p[i] = netip.MustParsePrefix(prefix)
+	}
+
+	return p
+}
+
+func TestPrefixSet(t *testing.T) {
+	a := iputil.NewPrefixSet(prefixes("fc00::2/128", "10.0.0.1/32", "10.0.0.1/8", "10.0.0.0/8")...)
+	b := iputil.NewPrefixSet(prefixes("10.0.0.0/8", "10.0.0.1/32", "fc00::2/128")...)
+	c := iputil.NewPrefixSet(prefixes("10.0.0.1/32", "192.168.0.0/24")...)
+
+	if !a.Equal(b) {
+		t.Errorf("expected %s to equal %s", a, b)
+	}
+
+	if a.Equal(c) {
+		t.Errorf("expected %s not to equal %s", a, c)
+	}
+
+	tests := []struct {
+		name     string
+		set      iputil.PrefixSet
+		expected []netip.Prefix
+	}{
+		{"sorted without duplicates", a, prefixes("10.0.0.0/8", "10.0.0.1/32", "fc00::2/128")},
+		{"union", a.Union(c), prefixes("10.0.0.0/8", "10.0.0.1/32", "192.168.0.0/24", "fc00::2/128")},
+		{"difference", a.Difference(c), prefixes("10.0.0.0/8", "fc00::2/128")},
+		{"empty difference", a.Difference(b), []netip.Prefix{}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.expected, test.set.Prefixes(), cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+			t.Errorf("%s: unexpected prefixes (-want +got):\n%s", test.name, diff)
+		}
+	}
+
+	if !a.Has(netip.MustParsePrefix("10.1.0.0/8")) || a.Has(netip.MustParsePrefix("10.0.0.0/16")) {
+		t.Error("unexpected membership")
+	}
+
+	if !c.Contains(netip.MustParseAddr("192.168.0.5")) || c.Contains(netip.MustParseAddr("10.0.0.2")) {
+		t.Error("unexpected address containment")
+	}
+
+	if !a.ContainsPrefix(netip.MustParsePrefix("10.1.0.0/16")) || c.ContainsPrefix(netip.MustParsePrefix("192.168.0.0/16")) {
+		t.Error("unexpected prefix containment")
+	}
+
+	if !c.Overlaps(netip.MustParsePrefix("192.168.0.0/16")) || c.Overlaps(netip.MustParsePrefix("172.16.0.0/12")) {
+		t.Error("unexpected overlap")
+	}
+
+	if !a.OverlapsSet(c) || b.OverlapsSet(iputil.NewPrefixSet(prefixes("192.168.0.0/16")...)) {
+		t.Error("unexpected set overlap")
+	}
+}
+
+func TestPrefixSetFromIPNets(t *testing.T) {
+	nets := []net.IPNet{
+		{IP: net.ParseIP("fc00::2"), Mask: net.CIDRMask(128, 128)},
+		{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(120, 128)},
+	}
+
+	set, err := iputil.PrefixSetFromIPNets(nets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := iputil.NewPrefixSet(prefixes("10.0.0.1/32", "10.0.0.0/24", "fc00::2/128")...)
+	if !set.Equal(expected) {
+		t.Errorf("got %s, expected %s", set, expected)
+	}
+
+	// The networks are left as they were
+	if !nets[0].IP.Equal(net.ParseIP("fc00::2")) {
+		t.Errorf("the networks were modified: %v", nets)
+	}
+
+	roundTrip, err := iputil.PrefixSetFromIPNets(set.IPNets())
+	if err != nil || !roundTrip.Equal(set) {
+		t.Errorf("got %s after a round trip, expected %s", roundTrip, set)
+	}
+
+	_, err = iputil.PrefixSetFromIPNets([]net.IPNet{{IP: net.ParseIP("1.1.1.1"), Mask: net.IPv4Mask(1, 1, 1, 1)}})
+	if err == nil {
+		t.Error("expected an error for a mask that isn't a prefix length")
+	}
+}
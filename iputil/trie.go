@@ -0,0 +1,275 @@
+package iputil
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// Trie maps prefixes to values, and finds the longest prefix containing an address in time proportional to the address length
+// It's a path compressed binary radix trie, with one root per address family, so it stays small for long prefixes such as peer addresses
+type Trie[T any] struct {
+	ipv4 *trieNode[T]
+	ipv6 *trieNode[T]
+	size int
+}
+
+// trieNode is either a prefix in the trie, or a branch where the prefixes below it diverge
+type trieNode[T any] struct {
+	prefix   netip.Prefix
+	children [2]*trieNode[T]
+	value    T
+	set      bool
+}
+
+// Insert adds a prefix to the trie, replacing the value of the prefix if it's already in it
+func (t *Trie[T]) Insert(p netip.Prefix, value T) {
+	p, ok := normalizePrefix(p)
+	if !ok {
+		return
+	}
+
+	np := t.root(p.Addr())
+	for {
+		n := *np
+		if n == nil {
+			*np = &trieNode[T]{prefix: p, value: value, set: true}
+			t.size++
+			return
+		}
+
+		common := commonBits(n.prefix, p)
+		switch {
+		case common == n.prefix.Bits() && common == p.Bits():
+			if !n.set {
+				t.size++
+			}
+
+			n.value = value
+			n.set = true
+			return
+		case common == n.prefix.Bits():
+			// The prefix is below the node
+			np = &n.children[bit(p.Addr(), common)]
+			continue
+		case common == p.Bits():
+			// The prefix is above the node
+			parent := &trieNode[T]{prefix: p, value: value, set: true}
+			parent.children[bit(n.prefix.Addr(), common)] = n
+			*np = parent
+		default:
+			// The prefix and the node diverge, so they're placed below a new branch
+			branch := &trieNode[T]{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+			branch.children[bit(p.Addr(), common)] = &trieNode[T]{prefix: p, value: value, set: true}
+			branch.children[bit(n.prefix.Addr(), common)] = n
+			*np = branch
+		}
+
+		t.size++
+		return
+	}
+}
+
+// Delete removes a prefix from the trie, and returns whether it was in it
+func (t *Trie[T]) Delete(p netip.Prefix) bool {
+	p, ok := normalizePrefix(p)
+	if !ok {
+		return false
+	}
+
+	return t.delete(t.root(p.Addr()), p)
+}
+
+func (t *Trie[T]) delete(np **trieNode[T], p netip.Prefix) bool {
+	n := *np
+	if n == nil || n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+		return false
+	}
+
+	if n.prefix == p {
+		if !n.set {
+			return false
+		}
+
+		var zero T
+		n.value = zero
+		n.set = false
+		t.size--
+	} else if !t.delete(&n.children[bit(p.Addr(), n.prefix.Bits())], p) {
+		return false
+	}
+
+	// Branches are only needed while there are prefixes on both sides of them
+	if !n.set {
+		switch {
+		case n.children[0] == nil:
+			*np = n.children[1]
+		case n.children[1] == nil:
+			*np = n.children[0]
+		}
+	}
+
+	return true
+}
+
+// Get returns the value of exactly the given prefix
+func (t *Trie[T]) Get(p netip.Prefix) (T, bool) {
+	var zero T
+
+	p, ok := normalizePrefix(p)
+	if !ok {
+		return zero, false
+	}
+
+	n := *t.root(p.Addr())
+	for n != nil && n.prefix.Bits() <= p.Bits() && n.prefix.Contains(p.Addr()) {
+		if n.prefix == p {
+			if !n.set {
+				break
+			}
+
+			return n.value, true
+		}
+
+		n = n.children[bit(p.Addr(), n.prefix.Bits())]
+	}
+
+	return zero, false
+}
+
+// Lookup returns the longest prefix containing the address, along with its value
+func (t *Trie[T]) Lookup(addr netip.Addr) (netip.Prefix, T, bool) {
+	var zero T
+	if !addr.IsValid() {
+		return netip.Prefix{}, zero, false
+	}
+
+	addr = addr.Unmap()
+
+	var match *trieNode[T]
+	n := *t.root(addr)
+	for n != nil && n.prefix.Contains(addr) {
+		if n.set {
+			match = n
+		}
+
+		if n.prefix.Bits() == addr.BitLen() {
+			break
+		}
+
+		n = n.children[bit(addr, n.prefix.Bits())]
+	}
+
+	if match == nil {
+		return netip.Prefix{}, zero, false
+	}
+
+	return match.prefix, match.value, true
+}
+
+// WalkOverlapping calls the function for every prefix in the trie that shares addresses with the given prefix, until it returns false
+// The prefixes containing the given prefix come first, from the shortest, followed by the prefixes within it in address order
+func (t *Trie[T]) WalkOverlapping(p netip.Prefix, f func(netip.Prefix, T) bool) {
+	p, ok := normalizePrefix(p)
+	if !ok {
+		return
+	}
+
+	n := *t.root(p.Addr())
+	for n != nil {
+		if n.prefix.Bits() >= p.Bits() {
+			// Everything below the node is within the prefix, if the node is
+			if p.Contains(n.prefix.Addr()) {
+				walk(n, f)
+			}
+
+			return
+		}
+
+		if !n.prefix.Contains(p.Addr()) {
+			return
+		}
+
+		if n.set && !f(n.prefix, n.value) {
+			return
+		}
+
+		n = n.children[bit(p.Addr(), n.prefix.Bits())]
+	}
+}
+
+// Len returns the number of prefixes in the trie
+func (t *Trie[T]) Len() int {
+	return t.size
+}
+
+// Walk calls the function for every prefix in the trie, ipv4 prefixes first, in address order, until it returns false
+func (t *Trie[T]) Walk(f func(netip.Prefix, T) bool) {
+	if walk(t.ipv4, f) {
+		walk(t.ipv6, f)
+	}
+}
+
+func walk[T any](n *trieNode[T], f func(netip.Prefix, T) bool) bool {
+	if n == nil {
+		return true
+	}
+
+	if n.set && !f(n.prefix, n.value) {
+		return false
+	}
+
+	return walk(n.children[0], f) && walk(n.children[1], f)
+}
+
+// root returns the root of the family of the address
+func (t *Trie[T]) root(addr netip.Addr) **trieNode[T] {
+	if addr.Is4() {
+		return &t.ipv4
+	}
+
+	return &t.ipv6
+}
+
+// normalizePrefix masks the prefix, and converts ipv4 prefixes in the ipv6 form to ipv4 ones
+func normalizePrefix(p netip.Prefix) (netip.Prefix, bool) {
+	if !p.IsValid() {
+		return netip.Prefix{}, false
+	}
+
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+
+	return p.Masked(), true
+}
+
+// commonBits returns the length of the longest prefix shared by two prefixes of the same family
+func commonBits(a netip.Prefix, b netip.Prefix) int {
+	max := a.Bits()
+	if b.Bits() < max {
+		max = b.Bits()
+	}
+
+	x, y := a.Addr().AsSlice(), b.Addr().AsSlice()
+	common := 0
+	for i := range x {
+		if x[i] != y[i] {
+			common += bits.LeadingZeros8(x[i] ^ y[i])
+			break
+		}
+
+		common += 8
+	}
+
+	if common > max {
+		return max
+	}
+
+	return common
+}
+
+// bit returns the bit at the given position of an address, counting from the most significant bit
+func bit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
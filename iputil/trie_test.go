@@ -0,0 +1,128 @@
+package iputil_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/mullvad/wg-manager/iputil"
+)
+
+func TestTrie(t *testing.T) {
+	var trie iputil.Trie[string]
+	for _, p := range []string{"10.0.0.0/8", "10.64.0.0/10", "10.64.0.1/32", "10.64.0.2/32", "0.0.0.0/0", "fc00::/7", "fc00::1/128"} {
+		trie.Insert(netip.MustParsePrefix(p), p)
+	}
+
+	// Replacing a value doesn't add a prefix
+	trie.Insert(netip.MustParsePrefix("10.64.0.1/32"), "10.64.0.1/32")
+
+	if trie.Len() != 7 {
+		t.Errorf("got %d prefixes, expected 7", trie.Len())
+	}
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"10.64.0.1", "10.64.0.1/32"},
+		{"10.64.0.3", "10.64.0.0/10"},
+		{"10.1.0.1", "10.0.0.0/8"},
+		{"192.168.0.1", "0.0.0.0/0"},
+		{"::ffff:10.64.0.2", "10.64.0.2/32"},
+		{"fc00::1", "fc00::1/128"},
+		{"fd00::1", "fc00::/7"},
+		{"2001:db8::1", ""},
+	}
+
+	for _, test := range tests {
+		_, value, _ := trie.Lookup(netip.MustParseAddr(test.addr))
+		if value != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.addr, value, test.expected)
+		}
+	}
+
+	if value, ok := trie.Get(netip.MustParsePrefix("10.64.0.0/10")); !ok || value != "10.64.0.0/10" {
+		t.Errorf("got %q for an exact match", value)
+	}
+
+	if _, ok := trie.Get(netip.MustParsePrefix("10.64.0.0/30")); ok {
+		t.Error("got a value for a branch that isn't a prefix in the trie")
+	}
+
+	if !trie.Delete(netip.MustParsePrefix("10.64.0.0/10")) || trie.Delete(netip.MustParsePrefix("10.64.0.0/10")) {
+		t.Error("expected the prefix to be deleted once")
+	}
+
+	_, value, _ := trie.Lookup(netip.MustParseAddr("10.64.0.3"))
+	if value != "10.0.0.0/8" {
+		t.Errorf("got %q after deleting, expected 10.0.0.0/8", value)
+	}
+
+	var walked []string
+	trie.Walk(func(p netip.Prefix, value string) bool {
+		walked = append(walked, p.String())
+		return true
+	})
+
+	expected := []string{"0.0.0.0/0", "10.0.0.0/8", "10.64.0.1/32", "10.64.0.2/32", "fc00::/7", "fc00::1/128"}
+	if len(walked) != len(expected) {
+		t.Fatalf("walked %v, expected %v", walked, expected)
+	}
+
+	for i := range expected {
+		if walked[i] != expected[i] {
+			t.Errorf("walked %v, expected %v", walked, expected)
+			break
+		}
+	}
+}
+
+func TestTrieWalkOverlapping(t *testing.T) {
+	var trie iputil.Trie[string]
+	for _, p := range []string{"10.0.0.0/8", "10.64.0.0/24", "10.64.0.5/32", "10.64.0.6/32", "10.65.0.1/32", "fc00::1/128"} {
+		trie.Insert(netip.MustParsePrefix(p), p)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"10.64.0.5/32", []string{"10.0.0.0/8", "10.64.0.0/24", "10.64.0.5/32"}},
+		{"10.64.0.0/16", []string{"10.0.0.0/8", "10.64.0.0/24", "10.64.0.5/32", "10.64.0.6/32"}},
+		{"10.64.0.4/30", []string{"10.0.0.0/8", "10.64.0.0/24", "10.64.0.5/32", "10.64.0.6/32"}},
+		{"10.64.1.0/24", []string{"10.0.0.0/8"}},
+		{"0.0.0.0/0", []string{"10.0.0.0/8", "10.64.0.0/24", "10.64.0.5/32", "10.64.0.6/32", "10.65.0.1/32"}},
+		{"192.168.0.0/16", nil},
+		{"fc00::/64", []string{"fc00::1/128"}},
+	}
+
+	for _, test := range tests {
+		var walked []string
+		trie.WalkOverlapping(netip.MustParsePrefix(test.prefix), func(p netip.Prefix, value string) bool {
+			walked = append(walked, value)
+			return true
+		})
+
+		if len(walked) != len(test.expected) {
+			t.Errorf("%s: walked %v, expected %v", test.prefix, walked, test.expected)
+			continue
+		}
+
+		for i := range walked {
+			if walked[i] != test.expected[i] {
+				t.Errorf("%s: walked %v, expected %v", test.prefix, walked, test.expected)
+				break
+			}
+		}
+	}
+
+	// Walking stops when the function returns false
+	count := 0
+	trie.WalkOverlapping(netip.MustParsePrefix("10.64.0.0/16"), func(netip.Prefix, string) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("walked %d prefixes after stopping, expected 1", count)
+	}
+}
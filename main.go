@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,18 +19,28 @@ import (
 	"github.com/DMarby/jitter"
 	"github.com/infosum/statsd"
 	"github.com/jamiealquiza/envy"
+	"github.com/mullvad/wg-manager/admin"
 	"github.com/mullvad/wg-manager/api"
 	"github.com/mullvad/wg-manager/api/subscriber"
+	"github.com/mullvad/wg-manager/index"
+	"github.com/mullvad/wg-manager/ipam"
+	"github.com/mullvad/wg-manager/pcp"
 	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/reconcile"
 	"github.com/mullvad/wg-manager/wireguard"
 )
 
 var (
-	a          *api.API
-	wg         *wireguard.Wireguard
-	pf         *portforward.Portforward
-	metrics    *statsd.Client
-	appVersion string // Populated during build time
+	a              *api.API
+	wg             *wireguard.Wireguard
+	pf             *portforward.Portforward
+	pcpServer      *pcp.Server
+	addresses      *ipam.IPAM
+	peerIndex      *index.Index
+	reconciler     *reconcile.Reconciler
+	conflictReport string
+	metrics        *statsd.Client
+	appVersion     string // Populated during build time
 )
 
 func main() {
@@ -39,14 +52,40 @@ func main() {
 	username := flag.String("username", "test", "api username")
 	password := flag.String("password", "test", "api password testw2")
 	interfaces := flag.String("interfaces", "wg0", "wireguard interfaces to configure. Pass a comma delimited list to configure multiple interfaces, eg 'wg0,wg1,wg2'")
-	portForwardingChain := flag.String("portforwarding-chain", "PORTFORWARDING", "iptables chain to use for portforwarding")
-	portForwardingIpsetIPv4 := flag.String("portforwarding-ipset-ipv4", "PORTFORWARDING_IPV4", "ipset table to use for portforwarding for ipv4 addresses.")
-	portForwardingIpsetIPv6 := flag.String("portforwarding-ipset-ipv6", "PORTFORWARDING_IPV6", "ipset table to use for portforwarding for ipv6 addresses.")
+	tunnelPoolIPv4 := flag.String("tunnel-pool-ipv4", "", "ipv4 network the tunnel addresses of the peers are assigned from, peers with addresses outside of it aren't configured. Empty to not check the ipv4 addresses, eg '10.64.0.0/10'")
+	tunnelPoolIPv6 := flag.String("tunnel-pool-ipv6", "", "ipv6 network the tunnel addresses of the peers are assigned from, peers with addresses outside of it aren't configured. Empty to not check the ipv6 addresses, eg 'fc00:bbbb:bbbb:bb01::/64'")
+	portForwardingBackend := flag.String("portforwarding-backend", "iptables", "firewall to manage portforwarding rules with, either 'iptables' or 'nftables'")
+	portForwardingChain := flag.String("portforwarding-chain", "PORTFORWARDING", "chain in the nat table to use for portforwarding")
+	portForwardingFilterChain := flag.String("portforwarding-filter-chain", "", "chain in the filter table to manage rules accepting the forwarded traffic in, empty to not manage them")
+	portForwardingHairpinChain := flag.String("portforwarding-hairpin-chain", "", "chain in the nat table to manage rules masquerading traffic from peers to their own forwarded ports in, so that they can reach them through the relay address, empty to not manage them")
+	portForwardingIpsetIPv4 := flag.String("portforwarding-ipset-ipv4", "PORTFORWARDING_IPV4", "ipset table, or nftables set, to use for portforwarding for ipv4 addresses.")
+	portForwardingIpsetIPv6 := flag.String("portforwarding-ipset-ipv6", "PORTFORWARDING_IPV6", "ipset table, or nftables set, to use for portforwarding for ipv6 addresses.")
+	portForwardingNoRestore := flag.Bool("portforwarding-no-restore", false, "apply iptables portforwarding rules one at a time, instead of atomically with iptables-restore")
+	portForwardingCreate := flag.Bool("portforwarding-create", false, "create the portforwarding chain, the jump to it from PREROUTING and the sets if they don't exist, and repair them on every synchronization")
+	portForwardingRelayAddresses := flag.String("portforwarding-relay-addresses", "", "addresses to add to the portforwarding sets when creating them, defaults to the public addresses of the machine. Pass a comma delimited list to use multiple addresses, eg '192.0.2.1,2001:db8::1'")
+	portForwardingExits := flag.String("portforwarding-exits", "", "exits peers can be assigned to, to forward their ports on other relay addresses than the default sets. Pass a semicolon delimited list of name=ipv4set,ipv6set followed by the addresses to add to the sets when creating them, eg 'se-1=EXIT1_IPV4,EXIT1_IPV6,192.0.2.2,2001:db8::2'")
+	portForwardingLeaseInterval := flag.Duration("portforwarding-lease-interval", time.Second*10, "how often to check for forwarded ports whose leases ran out, so that they're removed even while the api is unreachable")
+	portForwardingPools := flag.String("portforwarding-pools", "", "pools of ports to hand out to peers locally with 'wg-manager portpool allocate', per exit. Pass a semicolon delimited list of port ranges, prefixed by the exit for exits other than the default one, which can't overlap the PCP port range, eg '40000-44999;se-1=45000-49999'")
+	portForwardingReservedPorts := flag.String("portforwarding-reserved-ports", "", "ports that no port pool may include. Pass a comma delimited list of ports and port ranges, eg '5351,51820-51830'")
+	portForwardingConflictPolicy := flag.String("portforwarding-conflict-policy", "pick-owner", "what to do with ports assigned to more than one peer, either 'pick-owner' to forward them to the peer with the lowest public key, or 'skip' to not forward them at all")
+	portForwardingConflictReport := flag.String("portforwarding-conflict-report", "", "file to write a JSON report of ports assigned to more than one peer to after every synchronization, empty to disable")
+	pcpEnabled := flag.Bool("pcp", false, "run a PCP and NAT-PMP server on the wireguard interface addresses, letting peers request port forwards themselves. The relay addresses, or the public addresses of the machine if they aren't set, are reported to the peers as the external addresses")
+	pcpPortRange := flag.String("pcp-port-range", "50000-59999", "range of ports handed out to peers by the PCP server, which no port pool may include, eg '50000-59999'")
+	pcpMaxMappings := flag.Int("pcp-max-mappings", 5, "max number of ports a single peer can have mapped through the PCP server at once")
+	pcpMaxLifetime := flag.Duration("pcp-max-lifetime", time.Hour*2, "max lifetime of a mapping made through the PCP server, longer requests are shortened to it")
+	pcpMappingInterval := flag.Duration("pcp-mapping-interval", time.Second, "shortest time between two new mappings of a single peer through the PCP server, renewals aren't limited")
+	stateDir := flag.String("state-dir", "/var/lib/wireguard-manager", "directory to persist state in, such as the port pool allocations")
+	adminSocket := flag.String("admin-socket", "/run/wireguard-manager/admin.sock", "unix socket to serve the admin api on, which the admin commands connect to, empty to disable")
 	statsdAddress := flag.String("statsd-address", "127.0.0.1:8125", "statsd address to send metrics to")
-	mqURL := flag.String("mq-url", "ws://95.217.73.36:1323/v1", "message-queue url")
+	mqURL := flag.String("mq-url", "ws://95.217.73.36:1323/v1", "message-queue url, use ws:// or wss:// for websockets and http:// or https:// for server-sent events. Acknowledgements are only sent over websockets")
 	mqUsername := flag.String("mq-username", "test", "message-queue username")
 	mqPassword := flag.String("mq-password", "test", "message-queue password")
-	mqChannel := flag.String("mq-channel", "main", "message-queue channel")
+	relayID := flag.String("relay-id", hostname(), "identifies this relay in acknowledgements sent to the message-queue, which are only sent over websockets")
+	mqChannel := flag.String("mq-channel", "main", "message-queue channels to subscribe to. Pass a comma delimited list to subscribe to multiple channels, eg 'main,relay-1'")
+	mqPingInterval := flag.Duration("mq-ping-interval", time.Second*30, "how often to ping the message-queue, 0 to disable")
+	mqIdleTimeout := flag.Duration("mq-idle-timeout", time.Second*90, "how long the message-queue connection may be unresponsive before reconnecting, 0 to disable")
+	retryInterval := flag.Duration("retry-interval", time.Second, "how often to retry peers that were left partially applied, each peer backs off on its own after failing")
+	eventQueueSize := flag.Int("event-queue-size", 1000, "max number of pending message-queue events before falling back to a full synchronization")
 
 	// Parse environment variables
 	envy.Parse("WG")
@@ -62,6 +101,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Run admin commands against the running instance
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args(), *adminSocket))
+	}
+
 	log.Printf("starting2 wg-manager %s", appVersion)
 
 	// Initialize metrics
@@ -95,30 +139,187 @@ func main() {
 	}
 	defer wg.Close()
 
+	peerIndex = index.New(interfacesList)
+
+	// Initialize the tunnel address management
+	interfaceAddressList, err := interfaceAddresses(interfacesList)
+	if err != nil {
+		log.Fatalf("error getting wireguard interface addresses %s", err.Error())
+	}
+
+	ipamConfig := ipam.Config{
+		Reserved: interfaceAddressList,
+		Metrics:  metrics,
+	}
+
+	if *tunnelPoolIPv4 != "" {
+		_, ipamConfig.IPv4, err = net.ParseCIDR(*tunnelPoolIPv4)
+		if err != nil {
+			log.Fatalf("invalid tunnel pool %s", err.Error())
+		}
+	}
+
+	if *tunnelPoolIPv6 != "" {
+		_, ipamConfig.IPv6, err = net.ParseCIDR(*tunnelPoolIPv6)
+		if err != nil {
+			log.Fatalf("invalid tunnel pool %s", err.Error())
+		}
+	}
+
+	addresses, err = ipam.New(ipamConfig)
+	if err != nil {
+		log.Fatalf("error initializing tunnel address management %s", err)
+	}
+
 	// Initialize portforward
-	pf, err = portforward.New(*portForwardingChain, *portForwardingIpsetIPv4, *portForwardingIpsetIPv6)
+	var relayAddresses []net.IP
+	if *portForwardingRelayAddresses != "" {
+		for _, address := range strings.Split(*portForwardingRelayAddresses, ",") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				log.Fatalf("invalid portforwarding relay address %s", address)
+			}
+
+			relayAddresses = append(relayAddresses, ip)
+		}
+	}
+
+	exits, err := parseExits(*portForwardingExits)
+	if err != nil {
+		log.Fatalf("invalid portforwarding exits %s", err.Error())
+	}
+
+	pools, err := parsePortPools(*portForwardingPools)
+	if err != nil {
+		log.Fatalf("invalid portforwarding pools %s", err.Error())
+	}
+
+	var reservedPorts []portforward.PortRange
+	if *portForwardingReservedPorts != "" {
+		for _, ports := range strings.Split(*portForwardingReservedPorts, ",") {
+			r, err := portforward.ParsePortRange(ports)
+			if err != nil {
+				log.Fatalf("invalid portforwarding reserved ports %s", err.Error())
+			}
+
+			reservedPorts = append(reservedPorts, r)
+		}
+	}
+
+	// The PCP server hands out ports on its own, so the port pools can't include them
+	var pcpPorts portforward.PortRange
+	if *pcpEnabled {
+		pcpPorts, err = portforward.ParsePortRange(*pcpPortRange)
+		if err != nil {
+			log.Fatalf("invalid pcp port range %s", err.Error())
+		}
+
+		reservedPorts = append(reservedPorts, pcpPorts)
+	}
+
+	pf, err = portforward.NewWithConfig(portforward.Config{
+		Backend:        portforward.Backend(*portForwardingBackend),
+		Chain:          *portForwardingChain,
+		FilterChain:    *portForwardingFilterChain,
+		HairpinChain:   *portForwardingHairpinChain,
+		IPSetIPv4:      *portForwardingIpsetIPv4,
+		IPSetIPv6:      *portForwardingIpsetIPv6,
+		NoRestore:      *portForwardingNoRestore,
+		Create:         *portForwardingCreate,
+		RelayAddresses: relayAddresses,
+		Exits:          exits,
+		PortPools:      pools,
+		ReservedPorts:  reservedPorts,
+		StateDir:       *stateDir,
+		ConflictPolicy: portforward.ConflictPolicy(*portForwardingConflictPolicy),
+		Metrics:        metrics,
+	})
 	if err != nil {
 		log.Fatalf("error initializing portforwarding %s", err)
 	}
+	conflictReport = *portForwardingConflictReport
+
+	reconciler, err = reconcile.New(wg, pf, metrics)
+	if err != nil {
+		log.Fatalf("error initializing reconciliation %s", err)
+	}
 
 	// Set up context for shutting down
 	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	defer shutdown()
 
+	// Serve the admin api
+	if *adminSocket != "" {
+		adminServer := admin.New(*adminSocket)
+		registerHandlers(adminServer)
+
+		err = adminServer.Serve(shutdownCtx)
+		if err != nil {
+			log.Printf("error starting admin api %s", err.Error())
+		}
+	}
+
+	// Initialize the PCP server
+	if *pcpEnabled {
+		externalAddresses, err := pf.DefaultExitAddresses()
+		if err != nil {
+			log.Fatalf("error getting the external addresses of the pcp server %s", err.Error())
+		}
+
+		if len(externalAddresses) == 0 {
+			log.Fatal("no public addresses found to report to pcp clients, set them with -portforwarding-relay-addresses")
+		}
+
+		pcpServer, err = pcp.New(pcp.Config{
+			Addresses:          interfaceAddressList,
+			PortMin:            pcpPorts.Min,
+			PortMax:            pcpPorts.Max,
+			MaxMappingsPerPeer: *pcpMaxMappings,
+			MaxLifetime:        *pcpMaxLifetime,
+			MappingInterval:    *pcpMappingInterval,
+			ExternalAddresses:  externalAddresses,
+			Metrics:            metrics,
+		}, pf)
+		if err != nil {
+			log.Fatalf("error initializing pcp server %s", err)
+		}
+
+		err = pcpServer.Serve(shutdownCtx)
+		if err != nil {
+			log.Fatalf("error starting pcp server %s", err)
+		}
+	}
+
 	// Run an initial synchronization
 	synchronize()
 
+	channels, err := subscriber.ParseChannels(*mqChannel)
+	if err != nil {
+		log.Fatalf("error parsing message-queue channels %s", err)
+	}
+
 	// Set up a connection to receive add/remove events
 	s := subscriber.Subscriber{
 		Username: *mqUsername,
 		Password: *mqPassword,
 		BaseURL:  *mqURL,
-		Channel:  *mqChannel,
+		Channels: channels,
 		Metrics:  metrics,
+		RelayID:  *relayID,
+
+		PingInterval: *mqPingInterval,
+		IdleTimeout:  *mqIdleTimeout,
 	}
 	eventChannel := make(chan subscriber.WireguardEvent)
 	defer close(eventChannel)
 
+	// Buffer events in a queue, so that reading from the message-queue doesn't stall while we're synchronizing
+	// Events that are coalesced or dropped are acknowledged right away, as they won't be handled individually
+	queue := subscriber.NewQueue(*eventQueueSize, metrics, func(event subscriber.WireguardEvent, status subscriber.AckStatus) {
+		s.Acknowledge(event, status, nil, 0)
+	})
+	go queue.Consume(shutdownCtx, eventChannel)
+
 	err = s.Subscribe(shutdownCtx, eventChannel)
 	if err != nil {
 		log.Fatal("error connecting to message-queue", err)
@@ -126,17 +327,42 @@ func main() {
 
 	// Create a ticker to run our logic for polling the api and updating wireguard peers
 	ticker := jitter.NewTicker(*interval, *delay)
+	leaseTicker := time.NewTicker(*portForwardingLeaseInterval)
+	retryTicker := time.NewTicker(*retryInterval)
 	go func() {
 		for {
 			select {
-			case msg := <-eventChannel:
-				handleEvent(msg)
+			case <-queue.Ready():
+				events, overflowed := queue.Drain()
+				if overflowed {
+					// Events were dropped, so the only way to get back in sync is a full synchronization
+					synchronize()
+					continue
+				}
+
+				for _, event := range events {
+					t := metrics.NewTiming()
+					err := handleEvent(event)
+
+					status := subscriber.AckSuccess
+					if err != nil {
+						status = subscriber.AckFailure
+					}
+
+					s.Acknowledge(event, status, err, t.Duration())
+				}
 			case <-ticker.C:
 				// We run this synchronously, the ticker will drop ticks if this takes too long
 				// This way we don't need a mutex or similar to ensure it doesn't run concurrently either
 				synchronize()
+			case now := <-leaseTicker.C:
+				pf.ExpireLeases(now)
+			case now := <-retryTicker.C:
+				retry(now)
 			case <-shutdownCtx.Done():
 				ticker.Stop()
+				leaseTicker.Stop()
+				retryTicker.Stop()
 				return
 			}
 		}
@@ -147,15 +373,53 @@ func main() {
 	log.Printf("shutting down: %s", err)
 }
 
-func handleEvent(event subscriber.WireguardEvent) {
+// handleEvent applies an event, and returns the error if it wasn't fully applied
+func handleEvent(event subscriber.WireguardEvent) error {
 	switch event.Action {
 	case "ADD":
-		wg.AddPeer(event.Peer)
-		pf.AddPortforwarding(event.Peer)
+		// Peers with addresses that would break routing for other peers are never configured
+		err := addresses.AddPeer(event.Peer)
+		if err != nil {
+			return err
+		}
+
+		// A peer that fails may be rolled back to how it was, or not be configured at all
+		applied, configured, err := reconciler.AddPeer(event.Peer)
+		if !configured {
+			// The addresses aren't taken by a peer that isn't configured, a retry claims them again
+			addresses.RemovePeer(event.Peer)
+			return err
+		}
+
+		if err != nil {
+			// The addresses are taken by the peer as it's configured, which is the previous one after a rollback
+			claimErr := addresses.AddPeer(applied)
+			if claimErr != nil {
+				log.Printf("error restoring the addresses of peer %s: %s", applied.Pubkey, claimErr.Error())
+			}
+		}
+
+		peerIndex.AddPeer(applied)
+		if pcpServer != nil {
+			pcpServer.AddPeer(applied)
+		}
+
+		return err
 	case "REMOVE":
-		wg.RemovePeer(event.Peer)
-		pf.RemovePortforwarding(event.Peer)
+		// The peer loses access right away, but its addresses are only released once its tunnel is removed, possibly by a retry
+		err := reconciler.RemovePeer(event.Peer)
+		if err == nil {
+			addresses.RemovePeer(event.Peer)
+		}
+
+		peerIndex.RemovePeer(event.Peer)
+		if pcpServer != nil {
+			pcpServer.RemovePeer(event.Peer)
+		}
+
+		return err
 	default: // Bad data from the API, ignore it
+		return fmt.Errorf("unknown action %s", event.Action)
 	}
 }
 
@@ -171,13 +435,155 @@ func synchronize() {
 	}
 	t.Send("get_wireguard_peers_time")
 
-	t = metrics.NewTiming()
-	wg.UpdatePeers(peers)
-	t.Send("update_peers_time")
+	// Only peers that are gone from the API lose their pool ports, not ones that fail to apply
+	pf.ReclaimPorts(peers)
+
+	// Leave out peers with addresses that would break routing for other peers
+	peers = addresses.SetPeers(peers)
+
+	// Only the peers with a working tunnel are looked up or allowed to request mappings
+	peers = reconciler.Synchronize(peers)
+	peerIndex.SetPeers(peers)
+
+	if pcpServer != nil {
+		pcpServer.SetPeers(peers)
+	}
+
+	if conflictReport != "" {
+		err = writeConflictReport(conflictReport)
+		if err != nil {
+			log.Printf("error writing portforwarding conflict report %s", err.Error())
+		}
+	}
+}
+
+// retry applies the peers that were left partially applied, once they've backed off
+func retry(now time.Time) {
+	// The addresses of peers that failed to add were released, and are claimed again before the peer is configured
+	tunneled, removed := reconciler.Retry(now, addresses.AddPeer)
+	for _, peer := range tunneled {
+		peerIndex.AddPeer(peer)
+		if pcpServer != nil {
+			pcpServer.AddPeer(peer)
+		}
+	}
+
+	for _, peer := range removed {
+		addresses.RemovePeer(peer)
+	}
+}
+
+// interfaceAddresses returns the addresses of the given interfaces
+func interfaceAddresses(names []string) ([]net.IP, error) {
+	var addresses []net.IP
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		interfaceAddresses, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range interfaceAddresses {
+			// Link-local addresses can't be listened on without a zone, and peers don't use them as gateways
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				addresses = append(addresses, ipNet.IP)
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// parsePortPools parses the port pools given on the command line
+func parsePortPools(s string) (map[string]portforward.PortRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	pools := make(map[string]portforward.PortRange)
+	for _, entry := range strings.Split(s, ";") {
+		exit, ports := "", entry
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			exit, ports = parts[0], parts[1]
+		}
+
+		r, err := portforward.ParsePortRange(ports)
+		if err != nil {
+			return nil, err
+		}
+
+		pools[exit] = r
+	}
+
+	return pools, nil
+}
+
+// parseExits parses the portforwarding exits given on the command line
+func parseExits(s string) (map[string]portforward.Exit, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	exits := make(map[string]portforward.Exit)
+	for _, entry := range strings.Split(s, ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("exit %s has no sets", entry)
+		}
+
+		fields := strings.Split(parts[1], ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("exit %s needs both an ipv4 and an ipv6 set", parts[0])
+		}
+
+		exit := portforward.Exit{
+			IPSetIPv4: fields[0],
+			IPSetIPv6: fields[1],
+		}
+
+		for _, address := range fields[2:] {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("exit %s has an invalid address %s", parts[0], address)
+			}
+
+			exit.Addresses = append(exit.Addresses, ip)
+		}
+
+		exits[parts[0]] = exit
+	}
+
+	return exits, nil
+}
+
+// writeConflictReport writes the portforwarding conflicts as JSON, replacing the file atomically so that readers never see a partial report
+func writeConflictReport(path string) error {
+	data, err := json.MarshalIndent(pf.Conflicts(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// hostname returns the hostname of the machine, or an empty string if it can't be determined
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
 
-	t = metrics.NewTiming()
-	pf.UpdatePortforwarding(peers)
-	t.Send("update_portforwarding_time")
+	return name
 }
 
 func waitForInterrupt(ctx context.Context) error {
@@ -0,0 +1,13 @@
+#!/bin/sh
+# Builds the binary and the .deb package into the build folder, versioned by the latest tag
+set -eu
+
+# The repository is mounted from the host, owned by another user
+git config --global --add safe.directory /repo
+
+version=$(git describe --tags --abbrev=0 | sed 's/^v//')
+
+go build -o build/wireguard-manager .
+
+sed "s/^version: .*/version: \"$version\"/" packaging/nfpm.yaml > /tmp/nfpm.yaml
+nfpm pkg --config /tmp/nfpm.yaml --packager deb --target build/
@@ -0,0 +1,258 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Protocol versions, NAT-PMP is version 0 of PCP
+const (
+	natpmpVersion = 0
+	pcpVersion    = 2
+)
+
+// NAT-PMP opcodes and result codes, from RFC 6886
+const (
+	natpmpOpAddress = 0
+	natpmpOpMapUDP  = 1
+	natpmpOpMapTCP  = 2
+
+	natpmpSuccess           = 0
+	natpmpNotAuthorized     = 2
+	natpmpNetworkFailure    = 3
+	natpmpOutOfResources    = 4
+	natpmpUnsupportedOpcode = 5
+)
+
+// PCP opcodes and result codes, from RFC 6887
+const (
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpSuccess          = 0
+	pcpUnsuppVersion    = 1
+	pcpNotAuthorized    = 2
+	pcpMalformedRequest = 3
+	pcpUnsuppOpcode     = 4
+	pcpUnsuppOption     = 5
+	pcpMalformedOption  = 6
+	pcpNetworkFailure   = 7
+	pcpNoResources      = 8
+	pcpUnsuppProtocol   = 9
+	pcpUserExQuota      = 10
+	pcpAddressMismatch  = 12
+)
+
+const (
+	// responseBit is set in the opcode of responses
+	responseBit = 0x80
+
+	pcpHeaderLength     = 24
+	pcpMapPayloadLength = 36
+	pcpMaxLength        = 1100
+	natpmpMapLength     = 12
+
+	// errorLifetime is how long clients are told to wait before retrying after an error
+	errorLifetime = 30
+)
+
+var protocolNumbers = map[string]uint8{
+	"tcp": 6,
+	"udp": 17,
+}
+
+// handle decodes a request in either protocol and returns the response to send, or nil if it should be dropped
+func (s *Server) handle(src net.IP, b []byte) []byte {
+	if len(b) < 2 || b[1]&responseBit != 0 {
+		return nil
+	}
+
+	switch b[0] {
+	case natpmpVersion:
+		return s.handleNATPMP(src, b)
+	case pcpVersion:
+		return s.handlePCP(src, b)
+	default:
+		return pcpResponse(b[1], pcpUnsuppVersion, errorLifetime, s.epoch(), nil)
+	}
+}
+
+func (s *Server) handleNATPMP(src net.IP, b []byte) []byte {
+	op := b[1]
+
+	switch op {
+	case natpmpOpAddress:
+		external := s.externalAddress(src).To4()
+		if external == nil {
+			return natpmpResponse(op, natpmpNetworkFailure, s.epoch(), nil)
+		}
+
+		return natpmpResponse(op, natpmpSuccess, s.epoch(), external)
+	case natpmpOpMapUDP, natpmpOpMapTCP:
+		if len(b) < natpmpMapLength {
+			return nil
+		}
+
+		protocol := "udp"
+		if op == natpmpOpMapTCP {
+			protocol = "tcp"
+		}
+
+		result, err := s.mapPort(src, request{
+			protocol:     protocol,
+			internalPort: int(binary.BigEndian.Uint16(b[4:6])),
+			externalPort: int(binary.BigEndian.Uint16(b[6:8])),
+			lifetime:     binary.BigEndian.Uint32(b[8:12]),
+		})
+
+		code := uint16(natpmpSuccess)
+		switch err {
+		case nil:
+		case errNotAuthorized, errMalformed:
+			code = natpmpNotAuthorized
+		case errNoResources, errQuota, errRateLimited:
+			code = natpmpOutOfResources
+		default:
+			code = natpmpNetworkFailure
+		}
+
+		payload := make([]byte, 8)
+		copy(payload[0:2], b[4:6])
+		binary.BigEndian.PutUint16(payload[2:4], uint16(result.externalPort))
+		binary.BigEndian.PutUint32(payload[4:8], result.lifetime)
+
+		return natpmpResponse(op, code, s.epoch(), payload)
+	default:
+		return natpmpResponse(op, natpmpUnsupportedOpcode, s.epoch(), nil)
+	}
+}
+
+// natpmpResponse builds a NAT-PMP response with the given opcode specific payload
+func natpmpResponse(op uint8, code uint16, epoch uint32, payload []byte) []byte {
+	response := make([]byte, 8, 8+len(payload))
+	response[0] = natpmpVersion
+	response[1] = op | responseBit
+	binary.BigEndian.PutUint16(response[2:4], code)
+	binary.BigEndian.PutUint32(response[4:8], epoch)
+
+	return append(response, payload...)
+}
+
+func (s *Server) handlePCP(src net.IP, b []byte) []byte {
+	op := b[1]
+
+	if len(b) < pcpHeaderLength || len(b) > pcpMaxLength || len(b)%4 != 0 {
+		return pcpResponse(op, pcpMalformedRequest, errorLifetime, s.epoch(), nil)
+	}
+
+	lifetime := binary.BigEndian.Uint32(b[4:8])
+	if !net.IP(b[8:24]).Equal(src) {
+		return pcpResponse(op, pcpAddressMismatch, errorLifetime, s.epoch(), nil)
+	}
+
+	switch op {
+	case pcpOpAnnounce:
+		return pcpResponse(op, pcpSuccess, 0, s.epoch(), nil)
+	case pcpOpMap:
+	default:
+		return pcpResponse(op, pcpUnsuppOpcode, errorLifetime, s.epoch(), nil)
+	}
+
+	if len(b) < pcpHeaderLength+pcpMapPayloadLength {
+		return pcpResponse(op, pcpMalformedRequest, errorLifetime, s.epoch(), nil)
+	}
+
+	// Errors are reported with a copy of the request payload
+	payload := make([]byte, pcpMapPayloadLength)
+	copy(payload, b[pcpHeaderLength:pcpHeaderLength+pcpMapPayloadLength])
+
+	if code := checkPCPOptions(b[pcpHeaderLength+pcpMapPayloadLength:]); code != pcpSuccess {
+		return pcpResponse(op, code, errorLifetime, s.epoch(), payload)
+	}
+
+	var protocol string
+	for name, number := range protocolNumbers {
+		if payload[12] == number {
+			protocol = name
+		}
+	}
+
+	if protocol == "" {
+		// Protocol 0 maps every port of every protocol, which we never hand out
+		if payload[12] == 0 && lifetime != 0 {
+			return pcpResponse(op, pcpNotAuthorized, errorLifetime, s.epoch(), payload)
+		}
+
+		if payload[12] != 0 {
+			return pcpResponse(op, pcpUnsuppProtocol, errorLifetime, s.epoch(), payload)
+		}
+	}
+
+	result, err := s.mapPort(src, request{
+		protocol:     protocol,
+		internalPort: int(binary.BigEndian.Uint16(payload[16:18])),
+		externalPort: int(binary.BigEndian.Uint16(payload[18:20])),
+		lifetime:     lifetime,
+	})
+
+	switch err {
+	case nil:
+	case errNotAuthorized:
+		return pcpResponse(op, pcpNotAuthorized, errorLifetime, s.epoch(), payload)
+	case errMalformed:
+		return pcpResponse(op, pcpMalformedRequest, errorLifetime, s.epoch(), payload)
+	case errNoResources:
+		return pcpResponse(op, pcpNoResources, errorLifetime, s.epoch(), payload)
+	case errQuota, errRateLimited:
+		return pcpResponse(op, pcpUserExQuota, errorLifetime, s.epoch(), payload)
+	default:
+		return pcpResponse(op, pcpNetworkFailure, errorLifetime, s.epoch(), payload)
+	}
+
+	binary.BigEndian.PutUint16(payload[18:20], uint16(result.externalPort))
+
+	external := s.externalAddress(src)
+	if result.lifetime == 0 || external == nil {
+		external = net.IPv6zero
+	}
+	copy(payload[20:36], external.To16())
+
+	return pcpResponse(op, pcpSuccess, result.lifetime, s.epoch(), payload)
+}
+
+// checkPCPOptions rejects requests with options, since we don't support any of them
+// Options in the optional range can be ignored, but the mandatory ones have to be refused
+func checkPCPOptions(b []byte) uint8 {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return pcpMalformedOption
+		}
+
+		code := b[0]
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		padded := 4 + (length+3)/4*4
+		if padded > len(b) {
+			return pcpMalformedOption
+		}
+
+		if code < 128 {
+			return pcpUnsuppOption
+		}
+
+		b = b[padded:]
+	}
+
+	return pcpSuccess
+}
+
+// pcpResponse builds a PCP response with the given opcode specific payload
+func pcpResponse(op uint8, code uint8, lifetime uint32, epoch uint32, payload []byte) []byte {
+	response := make([]byte, pcpHeaderLength, pcpHeaderLength+len(payload))
+	response[0] = pcpVersion
+	response[1] = op | responseBit
+	response[3] = code
+	binary.BigEndian.PutUint32(response[4:8], lifetime)
+	binary.BigEndian.PutUint32(response[8:12], epoch)
+
+	return append(response, payload...)
+}
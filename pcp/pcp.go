@@ -0,0 +1,537 @@
+// Package pcp implements a Port Control Protocol server, compatible with NAT-PMP clients, that lets peers request port forwards themselves
+package pcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// DefaultPort is the port PCP and NAT-PMP servers listen on
+const DefaultPort = 5351
+
+// How often expired mappings are removed
+const expiryInterval = 5 * time.Second
+
+var (
+	errNotAuthorized = errors.New("not authorized")
+	errMalformed     = errors.New("malformed request")
+	errNoResources   = errors.New("no free ports in the pool")
+	errQuota         = errors.New("mapping limit reached")
+	errRateLimited   = errors.New("mapping requested too soon after the last one")
+)
+
+// privilegedPorts is the upper bound of the ports only root can bind, which are never handed out
+const privilegedPorts = 1023
+
+// Forwarder applies the mappings, which is implemented by portforward.Portforward
+type Forwarder interface {
+	AddMapping(pubkey string, port api.Port) error
+	RemoveMapping(pubkey string, port api.Port) error
+	// AllocatedPorts returns the ports handed out by other means than the server, which it never hands out
+	AllocatedPorts() map[int]struct{}
+}
+
+// Config is the configuration for the server
+type Config struct {
+	// Addresses are the addresses to listen on, normally the addresses of the wireguard interfaces
+	Addresses []net.IP
+	// Port is the port to listen on, defaults to DefaultPort
+	Port int
+	// PortMin and PortMax are the range of external ports handed out to peers, inclusive
+	PortMin int
+	PortMax int
+	// MaxMappingsPerPeer is how many mappings a single peer can have at once
+	MaxMappingsPerPeer int
+	// MaxLifetime is the longest lifetime handed out, longer requests are shortened to it
+	MaxLifetime time.Duration
+	// MappingInterval is the shortest time between two new mappings of a single peer, 0 doesn't limit them
+	// Renewing and deleting mappings isn't limited
+	MappingInterval time.Duration
+	// ExternalAddresses are the addresses ports are forwarded on, reported to the peers, at least one is required
+	ExternalAddresses []net.IP
+	// Metrics is the client to send metrics to, if nil no metrics are sent
+	Metrics *statsd.Client
+}
+
+// Server hands out port mappings to peers from a pool of ports
+type Server struct {
+	cfg       Config
+	forwarder Forwarder
+	metrics   *statsd.Client
+	started   time.Time
+
+	mu sync.Mutex
+	// peers are the peers allowed to request mappings, keyed by their tunnel addresses
+	peers map[string]api.WireguardPeer
+	// reserved are the ports assigned to peers through the API, which are never handed out
+	reserved map[int]struct{}
+	mappings map[mappingKey]*mapping
+	// lastMapped is when each peer last got a new mapping, for the rate limit
+	lastMapped map[string]time.Time
+}
+
+// mappingKey identifies a mapping, a peer has at most one mapping per internal port and protocol
+type mappingKey struct {
+	pubkey       string
+	protocol     string
+	internalPort int
+}
+
+type mapping struct {
+	port    api.Port
+	expires time.Time
+}
+
+// removal is a mapping that was dropped, whose rules the forwarder still has to remove
+type removal struct {
+	pubkey string
+	port   api.Port
+}
+
+// change is what a request changed, applied through the forwarder once the lock is released
+type change struct {
+	pubkey string
+	// key and added are the new mapping, if any
+	key     mappingKey
+	added   *mapping
+	removed []removal
+	result  result
+}
+
+// request is a mapping request, decoded from either protocol
+type request struct {
+	protocol     string
+	internalPort int
+	// externalPort is the port the peer would like, which it gets if it's free
+	externalPort int
+	// lifetime is the requested lifetime in seconds, 0 deletes the mapping
+	lifetime uint32
+}
+
+// result is the outcome of a mapping request
+type result struct {
+	externalPort int
+	lifetime     uint32
+}
+
+// New validates the configuration and returns a new Server
+func New(cfg Config, forwarder Forwarder) (*Server, error) {
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+
+	if cfg.PortMin <= privilegedPorts || cfg.PortMax > 65535 || cfg.PortMin > cfg.PortMax {
+		return nil, fmt.Errorf("invalid port range %d-%d, it has to be within %d-65535", cfg.PortMin, cfg.PortMax, privilegedPorts+1)
+	}
+
+	if cfg.MaxMappingsPerPeer < 1 {
+		return nil, fmt.Errorf("invalid mapping limit %d", cfg.MaxMappingsPerPeer)
+	}
+
+	if cfg.MaxLifetime < time.Second {
+		return nil, fmt.Errorf("invalid max lifetime %s", cfg.MaxLifetime)
+	}
+
+	if cfg.MappingInterval < 0 {
+		return nil, fmt.Errorf("invalid mapping interval %s", cfg.MappingInterval)
+	}
+
+	if len(cfg.ExternalAddresses) == 0 {
+		return nil, errors.New("no external addresses to report to the peers")
+	}
+
+	metrics := cfg.Metrics
+	if metrics == nil {
+		var err error
+		metrics, err = statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Server{
+		cfg:        cfg,
+		forwarder:  forwarder,
+		metrics:    metrics,
+		started:    time.Now(),
+		peers:      make(map[string]api.WireguardPeer),
+		reserved:   make(map[int]struct{}),
+		mappings:   make(map[mappingKey]*mapping),
+		lastMapped: make(map[string]time.Time),
+	}, nil
+}
+
+// Serve listens on the configured addresses and removes expired mappings until the context is canceled
+func (s *Server) Serve(ctx context.Context) error {
+	var conns []*net.UDPConn
+	for _, address := range s.cfg.Addresses {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: address, Port: s.cfg.Port})
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+
+			return err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns {
+		go s.serve(conn)
+	}
+
+	go func() {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Expire(time.Now())
+			case <-ctx.Done():
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) serve(conn *net.UDPConn) {
+	buffer := make([]byte, pcpMaxLength+1)
+
+	for {
+		n, src, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			// The connection is closed on shutdown
+			return
+		}
+
+		s.metrics.Increment("pcp_requests")
+
+		response := s.handle(src.IP, buffer[:n])
+		if response == nil {
+			continue
+		}
+
+		_, err = conn.WriteToUDP(response, src)
+		if err != nil {
+			log.Printf("error sending pcp response to %s %s", src.String(), err.Error())
+		}
+	}
+}
+
+// SetPeers replaces the peers allowed to request mappings, and drops the mappings of peers that are gone
+// The ports assigned to the peers through the API are reserved, so that they're never handed out
+func (s *Server) SetPeers(peers api.WireguardPeerList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers = make(map[string]api.WireguardPeer)
+	s.reserved = make(map[int]struct{})
+	for _, peer := range peers {
+		s.addPeer(peer)
+	}
+
+	for key := range s.mappings {
+		if !s.hasPeer(key.pubkey) {
+			delete(s.mappings, key)
+		}
+	}
+
+	for pubkey := range s.lastMapped {
+		if !s.hasPeer(pubkey) {
+			delete(s.lastMapped, pubkey)
+		}
+	}
+
+	s.metrics.Gauge("pcp_mappings", len(s.mappings))
+}
+
+// AddPeer allows a peer to request mappings
+func (s *Server) AddPeer(peer api.WireguardPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addPeer(peer)
+}
+
+// RemovePeer stops a peer from requesting mappings, and drops its mappings
+// The forwarder removes the rules of the mappings along with the peer
+func (s *Server) RemovePeer(peer api.WireguardPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, p := range s.peers {
+		if p.Pubkey == peer.Pubkey {
+			delete(s.peers, address)
+		}
+	}
+
+	for key := range s.mappings {
+		if key.pubkey == peer.Pubkey {
+			delete(s.mappings, key)
+		}
+	}
+	delete(s.lastMapped, peer.Pubkey)
+
+	s.metrics.Gauge("pcp_mappings", len(s.mappings))
+}
+
+func (s *Server) addPeer(peer api.WireguardPeer) {
+	for _, address := range []string{peer.IPv4, peer.IPv6} {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			continue
+		}
+
+		s.peers[ip.String()] = peer
+	}
+
+	for _, port := range peer.Ports {
+		s.reserved[port.External] = struct{}{}
+	}
+}
+
+func (s *Server) hasPeer(pubkey string) bool {
+	for _, peer := range s.peers {
+		if peer.Pubkey == pubkey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expire removes the mappings that expired before the given time
+func (s *Server) Expire(now time.Time) {
+	s.mu.Lock()
+	var removed []removal
+	for key, m := range s.mappings {
+		if now.Before(m.expires) {
+			continue
+		}
+
+		removed = append(removed, s.remove(key))
+		s.metrics.Increment("pcp_expired")
+	}
+
+	s.metrics.Gauge("pcp_mappings", len(s.mappings))
+	s.mu.Unlock()
+
+	s.unmap(removed)
+}
+
+// mapPort creates, renews or deletes a mapping for the peer with the given tunnel address
+// The forwarder is called without holding the lock, so that applying a mapping doesn't hold up other requests
+func (s *Server) mapPort(src net.IP, req request) (result, error) {
+	allocated := s.forwarder.AllocatedPorts()
+
+	s.mu.Lock()
+	c, err := s.change(src, req, allocated, time.Now())
+	s.metrics.Gauge("pcp_mappings", len(s.mappings))
+	s.mu.Unlock()
+
+	if err != nil {
+		return result{}, err
+	}
+
+	s.unmap(c.removed)
+
+	if c.added == nil {
+		return c.result, nil
+	}
+
+	port := c.added.port
+	err = s.forwarder.AddMapping(c.pubkey, port)
+
+	s.mu.Lock()
+	// The mapping may have been deleted or expired while it was added
+	current := s.mappings[c.key] == c.added
+	if err != nil && current {
+		delete(s.mappings, c.key)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.metrics.Increment("pcp_error")
+		log.Printf("error adding pcp mapping of port %d for peer %s %s", port.External, c.pubkey, err.Error())
+		return result{}, err
+	}
+
+	// It was dropped along with the peer, or by another request of the peer
+	if !current {
+		s.unmap([]removal{{pubkey: c.pubkey, port: port}})
+		return result{}, errNotAuthorized
+	}
+
+	log.Printf("added pcp mapping of %s port %d to port %d for peer %s, expiring in %ds", port.Protocol, port.External, port.Internal, c.pubkey, c.result.lifetime)
+
+	return c.result, nil
+}
+
+// change decides what a request changes, reserving the port of a new mapping, and must be called with the lock held
+// The allocated ports are skipped along with the reserved ones when handing out a port
+func (s *Server) change(src net.IP, req request, allocated map[int]struct{}, now time.Time) (change, error) {
+	peer, ok := s.peers[src.String()]
+	if !ok {
+		return change{}, errNotAuthorized
+	}
+
+	c := change{pubkey: peer.Pubkey}
+
+	if req.lifetime == 0 {
+		c.removed = s.delete(peer.Pubkey, req)
+		return c, nil
+	}
+
+	if req.internalPort == 0 {
+		return change{}, errMalformed
+	}
+
+	lifetime := req.lifetime
+	if max := uint32(s.cfg.MaxLifetime / time.Second); lifetime > max {
+		lifetime = max
+	}
+	expires := now.Add(time.Duration(lifetime) * time.Second)
+
+	key := mappingKey{pubkey: peer.Pubkey, protocol: req.protocol, internalPort: req.internalPort}
+	if m, ok := s.mappings[key]; ok {
+		m.expires = expires
+		c.result = result{externalPort: m.port.External, lifetime: lifetime}
+		return c, nil
+	}
+
+	count := 0
+	for k := range s.mappings {
+		if k.pubkey == peer.Pubkey {
+			count++
+		}
+	}
+
+	if count >= s.cfg.MaxMappingsPerPeer {
+		s.metrics.Increment("pcp_quota_exceeded")
+		return change{}, errQuota
+	}
+
+	if last, ok := s.lastMapped[peer.Pubkey]; ok && now.Sub(last) < s.cfg.MappingInterval {
+		s.metrics.Increment("pcp_rate_limited")
+		return change{}, errRateLimited
+	}
+
+	external, ok := s.allocate(req.externalPort, allocated)
+	if !ok {
+		s.metrics.Increment("pcp_pool_exhausted")
+		return change{}, errNoResources
+	}
+
+	c.key = key
+	c.added = &mapping{
+		port: api.Port{
+			External: external,
+			Internal: req.internalPort,
+			Protocol: req.protocol,
+		},
+		expires: expires,
+	}
+	c.result = result{externalPort: external, lifetime: lifetime}
+
+	s.mappings[key] = c.added
+	s.lastMapped[peer.Pubkey] = now
+
+	return c, nil
+}
+
+// delete drops the peer's mapping of the requested internal port, or all of its mappings for the protocol if the port is 0
+func (s *Server) delete(pubkey string, req request) []removal {
+	var removed []removal
+	for key := range s.mappings {
+		if key.pubkey != pubkey || (req.protocol != "" && key.protocol != req.protocol) {
+			continue
+		}
+
+		if req.internalPort != 0 && key.internalPort != req.internalPort {
+			continue
+		}
+
+		removed = append(removed, s.remove(key))
+	}
+
+	return removed
+}
+
+// remove drops a mapping, returning what the forwarder has to remove
+func (s *Server) remove(key mappingKey) removal {
+	m := s.mappings[key]
+	delete(s.mappings, key)
+
+	return removal{pubkey: key.pubkey, port: m.port}
+}
+
+// unmap removes the rules of dropped mappings, and must be called without the lock held
+func (s *Server) unmap(removed []removal) {
+	for _, r := range removed {
+		err := s.forwarder.RemoveMapping(r.pubkey, r.port)
+		if err != nil {
+			s.metrics.Increment("pcp_error")
+			log.Printf("error removing pcp mapping of port %d for peer %s %s", r.port.External, r.pubkey, err.Error())
+		}
+	}
+}
+
+// allocate returns a free port from the pool, the suggested one if it's free
+// Ports assigned through the API, mapped already, or allocated by other means aren't free
+func (s *Server) allocate(suggested int, allocated map[int]struct{}) (int, bool) {
+	used := make(map[int]struct{})
+	for port := range s.reserved {
+		used[port] = struct{}{}
+	}
+	for port := range allocated {
+		used[port] = struct{}{}
+	}
+	for _, m := range s.mappings {
+		used[m.port.External] = struct{}{}
+	}
+
+	if suggested >= s.cfg.PortMin && suggested <= s.cfg.PortMax {
+		if _, ok := used[suggested]; !ok {
+			return suggested, true
+		}
+	}
+
+	for port := s.cfg.PortMin; port <= s.cfg.PortMax; port++ {
+		if _, ok := used[port]; !ok {
+			return port, true
+		}
+	}
+
+	return 0, false
+}
+
+// externalAddress returns the address ports are forwarded on in the same family as the given address, or nil if there is none
+func (s *Server) externalAddress(src net.IP) net.IP {
+	for _, address := range s.cfg.ExternalAddresses {
+		if (address.To4() == nil) == (src.To4() == nil) {
+			return address
+		}
+	}
+
+	return nil
+}
+
+// epoch is the seconds since the server started, which tells clients that mappings were lost when it goes backwards
+func (s *Server) epoch() uint32 {
+	return uint32(time.Since(s.started) / time.Second)
+}
@@ -0,0 +1,295 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+type fakeForwarder struct {
+	mappings map[string][]api.Port
+	// onAdd is called when a mapping is added, if it's set
+	onAdd func()
+	// allocated are the ports handed out from the port pools
+	allocated map[int]struct{}
+}
+
+func (f *fakeForwarder) AddMapping(pubkey string, port api.Port) error {
+	if f.onAdd != nil {
+		f.onAdd()
+	}
+
+	f.mappings[pubkey] = append(f.mappings[pubkey], port)
+	return nil
+}
+
+func (f *fakeForwarder) AllocatedPorts() map[int]struct{} {
+	return f.allocated
+}
+
+func (f *fakeForwarder) RemoveMapping(pubkey string, port api.Port) error {
+	var ports []api.Port
+	for _, p := range f.mappings[pubkey] {
+		if p != port {
+			ports = append(ports, p)
+		}
+	}
+
+	f.mappings[pubkey] = ports
+	return nil
+}
+
+var peer = net.ParseIP("10.99.0.1")
+
+var testConfig = Config{
+	PortMin:            50000,
+	PortMax:            50002,
+	MaxMappingsPerPeer: 2,
+	MaxLifetime:        time.Hour,
+	ExternalAddresses:  []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+}
+
+func newTestServer(t *testing.T) (*Server, *fakeForwarder) {
+	return newTestServerWithConfig(t, testConfig)
+}
+
+func newTestServerWithConfig(t *testing.T, cfg Config) (*Server, *fakeForwarder) {
+	f := &fakeForwarder{mappings: make(map[string][]api.Port)}
+
+	s, err := New(cfg, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetPeers(api.WireguardPeerList{
+		{
+			IPv4:   "10.99.0.1/32",
+			IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+			Ports:  []api.Port{{External: 50000}},
+			Pubkey: "aaaa",
+		},
+	})
+
+	return s, f
+}
+
+func natpmpMapRequest(op uint8, internal uint16, external uint16, lifetime uint32) []byte {
+	b := make([]byte, natpmpMapLength)
+	b[1] = op
+	binary.BigEndian.PutUint16(b[4:6], internal)
+	binary.BigEndian.PutUint16(b[6:8], external)
+	binary.BigEndian.PutUint32(b[8:12], lifetime)
+
+	return b
+}
+
+func pcpMapRequest(client net.IP, protocol uint8, internal uint16, external uint16, lifetime uint32) []byte {
+	b := make([]byte, pcpHeaderLength+pcpMapPayloadLength)
+	b[0] = pcpVersion
+	b[1] = pcpOpMap
+	binary.BigEndian.PutUint32(b[4:8], lifetime)
+	copy(b[8:24], client.To16())
+	b[pcpHeaderLength+12] = protocol
+	binary.BigEndian.PutUint16(b[pcpHeaderLength+16:pcpHeaderLength+18], internal)
+	binary.BigEndian.PutUint16(b[pcpHeaderLength+18:pcpHeaderLength+20], external)
+
+	return b
+}
+
+func TestNATPMP(t *testing.T) {
+	s, f := newTestServer(t)
+
+	response := s.handle(peer, []byte{natpmpVersion, natpmpOpAddress})
+	if len(response) != 12 || binary.BigEndian.Uint16(response[2:4]) != natpmpSuccess || !net.IP(response[8:12]).Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("unexpected address response %v", response)
+	}
+
+	// The suggested port is reserved by the API, so the next free one is handed out
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8080, 50000, 7200))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpSuccess {
+		t.Fatalf("got result %d", code)
+	}
+
+	if external := binary.BigEndian.Uint16(response[10:12]); external != 50001 {
+		t.Errorf("got external port %d, expected 50001", external)
+	}
+
+	if lifetime := binary.BigEndian.Uint32(response[12:16]); lifetime != 3600 {
+		t.Errorf("got lifetime %d, expected the max lifetime", lifetime)
+	}
+
+	// Renewing keeps the same port
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8080, 0, 60))
+	if external := binary.BigEndian.Uint16(response[10:12]); external != 50001 {
+		t.Errorf("got external port %d after renewing, expected 50001", external)
+	}
+
+	expected := map[string][]api.Port{"aaaa": {{External: 50001, Internal: 8080, Protocol: "tcp"}}}
+	if diff := cmp.Diff(expected, f.mappings); diff != "" {
+		t.Errorf("unexpected mappings (-want +got):\n%s", diff)
+	}
+
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapUDP, 8080, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpSuccess {
+		t.Fatalf("got result %d", code)
+	}
+
+	// Both the pool and the limit of the peer are exhausted
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapUDP, 8081, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpOutOfResources {
+		t.Errorf("got result %d, expected out of resources", code)
+	}
+
+	// Deleting every udp mapping
+	s.handle(peer, natpmpMapRequest(natpmpOpMapUDP, 0, 0, 0))
+	if diff := cmp.Diff(expected, f.mappings); diff != "" {
+		t.Errorf("unexpected mappings after deleting (-want +got):\n%s", diff)
+	}
+
+	response = s.handle(net.ParseIP("10.99.0.2"), natpmpMapRequest(natpmpOpMapTCP, 8080, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpNotAuthorized {
+		t.Errorf("got result %d for an unknown peer, expected not authorized", code)
+	}
+}
+
+func TestPCP(t *testing.T) {
+	s, f := newTestServer(t)
+	client := net.ParseIP("fc00:bbbb:bbbb:bb01::1")
+
+	response := s.handle(client, pcpMapRequest(client, 17, 8080, 50002, 60))
+	if len(response) != pcpHeaderLength+pcpMapPayloadLength || response[3] != pcpSuccess {
+		t.Fatalf("unexpected response %v", response)
+	}
+
+	if lifetime := binary.BigEndian.Uint32(response[4:8]); lifetime != 60 {
+		t.Errorf("got lifetime %d, expected 60", lifetime)
+	}
+
+	payload := response[pcpHeaderLength:]
+	if external := binary.BigEndian.Uint16(payload[18:20]); external != 50002 {
+		t.Errorf("got external port %d, expected the suggested one", external)
+	}
+
+	if !net.IP(payload[20:36]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got external address %s", net.IP(payload[20:36]))
+	}
+
+	tests := []struct {
+		name    string
+		src     net.IP
+		request []byte
+		code    uint8
+	}{
+		{
+			name:    "address mismatch",
+			src:     peer,
+			request: pcpMapRequest(client, 17, 8080, 0, 60),
+			code:    pcpAddressMismatch,
+		},
+		{
+			name:    "unsupported protocol",
+			src:     client,
+			request: pcpMapRequest(client, 132, 8080, 0, 60),
+			code:    pcpUnsuppProtocol,
+		},
+		{
+			name:    "all protocols",
+			src:     client,
+			request: pcpMapRequest(client, 0, 0, 0, 60),
+			code:    pcpNotAuthorized,
+		},
+		{
+			name:    "mandatory option",
+			src:     client,
+			request: append(pcpMapRequest(client, 17, 8080, 0, 60), 2, 0, 0, 0),
+			code:    pcpUnsuppOption,
+		},
+		{
+			name:    "unsupported version",
+			src:     client,
+			request: []byte{1, pcpOpMap},
+			code:    pcpUnsuppVersion,
+		},
+	}
+
+	for _, test := range tests {
+		response := s.handle(test.src, test.request)
+		if response[3] != test.code {
+			t.Errorf("%s: got result %d, expected %d", test.name, response[3], test.code)
+		}
+	}
+
+	s.Expire(time.Now().Add(time.Minute))
+	if len(f.mappings["aaaa"]) != 0 {
+		t.Errorf("mappings left after expiry: %v", f.mappings)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	privileged := testConfig
+	privileged.PortMin = 1023
+
+	noAddresses := testConfig
+	noAddresses.ExternalAddresses = nil
+
+	for name, cfg := range map[string]Config{"privileged ports": privileged, "no external addresses": noAddresses} {
+		if _, err := New(cfg, &fakeForwarder{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := testConfig
+	cfg.MappingInterval = time.Hour
+	s, f := newTestServerWithConfig(t, cfg)
+
+	// The forwarder can use the server while a mapping is added, since the lock isn't held
+	f.onAdd = func() {
+		s.Expire(time.Now())
+	}
+
+	response := s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8080, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpSuccess {
+		t.Fatalf("got result %d", code)
+	}
+
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8081, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpOutOfResources {
+		t.Errorf("got result %d for a mapping right after another, expected out of resources", code)
+	}
+
+	// Renewing isn't limited
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8080, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpSuccess {
+		t.Errorf("got result %d when renewing, expected success", code)
+	}
+
+	if len(f.mappings["aaaa"]) != 1 {
+		t.Errorf("expected a single mapping, got %v", f.mappings)
+	}
+}
+
+func TestSkipsAllocatedPorts(t *testing.T) {
+	s, f := newTestServer(t)
+	f.allocated = map[int]struct{}{50001: {}}
+
+	// 50000 is assigned through the API, and 50001 is allocated from a port pool
+	response := s.handle(peer, natpmpMapRequest(natpmpOpMapTCP, 8080, 50001, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpSuccess {
+		t.Fatalf("got result %d", code)
+	}
+
+	if external := binary.BigEndian.Uint16(response[10:12]); external != 50002 {
+		t.Errorf("got external port %d, expected 50002", external)
+	}
+
+	response = s.handle(peer, natpmpMapRequest(natpmpOpMapUDP, 8080, 0, 60))
+	if code := binary.BigEndian.Uint16(response[2:4]); code != natpmpOutOfResources {
+		t.Errorf("got result %d with only allocated ports left, expected out of resources", code)
+	}
+}
@@ -0,0 +1,466 @@
+package portforward
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// allocationsFile is the name of the file in the state directory that allocations are persisted in
+const allocationsFile = "portpool.json"
+
+// privilegedPorts is the upper bound of the ports only root can bind, which are never handed out
+const privilegedPorts = 1023
+
+// PortRange is a range of ports, inclusive
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a range of ports in the form min-max, or a single port
+func ParsePortRange(s string) (PortRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %s", s)
+	}
+
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %s", s)
+	}
+
+	return PortRange{Min: min, Max: max}, nil
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) overlaps(o PortRange) bool {
+	return r.Min <= o.Max && o.Min <= r.Max
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Allocation is a port handed out to a peer from the pool of its exit
+type Allocation struct {
+	Pubkey string `json:"pubkey"`
+	// Exit is the exit the port is forwarded on, empty for the default one
+	Exit string `json:"exit,omitempty"`
+	Port int    `json:"port"`
+}
+
+// AllocatePort hands out a port from the pool of the peer's exit, and forwards it to the peer until it's released or the peer is gone
+// If the rules can't be applied the port is handed back, and the error is returned
+func (p *Portforward) AllocatePort(pubkey string) (int, error) {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	if p.allocator == nil {
+		return 0, fmt.Errorf("no port pools are configured")
+	}
+
+	peer, ok := p.peer(pubkey)
+	if !ok {
+		return 0, fmt.Errorf("unknown peer %s", pubkey)
+	}
+
+	// Ports assigned through the API, or mapped by peers, on the same exit can't be handed out again
+	used := make(map[int]struct{})
+	for _, other := range p.withMappings(p.peers) {
+		if other.Exit != peer.Exit {
+			continue
+		}
+
+		for _, port := range other.Ports {
+			used[port.External] = struct{}{}
+		}
+	}
+
+	port, err := p.allocator.allocate(pubkey, peer.Exit, used)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.update()
+	if err != nil {
+		_, releaseErr := p.allocator.release(pubkey, port)
+		if releaseErr != nil {
+			log.Printf("error releasing port %d of peer %s %s", port, pubkey, releaseErr.Error())
+		}
+		p.update()
+
+		return 0, err
+	}
+
+	p.metrics.Increment("portforwarding_pool_allocated")
+
+	return port, nil
+}
+
+// ReleasePort returns a port of a peer to the pool, or all of its ports if the port is 0, and stops forwarding them
+// If the rules can't be applied the ports stay allocated, and the error is returned
+func (p *Portforward) ReleasePort(pubkey string, port int) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	if p.allocator == nil {
+		return fmt.Errorf("no port pools are configured")
+	}
+
+	previous := make([]Allocation, len(p.allocator.allocations))
+	copy(previous, p.allocator.allocations)
+
+	released, err := p.allocator.release(pubkey, port)
+	if err != nil {
+		return err
+	}
+
+	if released == 0 {
+		return fmt.Errorf("peer %s has no allocated port %d", pubkey, port)
+	}
+
+	err = p.update()
+	if err != nil {
+		restoreErr := p.allocator.restore(previous)
+		if restoreErr != nil {
+			log.Printf("error restoring the port pool allocations of peer %s %s", pubkey, restoreErr.Error())
+		}
+		p.update()
+
+		return err
+	}
+
+	p.metrics.Count("portforwarding_pool_released", released)
+
+	return nil
+}
+
+// ReclaimPorts returns the ports of peers that aren't in the list to the pool
+// The list has to be the full list of peers from the API, since peers left out of the applied list, eg because their tunnel failed, keep their ports
+func (p *Portforward) ReclaimPorts(peers api.WireguardPeerList) {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	if p.allocator == nil {
+		return
+	}
+
+	pubkeys := make(map[string]struct{})
+	for _, peer := range peers {
+		pubkeys[peer.Pubkey] = struct{}{}
+	}
+
+	reclaimed, err := p.allocator.reclaim(pubkeys)
+	if err != nil {
+		log.Printf("error reclaiming port pool allocations %s", err.Error())
+	}
+
+	p.metrics.Count("portforwarding_pool_reclaimed", reclaimed)
+}
+
+// AllocatedPorts returns the ports handed out from the pools of all exits, so that other ways of handing out ports can skip them
+func (p *Portforward) AllocatedPorts() map[int]struct{} {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	ports := make(map[int]struct{})
+	if p.allocator == nil {
+		return ports
+	}
+
+	for _, allocation := range p.allocator.allocations {
+		ports[allocation.Port] = struct{}{}
+	}
+
+	return ports
+}
+
+// Allocations returns the ports handed out from the pools
+func (p *Portforward) Allocations() []Allocation {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	if p.allocator == nil {
+		return nil
+	}
+
+	allocations := make([]Allocation, len(p.allocator.allocations))
+	copy(allocations, p.allocator.allocations)
+
+	return allocations
+}
+
+// allocator hands out ports from a pool per exit, and persists them so that peers keep their ports across restarts
+type allocator struct {
+	path        string
+	pools       map[string]PortRange
+	allocations []Allocation
+	// bound returns the ports local services are listening on, which are never handed out
+	bound func() (map[int]struct{}, error)
+}
+
+// newAllocator validates the pools and loads the persisted allocations
+// Allocations outside of the pools are dropped, since the pools may have changed since they were made
+func newAllocator(stateDir string, pools map[string]PortRange, reserved []PortRange) (*allocator, error) {
+	if stateDir == "" {
+		return nil, fmt.Errorf("a state directory is needed to persist the port pool allocations")
+	}
+
+	for exit, pool := range pools {
+		if pool.Min <= privilegedPorts || pool.Max > 65535 || pool.Min > pool.Max {
+			return nil, fmt.Errorf("invalid port pool %s for exit %s, it has to be within %d-65535", pool, exit, privilegedPorts+1)
+		}
+
+		for _, r := range reserved {
+			if pool.overlaps(r) {
+				return nil, fmt.Errorf("port pool %s for exit %s overlaps the reserved ports %s", pool, exit, r)
+			}
+		}
+	}
+
+	a := &allocator{
+		path:  filepath.Join(stateDir, allocationsFile),
+		pools: pools,
+		bound: listeningPorts,
+	}
+
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []Allocation
+	err = json.Unmarshal(data, &allocations)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing port pool allocations in %s %s", a.path, err.Error())
+	}
+
+	for _, allocation := range allocations {
+		pool, ok := pools[allocation.Exit]
+		if !ok || !pool.contains(allocation.Port) {
+			log.Printf("dropping allocation of port %d for peer %s, it's outside of the port pool", allocation.Port, allocation.Pubkey)
+			continue
+		}
+
+		a.allocations = append(a.allocations, allocation)
+	}
+
+	return a, nil
+}
+
+// allocate hands out the first free port in the pool of the exit, skipping the used ports and ports local services are listening on
+func (a *allocator) allocate(pubkey string, exit string, used map[int]struct{}) (int, error) {
+	pool, ok := a.pools[exit]
+	if !ok {
+		return 0, fmt.Errorf("there is no port pool for the exit %s", exit)
+	}
+
+	bound, err := a.bound()
+	if err != nil {
+		return 0, fmt.Errorf("error getting listening ports %s", err.Error())
+	}
+
+	allocated := make(map[int]struct{})
+	for _, allocation := range a.allocations {
+		if allocation.Exit == exit {
+			allocated[allocation.Port] = struct{}{}
+		}
+	}
+
+	for port := pool.Min; port <= pool.Max; port++ {
+		_, isUsed := used[port]
+		_, isBound := bound[port]
+		_, isAllocated := allocated[port]
+		if isUsed || isBound || isAllocated {
+			continue
+		}
+
+		previous := a.allocations
+		a.allocations = append(a.allocations, Allocation{Pubkey: pubkey, Exit: exit, Port: port})
+
+		err = a.save()
+		if err != nil {
+			a.allocations = previous
+			return 0, err
+		}
+
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("the port pool %s for the exit %s is exhausted", pool, exit)
+}
+
+// release returns a port of a peer to the pool, or all of its ports if the port is 0, and returns how many were released
+func (a *allocator) release(pubkey string, port int) (int, error) {
+	return a.filter(func(allocation Allocation) bool {
+		return allocation.Pubkey != pubkey || (port != 0 && allocation.Port != port)
+	})
+}
+
+// reclaim returns the ports of peers that are gone to the pool, and returns how many were reclaimed
+func (a *allocator) reclaim(peers map[string]struct{}) (int, error) {
+	return a.filter(func(allocation Allocation) bool {
+		_, ok := peers[allocation.Pubkey]
+		return ok
+	})
+}
+
+// restore replaces the allocations with ones returned by an earlier call, and persists them
+func (a *allocator) restore(allocations []Allocation) error {
+	previous := a.allocations
+	a.allocations = allocations
+
+	err := a.save()
+	if err != nil {
+		a.allocations = previous
+		return err
+	}
+
+	return nil
+}
+
+// filter keeps the allocations the keep function returns true for, and persists them if any were removed
+func (a *allocator) filter(keep func(Allocation) bool) (int, error) {
+	var kept []Allocation
+	for _, allocation := range a.allocations {
+		if keep(allocation) {
+			kept = append(kept, allocation)
+		}
+	}
+
+	removed := len(a.allocations) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	previous := a.allocations
+	a.allocations = kept
+
+	err := a.save()
+	if err != nil {
+		a.allocations = previous
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// ports returns the ports allocated to a peer on an exit
+func (a *allocator) ports(pubkey string, exit string) []api.Port {
+	var ports []api.Port
+	for _, allocation := range a.allocations {
+		if allocation.Pubkey == pubkey && allocation.Exit == exit {
+			ports = append(ports, api.Port{External: allocation.Port})
+		}
+	}
+
+	return ports
+}
+
+// save writes the allocations to the state directory, replacing the file atomically so that a crash never leaves a partial file
+func (a *allocator) save() error {
+	allocations := a.allocations
+	if allocations == nil {
+		allocations = []Allocation{}
+	}
+
+	data, err := json.MarshalIndent(allocations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("error saving port pool allocations %s", err.Error())
+	}
+
+	err = os.Rename(tmp, a.path)
+	if err != nil {
+		return fmt.Errorf("error saving port pool allocations %s", err.Error())
+	}
+
+	return nil
+}
+
+// listeningPorts returns the tcp ports in the listening state and the bound udp ports, from /proc/net
+func listeningPorts() (map[int]struct{}, error) {
+	ports := make(map[int]struct{})
+
+	for _, file := range []struct {
+		name  string
+		state string
+	}{
+		{"/proc/net/tcp", "0A"},
+		{"/proc/net/tcp6", "0A"},
+		{"/proc/net/udp", "07"},
+		{"/proc/net/udp6", "07"},
+	} {
+		f, err := os.Open(file.name)
+		if os.IsNotExist(err) {
+			// The family is disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = parseProcNet(f, file.state, ports)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ports, nil
+}
+
+// parseProcNet adds the local ports of the sockets in the given state, from a file in the /proc/net/tcp format
+func parseProcNet(r io.Reader, state string, ports map[int]struct{}) error {
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != state {
+			continue
+		}
+
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+
+		ports[int(port)] = struct{}{}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,246 @@
+package portforward
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager-allocator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pools := map[string]PortRange{
+		"":       {Min: 50000, Max: 50003},
+		"exit-1": {Min: 50000, Max: 50000},
+	}
+
+	a, err := newAllocator(dir, pools, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.bound = func() (map[int]struct{}, error) {
+		return map[int]struct{}{50001: {}}, nil
+	}
+
+	for _, test := range []struct {
+		pubkey   string
+		exit     string
+		used     map[int]struct{}
+		expected int
+	}{
+		{pubkey: "aaaa", expected: 50000},
+		// 50001 is bound by a local service, and 50002 is assigned through the API
+		{pubkey: "aaaa", used: map[int]struct{}{50002: {}}, expected: 50003},
+		// Pools of different exits are separate
+		{pubkey: "bbbb", exit: "exit-1", expected: 50000},
+	} {
+		port, err := a.allocate(test.pubkey, test.exit, test.used)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if port != test.expected {
+			t.Errorf("got port %d, expected %d", port, test.expected)
+		}
+	}
+
+	_, err = a.allocate("cccc", "exit-1", nil)
+	if err == nil {
+		t.Error("allocated a port from an exhausted pool")
+	}
+
+	_, err = a.allocate("cccc", "unknown", nil)
+	if err == nil {
+		t.Error("allocated a port for an exit without a pool")
+	}
+
+	released, err := a.release("aaaa", 50000)
+	if err != nil || released != 1 {
+		t.Errorf("got %d released ports and error %v", released, err)
+	}
+
+	reclaimed, err := a.reclaim(map[string]struct{}{"aaaa": {}})
+	if err != nil || reclaimed != 1 {
+		t.Errorf("got %d reclaimed ports and error %v", reclaimed, err)
+	}
+
+	// The allocations are persisted, and ones outside of the pools are dropped on load
+	delete(pools, "exit-1")
+	a, err = newAllocator(dir, pools, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Allocation{{Pubkey: "aaaa", Port: 50003}}
+	if diff := cmp.Diff(expected, a.allocations); diff != "" {
+		t.Errorf("unexpected allocations (-want +got):\n%s", diff)
+	}
+}
+
+func TestAllocatorPoolValidation(t *testing.T) {
+	for _, pool := range []PortRange{{Min: 80, Max: 2000}, {Min: 5000, Max: 4000}, {Min: 60000, Max: 70000}, {Min: 5300, Max: 5400}} {
+		_, err := newAllocator(os.TempDir(), map[string]PortRange{"": pool}, []PortRange{{Min: 5351, Max: 5351}})
+		if err == nil {
+			t.Errorf("pool %s was accepted", pool)
+		}
+	}
+}
+
+func TestAllocatePortSkipsMappings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager-allocator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := newFakePortforward(t, ConflictPolicyPickOwner)
+	p.allocator, err = newAllocator(dir, map[string]PortRange{"": {Min: 50000, Max: 50001}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.allocator.bound = func() (map[int]struct{}, error) {
+		return nil, nil
+	}
+
+	peers := api.WireguardPeerList{
+		{IPv4: "10.99.0.1/32", Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", Pubkey: "bbbb"},
+	}
+	if err := p.UpdatePortforwarding(peers); err != nil {
+		t.Fatal(err)
+	}
+
+	// A port mapped by another peer, eg through PCP, isn't handed out
+	if err := p.AddMapping("aaaa", api.Port{External: 50000, Internal: 8080, Protocol: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := p.AllocatePort("bbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port != 50001 {
+		t.Errorf("got port %d, expected 50001", port)
+	}
+
+	// The allocated ports are reported, so that they aren't mapped in turn
+	if diff := cmp.Diff(map[int]struct{}{50001: {}}, p.AllocatedPorts()); diff != "" {
+		t.Errorf("unexpected allocated ports (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseProcNet(t *testing.T) {
+	data := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:C350 0100007F:1F90 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1
+`
+
+	ports := make(map[int]struct{})
+	err := parseProcNet(strings.NewReader(data), "0A", ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(map[int]struct{}{8080: {}}, ports); diff != "" {
+		t.Errorf("unexpected ports (-want +got):\n%s", diff)
+	}
+}
+
+func TestAllocatePortFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager-allocator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+	p.allocator, err = newAllocator(dir, map[string]PortRange{"": {Min: 50000, Max: 50001}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.allocator.bound = func() (map[int]struct{}, error) {
+		return nil, nil
+	}
+
+	if err := p.UpdatePortforwarding(api.WireguardPeerList{{IPv4: "10.99.0.1/32", Pubkey: "aaaa"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A port that isn't forwarded is handed back
+	b.err = errors.New("failed")
+	if _, err := p.AllocatePort("aaaa"); err == nil {
+		t.Error("expected an error when the rules can't be applied")
+	}
+
+	if allocations := p.Allocations(); len(allocations) != 0 {
+		t.Errorf("unexpected allocations %v", allocations)
+	}
+
+	// A port that's still forwarded stays allocated
+	b.err = nil
+	port, err := p.AllocatePort("aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.err = errors.New("failed")
+	if err := p.ReleasePort("aaaa", port); err == nil {
+		t.Error("expected an error when the rules can't be applied")
+	}
+
+	if diff := cmp.Diff([]Allocation{{Pubkey: "aaaa", Port: port}}, p.Allocations()); diff != "" {
+		t.Errorf("unexpected allocations (-want +got):\n%s", diff)
+	}
+}
+
+func TestReclaimPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager-allocator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := newFakePortforward(t, ConflictPolicyPickOwner)
+	p.allocator, err = newAllocator(dir, map[string]PortRange{"": {Min: 50000, Max: 50001}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.allocator.bound = func() (map[int]struct{}, error) {
+		return nil, nil
+	}
+
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Pubkey: "aaaa"}
+	if err := p.UpdatePortforwarding(api.WireguardPeerList{peer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.AllocatePort("aaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer left out of the applied peers, eg because its tunnel failed, keeps its port
+	if err := p.UpdatePortforwarding(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p.ReclaimPorts(api.WireguardPeerList{peer})
+	if allocations := p.Allocations(); len(allocations) != 1 {
+		t.Errorf("unexpected allocations %v", allocations)
+	}
+
+	// A peer gone from the API doesn't
+	p.ReclaimPorts(nil)
+	if allocations := p.Allocations(); len(allocations) != 0 {
+		t.Errorf("unexpected allocations %v", allocations)
+	}
+}
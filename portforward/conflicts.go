@@ -0,0 +1,192 @@
+package portforward
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// ConflictPolicy decides what happens to a port that's forwarded to more than one peer
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyPickOwner forwards the port to the peer with the lowest public key, so that the same peer wins on every relay
+	ConflictPolicyPickOwner ConflictPolicy = "pick-owner"
+	// ConflictPolicySkip forwards the port to none of the peers
+	ConflictPolicySkip ConflictPolicy = "skip"
+)
+
+// Conflict is a port assigned to more than one peer, for one protocol, address family and exit
+type Conflict struct {
+	// Exit is the exit the peers are assigned to, empty for the default one
+	Exit     string   `json:"exit,omitempty"`
+	Family   string   `json:"family"`
+	Protocol string   `json:"protocol"`
+	Port     int      `json:"port"`
+	Pubkeys  []string `json:"pubkeys"`
+	// Owner is the public key of the peer the port is forwarded to, empty if it isn't forwarded at all
+	Owner string `json:"owner,omitempty"`
+}
+
+// portClaim is a port forwarded for one protocol and address family on an ipset, which only a single peer can own
+type portClaim struct {
+	ipv6     bool
+	ipset    string
+	protocol string
+	port     int
+}
+
+// Conflicts returns the conflicts found during the last update
+func (p *Portforward) Conflicts() []Conflict {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conflicts := make([]Conflict, len(p.conflicts))
+	copy(conflicts, p.conflicts)
+
+	return conflicts
+}
+
+// detectConflicts finds ports claimed by more than one peer, and returns the owner of each according to the policy
+// An empty owner means nobody gets the port
+func (p *Portforward) detectConflicts(peers api.WireguardPeerList) (map[portClaim]string, []Conflict) {
+	claimants := make(map[portClaim]map[string]struct{})
+	exits := make(map[portClaim]string)
+
+	for _, peer := range peers {
+		exit, err := p.exit(peer)
+		if err != nil {
+			// Ports aren't forwarded for the peer at all
+			continue
+		}
+
+		ipv4, ipv6 := peerAddresses(peer)
+
+		for _, family := range []struct {
+			ipv6    bool
+			address string
+			ipset   string
+		}{{false, ipv4, exit.IPSetIPv4}, {true, ipv6, exit.IPSetIPv6}} {
+			if family.address == "" {
+				continue
+			}
+
+			for _, port := range peer.Ports {
+				for _, protocol := range []string{"tcp", "udp"} {
+					if !port.HasProtocol(protocol) {
+						continue
+					}
+
+					claim := portClaim{ipv6: family.ipv6, ipset: family.ipset, protocol: protocol, port: port.External}
+					exits[claim] = peer.Exit
+					if claimants[claim] == nil {
+						claimants[claim] = make(map[string]struct{})
+					}
+					claimants[claim][peer.Pubkey] = struct{}{}
+				}
+			}
+		}
+	}
+
+	owners := make(map[portClaim]string)
+	var conflicts []Conflict
+
+	for claim, pubkeys := range claimants {
+		if len(pubkeys) < 2 {
+			continue
+		}
+
+		conflict := Conflict{
+			Exit:     exits[claim],
+			Family:   "ipv4",
+			Protocol: claim.protocol,
+			Port:     claim.port,
+		}
+		if claim.ipv6 {
+			conflict.Family = "ipv6"
+		}
+
+		for pubkey := range pubkeys {
+			conflict.Pubkeys = append(conflict.Pubkeys, pubkey)
+		}
+		sort.Strings(conflict.Pubkeys)
+
+		if p.conflictPolicy != ConflictPolicySkip {
+			conflict.Owner = conflict.Pubkeys[0]
+		}
+
+		owners[claim] = conflict.Owner
+		conflicts = append(conflicts, conflict)
+	}
+
+	sort.Slice(conflicts, func(i int, j int) bool {
+		a, b := conflicts[i], conflicts[j]
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		return a.Exit < b.Exit
+	})
+
+	return owners, conflicts
+}
+
+// conflicted checks whether a peer claims a port another peer claims too, or did in the conflicts found during the last update
+// The rules of such a peer can't be changed on their own, since the policy may move ports between it and the other peers
+func (p *Portforward) conflicted(pubkey string) bool {
+	for _, c := range p.Conflicts() {
+		for _, claimant := range c.Pubkeys {
+			if claimant == pubkey {
+				return true
+			}
+		}
+	}
+
+	peers := make(api.WireguardPeerList, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, p.withPeerMappings(peer))
+	}
+	peers, _, _ = withoutExpired(peers, time.Now())
+
+	_, conflicts := p.detectConflicts(peers)
+	for _, c := range conflicts {
+		for _, claimant := range c.Pubkeys {
+			if claimant == pubkey {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// reportConflicts logs and stores the conflicts, so that they can be fixed in the API
+func (p *Portforward) reportConflicts(conflicts []Conflict) {
+	for _, c := range conflicts {
+		outcome := "forwarding to " + c.Owner
+		if c.Owner == "" {
+			outcome = "not forwarding"
+		}
+
+		exit := c.Exit
+		if exit == "" {
+			exit = "the default exit"
+		}
+
+		log.Printf("portforwarding conflict: %s %s port %d on %s is assigned to peers %s, %s", c.Family, c.Protocol, c.Port, exit, strings.Join(c.Pubkeys, ", "), outcome)
+	}
+
+	p.metrics.Gauge("portforwarding_conflicts", len(conflicts))
+
+	p.mu.Lock()
+	p.conflicts = conflicts
+	p.mu.Unlock()
+}
@@ -0,0 +1,296 @@
+package portforward
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// fakeBackend keeps the rules in memory
+type fakeBackend struct {
+	rules map[rule]struct{}
+	// updateCalls and counterCalls are how many times all rules were updated, and the counters were read
+	updateCalls  int
+	counterCalls int
+	// err fails every change of the rules, and removeErr every removal, without changing them
+	err       error
+	removeErr error
+	// failRule fails adding the rules it returns true for, while the rest are added, if it's set
+	failRule func(rule) bool
+}
+
+func (b *fakeBackend) update(rules map[rule]struct{}) ([]rule, error) {
+	b.updateCalls++
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	var removed []rule
+	for r := range b.rules {
+		if _, ok := rules[r]; !ok {
+			removed = append(removed, r)
+		}
+	}
+
+	b.rules = make(map[rule]struct{})
+	for r := range rules {
+		b.rules[r] = struct{}{}
+	}
+
+	return removed, nil
+}
+
+func (b *fakeBackend) add(rules map[rule]struct{}) ([]rule, int, error) {
+	if b.err != nil {
+		return nil, 0, b.err
+	}
+
+	if b.rules == nil {
+		b.rules = make(map[rule]struct{})
+	}
+
+	var added []rule
+	var err error
+	existing := 0
+	for r := range rules {
+		if _, ok := b.rules[r]; ok {
+			existing++
+			continue
+		}
+
+		if b.failRule != nil && b.failRule(r) {
+			err = errors.New("failed")
+			continue
+		}
+
+		b.rules[r] = struct{}{}
+		added = append(added, r)
+	}
+
+	return added, existing, err
+}
+
+func (b *fakeBackend) remove(rules map[rule]struct{}) ([]rule, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.removeErr != nil {
+		return nil, b.removeErr
+	}
+
+	var removed []rule
+	for r := range rules {
+		if _, ok := b.rules[r]; ok {
+			removed = append(removed, r)
+			delete(b.rules, r)
+		}
+	}
+
+	return removed, nil
+}
+
+func (b *fakeBackend) scaffold(exits []Exit) error {
+	return nil
+}
+
+func (b *fakeBackend) counters() (map[rule]ruleCounters, error) {
+	b.counterCalls++
+	return nil, nil
+}
+
+// newFakePortforward returns a portforward applying its rules to a fakeBackend
+func newFakePortforward(t *testing.T, policy ConflictPolicy) (*Portforward, *fakeBackend) {
+	t.Helper()
+
+	metrics, err := statsd.New(statsd.Mute(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBackend{}
+	return &Portforward{
+		backend:        b,
+		conflictPolicy: policy,
+		metrics:        metrics,
+	}, b
+}
+
+var conflictingPeers = api.WireguardPeerList{
+	{
+		IPv4:   "10.99.0.2/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+		Ports:  []api.Port{{External: 1234}, {External: 5678, Protocol: "udp"}},
+		Pubkey: "bbbb",
+	},
+	{
+		IPv4:   "10.99.0.1/32",
+		Ports:  []api.Port{{External: 1234, Internal: 80, Protocol: "tcp"}, {External: 5678, Protocol: "tcp"}},
+		Pubkey: "aaaa",
+	},
+}
+
+func TestDetectConflicts(t *testing.T) {
+	tests := []struct {
+		policy   ConflictPolicy
+		expected []Conflict
+		rules    []rule
+	}{
+		{
+			policy: ConflictPolicyPickOwner,
+			expected: []Conflict{
+				{Family: "ipv4", Protocol: "tcp", Port: 1234, Pubkeys: []string{"aaaa", "bbbb"}, Owner: "aaaa"},
+			},
+			rules: []rule{
+				{protocol: "tcp", ports: "1234", destination: "10.99.0.1", toPort: 80},
+				{protocol: "tcp", ports: "5678", destination: "10.99.0.1"},
+				{protocol: "udp", ports: "1234,5678", destination: "10.99.0.2"},
+				{ipv6: true, protocol: "tcp", ports: "1234", destination: "fc00:bbbb:bbbb:bb01::2"},
+				{ipv6: true, protocol: "udp", ports: "1234,5678", destination: "fc00:bbbb:bbbb:bb01::2"},
+			},
+		},
+		{
+			policy: ConflictPolicySkip,
+			expected: []Conflict{
+				{Family: "ipv4", Protocol: "tcp", Port: 1234, Pubkeys: []string{"aaaa", "bbbb"}},
+			},
+			rules: []rule{
+				{protocol: "tcp", ports: "5678", destination: "10.99.0.1"},
+				{protocol: "udp", ports: "1234,5678", destination: "10.99.0.2"},
+				{ipv6: true, protocol: "tcp", ports: "1234", destination: "fc00:bbbb:bbbb:bb01::2"},
+				{ipv6: true, protocol: "udp", ports: "1234,5678", destination: "fc00:bbbb:bbbb:bb01::2"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		p := &Portforward{conflictPolicy: test.policy}
+
+		owners, conflicts := p.detectConflicts(conflictingPeers)
+		if diff := cmp.Diff(test.expected, conflicts); diff != "" {
+			t.Errorf("%s: unexpected conflicts (-want +got):\n%s", test.policy, diff)
+		}
+
+		rules := make(map[rule]struct{})
+		for _, peer := range conflictingPeers {
+			pubkey := peer.Pubkey
+			p.createPeerRules(peer, rules, func(claim portClaim) bool {
+				owner, conflicted := owners[claim]
+				return !conflicted || owner == pubkey
+			})
+		}
+
+		expected := make(map[rule]struct{})
+		for _, r := range test.rules {
+			expected[r] = struct{}{}
+		}
+
+		if diff := cmp.Diff(expected, rules, cmp.AllowUnexported(rule{})); diff != "" {
+			t.Errorf("%s: unexpected rules (-want +got):\n%s", test.policy, diff)
+		}
+	}
+}
+
+func TestDetectConflictsPerExit(t *testing.T) {
+	p := &Portforward{
+		conflictPolicy: ConflictPolicyPickOwner,
+		defaultExit:    Exit{IPSetIPv4: "PORTFORWARDING_IPV4", IPSetIPv6: "PORTFORWARDING_IPV6"},
+		exits: map[string]Exit{
+			"exit-1": {IPSetIPv4: "EXIT1_IPV4", IPSetIPv6: "EXIT1_IPV6"},
+		},
+	}
+
+	peers := api.WireguardPeerList{
+		{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "bbbb", Exit: "exit-1"},
+		{IPv4: "10.99.0.3/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "cccc", Exit: "exit-1"},
+		{IPv4: "10.99.0.4/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "dddd", Exit: "unknown"},
+	}
+
+	owners, conflicts := p.detectConflicts(peers)
+
+	expectedConflicts := []Conflict{
+		{Exit: "exit-1", Family: "ipv4", Protocol: "tcp", Port: 1234, Pubkeys: []string{"bbbb", "cccc"}, Owner: "bbbb"},
+	}
+	if diff := cmp.Diff(expectedConflicts, conflicts); diff != "" {
+		t.Errorf("unexpected conflicts (-want +got):\n%s", diff)
+	}
+
+	rules := make(map[rule]struct{})
+	for _, peer := range peers {
+		pubkey := peer.Pubkey
+		err := p.createPeerRules(peer, rules, func(claim portClaim) bool {
+			owner, conflicted := owners[claim]
+			return !conflicted || owner == pubkey
+		})
+		if (err != nil) != (peer.Exit == "unknown") {
+			t.Errorf("%s: unexpected error %v", pubkey, err)
+		}
+	}
+
+	expected := map[rule]struct{}{
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4", ports: "1234", destination: "10.99.0.1"}: {},
+		{protocol: "tcp", ipset: "EXIT1_IPV4", ports: "1234", destination: "10.99.0.2"}:          {},
+	}
+	if diff := cmp.Diff(expected, rules, cmp.AllowUnexported(rule{})); diff != "" {
+		t.Errorf("unexpected rules (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddPortforwardingConflicts(t *testing.T) {
+	existing := api.WireguardPeer{IPv4: "10.99.0.2/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "bbbb"}
+	added := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "aaaa"}
+
+	existingRule := rule{protocol: "tcp", ports: "1234", destination: "10.99.0.2"}
+	addedRule := rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"}
+
+	tests := []struct {
+		policy ConflictPolicy
+		rules  []rule
+	}{
+		{policy: ConflictPolicyPickOwner, rules: []rule{addedRule}},
+		{policy: ConflictPolicySkip, rules: []rule{}},
+	}
+
+	for _, test := range tests {
+		p, b := newFakePortforward(t, test.policy)
+
+		if err := p.UpdatePortforwarding(api.WireguardPeerList{existing}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.AddPortforwarding(added); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := make(map[rule]struct{})
+		for _, r := range test.rules {
+			expected[r] = struct{}{}
+		}
+
+		if diff := cmp.Diff(expected, b.rules, cmp.AllowUnexported(rule{})); diff != "" {
+			t.Errorf("%s: unexpected rules after adding a conflicting peer (-want +got):\n%s", test.policy, diff)
+		}
+
+		if len(p.Conflicts()) != 1 {
+			t.Errorf("%s: expected the conflict to be reported, got %v", test.policy, p.Conflicts())
+		}
+
+		// The port goes back to the remaining peer
+		if err := p.RemovePortforwarding(added); err != nil {
+			t.Fatal(err)
+		}
+
+		expected = map[rule]struct{}{existingRule: {}}
+		if diff := cmp.Diff(expected, b.rules, cmp.AllowUnexported(rule{})); diff != "" {
+			t.Errorf("%s: unexpected rules after removing the conflicting peer (-want +got):\n%s", test.policy, diff)
+		}
+
+		if len(p.Conflicts()) != 0 {
+			t.Errorf("%s: expected no conflicts, got %v", test.policy, p.Conflicts())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package portforward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/ti-mo/netfilter"
+)
+
+// Conntrack netlink message and attribute types, from linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctMsgGet    netfilter.MessageType = 1
+	ctMsgDelete netfilter.MessageType = 2
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaStatus     = 3
+	ctaFilter     = 25
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	ctaFilterReplyFlags = 2
+
+	ctaFilterFlagIPSrc    = 1 << 0
+	ctaFilterFlagProtoNum = 1 << 3
+)
+
+// ipsDstNAT is the status bit of connections whose destination was translated, from linux/netfilter/nf_conntrack_common.h
+const ipsDstNAT = 1 << 5
+
+var protocolNumbers = map[string]uint8{
+	"tcp": 6,
+	"udp": 17,
+}
+
+// conntrackEntry is the part of a conntrack entry needed to tell which portforwarding rule it went through
+type conntrackEntry struct {
+	family   netfilter.ProtoFamily
+	original netfilter.Attribute
+	status   uint32
+
+	protocol uint8
+	// dst and dstPort are the address and port the connection was made to on the relay
+	dst     net.IP
+	dstPort uint16
+	// replySrc and replySrcPort are the address and port on the peer the connection was forwarded to
+	replySrc     net.IP
+	replySrcPort uint16
+}
+
+// conntrackFilter selects the entries of connections to one peer address over one protocol
+type conntrackFilter struct {
+	ipv6        bool
+	protocol    string
+	destination string
+}
+
+// flushConntrack deletes the conntrack entries of connections forwarded by the given rules, and returns how many were deleted
+// The exits are the relay addresses on each ipset, connections made to other addresses aren't forwarded by the rules on it
+// Without this, established connections keep reaching the peer a port was forwarded to after it's removed or reassigned
+func flushConntrack(rules []rule, exits map[string][]net.IP) (int, error) {
+	forwards := make(map[conntrackFilter][]rule)
+	for _, r := range rules {
+		if r.forward() {
+			f := conntrackFilter{ipv6: r.ipv6, protocol: r.protocol, destination: r.destination}
+			forwards[f] = append(forwards[f], r)
+		}
+	}
+
+	if len(forwards) == 0 {
+		return 0, nil
+	}
+
+	conn, err := netfilter.Dial(&netlink.Config{})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	flushed := 0
+	for f, rules := range forwards {
+		entries, err := dumpConntrack(conn, f)
+		if err != nil {
+			return flushed, err
+		}
+
+		for _, e := range entries {
+			for _, r := range rules {
+				if !r.forwarded(e, exits[r.ipset]) {
+					continue
+				}
+
+				// The entry may have timed out since it was dumped, so failing to delete a single entry isn't an error
+				if deleteConntrack(conn, e) == nil {
+					flushed++
+				}
+				break
+			}
+		}
+	}
+
+	return flushed, nil
+}
+
+// dumpConntrack returns the entries of connections matching the filter
+// The kernel only filters on the reply source and the protocol since linux 5.8, older kernels ignore the filter and return all entries of the family
+func dumpConntrack(conn *netfilter.Conn, f conntrackFilter) ([]conntrackEntry, error) {
+	family, srcType, address := netfilter.ProtoIPv4, uint16(ctaIPv4Src), net.ParseIP(f.destination).To4()
+	if f.ipv6 {
+		family, srcType, address = netfilter.ProtoIPv6, ctaIPv6Src, net.ParseIP(f.destination).To16()
+	}
+
+	if address == nil {
+		return nil, fmt.Errorf("invalid portforwarding destination %s", f.destination)
+	}
+
+	request, err := netfilter.MarshalNetlink(netfilter.Header{
+		SubsystemID: netfilter.NFSubsysCTNetlink,
+		MessageType: ctMsgGet,
+		Family:      family,
+		Flags:       netlink.Request | netlink.Dump,
+	}, []netfilter.Attribute{
+		{
+			Type:   ctaTupleReply,
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{Type: ctaTupleIP, Nested: true, Children: []netfilter.Attribute{{Type: srcType, Data: address}}},
+				{Type: ctaTupleProto, Nested: true, Children: []netfilter.Attribute{{Type: ctaProtoNum, Data: []byte{protocolNumbers[f.protocol]}}}},
+			},
+		},
+		{
+			Type:   ctaFilter,
+			Nested: true,
+			// Unlike the tuples, the flags are in host byte order
+			Children: []netfilter.Attribute{{Type: ctaFilterReplyFlags, Data: nlenc.Uint32Bytes(ctaFilterFlagIPSrc | ctaFilterFlagProtoNum)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := conn.Query(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []conntrackEntry
+	for _, m := range messages {
+		h, attrs, err := netfilter.UnmarshalNetlink(m)
+		if err != nil {
+			return nil, err
+		}
+
+		e, ok := parseConntrackEntry(h.Family, attrs)
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+func deleteConntrack(conn *netfilter.Conn, e conntrackEntry) error {
+	request, err := netfilter.MarshalNetlink(netfilter.Header{
+		SubsystemID: netfilter.NFSubsysCTNetlink,
+		MessageType: ctMsgDelete,
+		Family:      e.family,
+		Flags:       netlink.Request | netlink.Acknowledge,
+	}, []netfilter.Attribute{e.original})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Query(request)
+	return err
+}
+
+// parseConntrackEntry parses the tuples of an entry, returning false for entries that aren't tcp or udp
+func parseConntrackEntry(family netfilter.ProtoFamily, attrs []netfilter.Attribute) (conntrackEntry, bool) {
+	e := conntrackEntry{family: family}
+	var hasOriginal, hasReply bool
+
+	for _, a := range attrs {
+		switch a.Type {
+		case ctaStatus:
+			if len(a.Data) == 4 {
+				e.status = a.Uint32()
+			}
+		case ctaTupleOrig:
+			hasOriginal = true
+			e.original = a
+
+			for _, t := range a.Children {
+				switch t.Type {
+				case ctaTupleIP:
+					for _, ip := range t.Children {
+						if ip.Type == ctaIPv4Dst || ip.Type == ctaIPv6Dst {
+							e.dst = net.IP(ip.Data)
+						}
+					}
+				case ctaTupleProto:
+					for _, p := range t.Children {
+						switch p.Type {
+						case ctaProtoNum:
+							if len(p.Data) == 1 {
+								e.protocol = p.Data[0]
+							}
+						case ctaProtoDstPort:
+							if len(p.Data) == 2 {
+								e.dstPort = p.Uint16()
+							}
+						}
+					}
+				}
+			}
+		case ctaTupleReply:
+			hasReply = true
+
+			for _, t := range a.Children {
+				switch t.Type {
+				case ctaTupleIP:
+					for _, ip := range t.Children {
+						if ip.Type == ctaIPv4Src || ip.Type == ctaIPv6Src {
+							e.replySrc = net.IP(ip.Data)
+						}
+					}
+				case ctaTupleProto:
+					for _, p := range t.Children {
+						if p.Type == ctaProtoSrcPort && len(p.Data) == 2 {
+							e.replySrcPort = p.Uint16()
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if !hasOriginal || !hasReply || e.replySrc == nil || (e.protocol != protocolNumbers["tcp"] && e.protocol != protocolNumbers["udp"]) {
+		return conntrackEntry{}, false
+	}
+
+	return e, true
+}
+
+// forwarded checks whether a conntrack entry is for a connection forwarded by the rule
+// The connection must have had its destination translated, and been made to one of the exit addresses, if they're known,
+// so that connections made directly to the peer over the tunnel are left alone
+func (r rule) forwarded(e conntrackEntry, exit []net.IP) bool {
+	if e.status&ipsDstNAT == 0 || e.protocol != protocolNumbers[r.protocol] || !e.replySrc.Equal(net.ParseIP(r.destination)) {
+		return false
+	}
+
+	if len(exit) > 0 && !containsIP(exit, e.dst) {
+		return false
+	}
+
+	for _, port := range strings.Split(r.ports, ",") {
+		p, err := strconv.Atoi(port)
+		if err != nil || p != int(e.dstPort) {
+			continue
+		}
+
+		toPort := p
+		if r.toPort != 0 {
+			toPort = r.toPort
+		}
+
+		return toPort == int(e.replySrcPort)
+	}
+
+	return false
+}
+
+func containsIP(addresses []net.IP, ip net.IP) bool {
+	for _, address := range addresses {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,149 @@
+package portforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ti-mo/netfilter"
+)
+
+// conntrackTuple builds a tuple attribute the way the kernel sends it
+func conntrackTuple(t uint16, src net.IP, dst net.IP, protocol uint8, srcPort uint16, dstPort uint16) netfilter.Attribute {
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Src+1)
+	if src.To4() == nil {
+		srcType, dstType = ctaIPv6Src, ctaIPv6Src+1
+	} else {
+		src, dst = src.To4(), dst.To4()
+	}
+
+	return netfilter.Attribute{
+		Type:   t,
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{
+				Type:   ctaTupleIP,
+				Nested: true,
+				Children: []netfilter.Attribute{
+					{Type: srcType, Data: src},
+					{Type: dstType, Data: dst},
+				},
+			},
+			{
+				Type:   ctaTupleProto,
+				Nested: true,
+				Children: []netfilter.Attribute{
+					{Type: ctaProtoNum, Data: []byte{protocol}},
+					{Type: ctaProtoSrcPort, Data: netfilter.Uint16Bytes(srcPort)},
+					{Type: ctaProtoDstPort, Data: netfilter.Uint16Bytes(dstPort)},
+				},
+			},
+		},
+	}
+}
+
+// conntrackStatus builds a status attribute
+func conntrackStatus(status uint32) netfilter.Attribute {
+	return netfilter.Attribute{Type: ctaStatus, Data: netfilter.Uint32Bytes(status)}
+}
+
+func TestConntrackForwarded(t *testing.T) {
+	client := net.ParseIP("198.51.100.1")
+	relay := net.ParseIP("192.0.2.1")
+	peer := net.ParseIP("10.99.0.1")
+	exit := []net.IP{relay, net.ParseIP("2001:db8::1")}
+
+	tests := []struct {
+		name     string
+		entry    []netfilter.Attribute
+		rule     rule
+		expected bool
+	}{
+		{
+			name: "forwarded to the same port",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, client, relay, 6, 40000, 1234),
+				conntrackTuple(ctaTupleReply, peer, client, 6, 1234, 40000),
+			},
+			rule:     rule{protocol: "tcp", ports: "1234,4321", destination: "10.99.0.1"},
+			expected: true,
+		},
+		{
+			name: "forwarded to a mapped port",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, client, relay, 17, 40000, 51234),
+				conntrackTuple(ctaTupleReply, peer, client, 17, 8080, 40000),
+			},
+			rule:     rule{protocol: "udp", ports: "51234", destination: "10.99.0.1", toPort: 8080},
+			expected: true,
+		},
+		{
+			name: "different protocol",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, client, relay, 17, 40000, 1234),
+				conntrackTuple(ctaTupleReply, peer, client, 17, 1234, 40000),
+			},
+			rule: rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"},
+		},
+		{
+			name: "different peer",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, client, relay, 6, 40000, 1234),
+				conntrackTuple(ctaTupleReply, net.ParseIP("10.99.0.2"), client, 6, 1234, 40000),
+			},
+			rule: rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"},
+		},
+		{
+			name: "not forwarded",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, peer, client, 6, 1234, 443),
+				conntrackTuple(ctaTupleReply, client, relay, 6, 443, 1234),
+			},
+			rule: rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"},
+		},
+		{
+			name: "not destination translated",
+			entry: []netfilter.Attribute{
+				conntrackStatus(0),
+				conntrackTuple(ctaTupleOrig, client, peer, 6, 40000, 1234),
+				conntrackTuple(ctaTupleReply, peer, client, 6, 1234, 40000),
+			},
+			rule: rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"},
+		},
+		{
+			name: "made to another exit",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, client, net.ParseIP("192.0.2.2"), 6, 40000, 1234),
+				conntrackTuple(ctaTupleReply, peer, client, 6, 1234, 40000),
+			},
+			rule: rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"},
+		},
+		{
+			name: "ipv6",
+			entry: []netfilter.Attribute{
+				conntrackStatus(ipsDstNAT),
+				conntrackTuple(ctaTupleOrig, net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8::1"), 6, 40000, 1234),
+				conntrackTuple(ctaTupleReply, net.ParseIP("fc00:bbbb:bbbb:bb01::1"), net.ParseIP("2001:db8:1::1"), 6, 1234, 40000),
+			},
+			rule:     rule{ipv6: true, protocol: "tcp", ports: "1234", destination: "fc00:bbbb:bbbb:bb01::1"},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		e, ok := parseConntrackEntry(netfilter.ProtoIPv4, test.entry)
+		if !ok {
+			t.Errorf("%s: entry not parsed", test.name)
+			continue
+		}
+
+		if result := test.rule.forwarded(e, exit); result != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package portforward
+
+import (
+	"log"
+)
+
+// ruleCounters are the packet and byte counters of a rule
+type ruleCounters struct {
+	packets uint64
+	bytes   uint64
+}
+
+// reportCounters sends aggregate metrics about how much the forwards are used since the last synchronization
+// It's only called when the peers are synchronized, not on the updates in between, so that the interval stays the same
+// A forward is a single portforwarding rule, and nothing identifying the peers is sent
+func (p *Portforward) reportCounters() {
+	counters, err := p.backend.counters()
+	if err != nil {
+		p.metrics.Increment("portforwarding_counters_error")
+		log.Printf("error getting portforwarding rule counters %s", err.Error())
+		return
+	}
+
+	p.metrics.Gauge("portforwarding_active_forwards", len(counters))
+
+	// The counters before the first update cover an unknown interval, so they're only used as a baseline
+	previousCounters := p.counters
+	p.counters = counters
+	if previousCounters == nil {
+		return
+	}
+
+	withTraffic, bytes := trafficSince(previousCounters, counters)
+	p.metrics.Gauge("portforwarding_forwards_with_traffic", withTraffic)
+	p.metrics.Count("portforwarding_forwarded_bytes", bytes)
+}
+
+// trafficSince returns the number of rules that had traffic, and the total bytes, between the previous and current counters
+func trafficSince(previousCounters map[rule]ruleCounters, counters map[rule]ruleCounters) (int, uint64) {
+	withTraffic := 0
+	var bytes uint64
+
+	for r, c := range counters {
+		previous, ok := previousCounters[r]
+
+		// Rules added or recreated since the last update have been counting since they were added
+		if !ok || c.packets < previous.packets || c.bytes < previous.bytes {
+			previous = ruleCounters{}
+		}
+
+		if c.packets > previous.packets {
+			withTraffic++
+		}
+
+		bytes += c.bytes - previous.bytes
+	}
+
+	return withTraffic, bytes
+}
@@ -0,0 +1,59 @@
+package portforward
+
+import (
+	"testing"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestTrafficSince(t *testing.T) {
+	idle := rule{protocol: "tcp", ports: "1234", destination: "10.99.0.1"}
+	active := rule{protocol: "udp", ports: "1234", destination: "10.99.0.1"}
+	recreated := rule{protocol: "tcp", ports: "4321", destination: "10.99.0.2"}
+	added := rule{protocol: "udp", ports: "4321", destination: "10.99.0.2"}
+	removed := rule{protocol: "tcp", ports: "5678", destination: "10.99.0.3"}
+
+	previous := map[rule]ruleCounters{
+		idle:      {packets: 10, bytes: 1000},
+		active:    {packets: 10, bytes: 1000},
+		recreated: {packets: 10, bytes: 1000},
+		removed:   {packets: 10, bytes: 1000},
+	}
+
+	current := map[rule]ruleCounters{
+		idle:      {packets: 10, bytes: 1000},
+		active:    {packets: 15, bytes: 1500},
+		recreated: {packets: 2, bytes: 200},
+		added:     {packets: 1, bytes: 100},
+	}
+
+	withTraffic, bytes := trafficSince(previous, current)
+	if withTraffic != 3 {
+		t.Errorf("got %d forwards with traffic, expected 3", withTraffic)
+	}
+
+	if bytes != 800 {
+		t.Errorf("got %d bytes, expected 800", bytes)
+	}
+}
+
+func TestCountersOnlyOnSync(t *testing.T) {
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234}}, Pubkey: "aaaa"}
+	if err := p.UpdatePortforwarding(api.WireguardPeerList{peer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.AddMapping("aaaa", api.Port{External: 50000, Internal: 8080, Protocol: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.RemoveMapping("aaaa", api.Port{External: 50000, Internal: 8080, Protocol: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.counterCalls != 1 {
+		t.Errorf("got the counters %d times, expected only on the synchronization", b.counterCalls)
+	}
+}
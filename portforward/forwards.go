@@ -0,0 +1,113 @@
+package portforward
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Forward is a port forwarded to a peer, for one protocol and address family
+type Forward struct {
+	Pubkey string `json:"pubkey"`
+	// Exit is the exit the port is forwarded on, empty for the default one
+	Exit     string `json:"exit,omitempty"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	// Destination is the tunnel address of the peer the port is forwarded to
+	Destination string     `json:"destination"`
+	ToPort      int        `json:"to_port"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// Forwards returns the ports forwarded by the last applied rules, ordered by port
+func (p *Portforward) Forwards() []Forward {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	forwards := []Forward{}
+	for _, peerForwards := range p.forwards {
+		forwards = append(forwards, peerForwards...)
+	}
+
+	sort.Slice(forwards, func(i int, j int) bool {
+		a, b := forwards[i], forwards[j]
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+
+		if a.Exit != b.Exit {
+			return a.Exit < b.Exit
+		}
+
+		return a.Destination < b.Destination
+	})
+
+	return forwards
+}
+
+// setForwards replaces the forwarded ports of a peer after its rules were added or removed on their own
+func (p *Portforward) setForwards(pubkey string, forwards []Forward) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.forwards == nil {
+		p.forwards = make(map[string][]Forward)
+	}
+
+	if len(forwards) == 0 {
+		delete(p.forwards, pubkey)
+		return
+	}
+
+	p.forwards[pubkey] = forwards
+}
+
+// peerForwards returns the ports forwarded to a peer by the rules createPeerRules creates for it, given the same owns function
+func (p *Portforward) peerForwards(peer api.WireguardPeer, owns func(portClaim) bool) []Forward {
+	exit, err := p.exit(peer)
+	if err != nil {
+		return nil
+	}
+
+	ipv4, ipv6 := peerAddresses(peer)
+
+	var forwards []Forward
+	for _, family := range []struct {
+		ipv6    bool
+		address string
+		ipset   string
+	}{{false, ipv4, exit.IPSetIPv4}, {true, ipv6, exit.IPSetIPv6}} {
+		if family.address == "" {
+			continue
+		}
+
+		for _, port := range peer.Ports {
+			for _, protocol := range []string{"tcp", "udp"} {
+				if !port.HasProtocol(protocol) {
+					continue
+				}
+
+				if owns != nil && !owns(portClaim{ipv6: family.ipv6, ipset: family.ipset, protocol: protocol, port: port.External}) {
+					continue
+				}
+
+				forwards = append(forwards, Forward{
+					Pubkey:      peer.Pubkey,
+					Exit:        peer.Exit,
+					Protocol:    protocol,
+					Port:        port.External,
+					Destination: family.address,
+					ToPort:      port.InternalPort(),
+					Expires:     port.Expires,
+				})
+			}
+		}
+	}
+
+	return forwards
+}
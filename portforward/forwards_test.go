@@ -0,0 +1,149 @@
+package portforward
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestPeerForwards(t *testing.T) {
+	p := &Portforward{conflictPolicy: ConflictPolicyPickOwner}
+
+	owners, _ := p.detectConflicts(conflictingPeers)
+	for _, peer := range conflictingPeers {
+		p.setForwards(peer.Pubkey, p.peerForwards(peer, func(claim portClaim) bool {
+			owner, conflicted := owners[claim]
+			return !conflicted || owner == peer.Pubkey
+		}))
+	}
+
+	// The conflicting tcp port 1234 on ipv4 is only forwarded to its owner
+	expected := []Forward{
+		{Pubkey: "aaaa", Protocol: "tcp", Port: 1234, Destination: "10.99.0.1", ToPort: 80},
+		{Pubkey: "bbbb", Protocol: "tcp", Port: 1234, Destination: "fc00:bbbb:bbbb:bb01::2", ToPort: 1234},
+		{Pubkey: "bbbb", Protocol: "udp", Port: 1234, Destination: "10.99.0.2", ToPort: 1234},
+		{Pubkey: "bbbb", Protocol: "udp", Port: 1234, Destination: "fc00:bbbb:bbbb:bb01::2", ToPort: 1234},
+		{Pubkey: "aaaa", Protocol: "tcp", Port: 5678, Destination: "10.99.0.1", ToPort: 5678},
+		{Pubkey: "bbbb", Protocol: "udp", Port: 5678, Destination: "10.99.0.2", ToPort: 5678},
+		{Pubkey: "bbbb", Protocol: "udp", Port: 5678, Destination: "fc00:bbbb:bbbb:bb01::2", ToPort: 5678},
+	}
+
+	if diff := cmp.Diff(expected, p.Forwards()); diff != "" {
+		t.Errorf("unexpected forwards (-want +got):\n%s", diff)
+	}
+
+	p.setForwards("bbbb", nil)
+	if forwards := p.Forwards(); len(forwards) != 2 {
+		t.Errorf("got %d forwards after removing a peer, expected 2", len(forwards))
+	}
+}
+
+func TestForwardsOnlyAfterApplying(t *testing.T) {
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "aaaa"}
+
+	b.err = errors.New("failed")
+	if p.AddPortforwarding(peer) == nil {
+		t.Fatal("expected an error when the rules can't be added")
+	}
+
+	if forwards := p.Forwards(); len(forwards) != 0 {
+		t.Errorf("got %d forwards for rules that weren't added, expected 0", len(forwards))
+	}
+
+	if p.UpdatePortforwarding(api.WireguardPeerList{peer}) == nil {
+		t.Fatal("expected an error when the rules can't be updated")
+	}
+
+	if forwards := p.Forwards(); len(forwards) != 0 {
+		t.Errorf("got %d forwards for rules that weren't updated, expected 0", len(forwards))
+	}
+
+	b.err = nil
+	err := p.AddPortforwarding(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.err = errors.New("failed")
+	if p.RemovePortforwarding(peer) == nil {
+		t.Fatal("expected an error when the rules can't be removed")
+	}
+
+	if forwards := p.Forwards(); len(forwards) != 1 {
+		t.Errorf("got %d forwards for rules that weren't removed, expected 1", len(forwards))
+	}
+}
+
+func TestStaleRulesErrors(t *testing.T) {
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "aaaa"}
+
+	err := p.AddPortforwarding(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new rules are added, but the error of removing the old ones isn't lost
+	b.removeErr = errors.New("failed")
+	peer.Ports = []api.Port{{External: 4321, Protocol: "tcp"}}
+	if p.AddPortforwarding(peer) == nil {
+		t.Error("expected an error when the stale rules can't be removed")
+	}
+
+	if diff := cmp.Diff([]Forward{{Pubkey: "aaaa", Protocol: "tcp", Port: 4321, Destination: "10.99.0.1", ToPort: 4321}}, p.Forwards()); diff != "" {
+		t.Errorf("unexpected forwards (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddPortforwardingRollback(t *testing.T) {
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+	other := api.WireguardPeer{IPv4: "10.99.0.2/32", Ports: []api.Port{{External: 5678}}, Pubkey: "bbbb"}
+	if err := p.AddPortforwarding(other); err != nil {
+		t.Fatal(err)
+	}
+
+	before := make(map[rule]struct{})
+	for r := range b.rules {
+		before[r] = struct{}{}
+	}
+
+	// One rule of a new peer fails, so the ones that were added for it are removed, and the rules of other peers are left alone
+	b.failRule = func(r rule) bool {
+		return r.protocol == "udp" && r.destination == "10.99.0.1"
+	}
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234}, {External: 4321}}, Pubkey: "aaaa"}
+	if p.AddPortforwarding(peer) == nil {
+		t.Fatal("expected an error when a rule can't be added")
+	}
+
+	if diff := cmp.Diff(before, b.rules, cmp.AllowUnexported(rule{})); diff != "" {
+		t.Errorf("unexpected rules (-want +got):\n%s", diff)
+	}
+
+	if _, ok := p.peer("aaaa"); ok {
+		t.Error("a new peer that failed was kept")
+	}
+
+	// An existing peer that fails is kept, along with its tunnel
+	b.failRule = nil
+	if err := p.AddPortforwarding(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	b.failRule = func(r rule) bool {
+		return strings.Contains(r.ports, "8080")
+	}
+	changed := peer
+	changed.Ports = append(changed.Ports, api.Port{External: 8080})
+	if p.AddPortforwarding(changed) == nil {
+		t.Fatal("expected an error when a rule can't be added")
+	}
+
+	if _, ok := p.peer("aaaa"); !ok {
+		t.Error("an existing peer that failed was left out")
+	}
+}
@@ -0,0 +1,726 @@
+package portforward
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/digineo/go-ipset/v2"
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// iptablesBackend manages portforwarding rules with iptables and ip6tables
+type iptablesBackend struct {
+	iptables     *iptables.IPTables
+	ip6tables    *iptables.IPTables
+	chain        string
+	filterChain  string
+	hairpinChain string
+	noRestore    bool
+}
+
+// iptablesChain is a chain we manage rules in, along with the built-in chain that jumps to it when scaffolding
+type iptablesChain struct {
+	table string
+	name  string
+	from  string
+}
+
+func newIPTablesBackend(cfg Config) (*iptablesBackend, error) {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &iptablesBackend{
+		iptables:     ipt,
+		ip6tables:    ip6t,
+		chain:        cfg.Chain,
+		filterChain:  cfg.FilterChain,
+		hairpinChain: cfg.HairpinChain,
+		noRestore:    cfg.NoRestore,
+	}
+
+	// Everything is created when scaffolding, so there's nothing to validate
+	if cfg.Create {
+		return b, nil
+	}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		for _, c := range b.chains() {
+			exists, err := chainExists(c.table, c.name, b.ipt(protocol))
+			if err != nil {
+				return nil, err
+			}
+
+			if !exists {
+				return nil, fmt.Errorf("an iptables chain named %s does not exist in the %s table", c.name, c.table)
+			}
+		}
+	}
+
+	for _, exit := range cfg.allExits() {
+		err = validateIPSet(exit.IPSetIPv4)
+		if err != nil {
+			return nil, err
+		}
+
+		err = validateIPSet(exit.IPSetIPv6)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// chains returns the chains we manage rules in
+func (b *iptablesBackend) chains() []iptablesChain {
+	chains := []iptablesChain{b.chainFor(rule{})}
+	if b.filterChain != "" {
+		chains = append(chains, b.chainFor(rule{accept: true}))
+	}
+	if b.hairpinChain != "" {
+		chains = append(chains, b.chainFor(rule{hairpin: true}))
+	}
+
+	return chains
+}
+
+// chainFor returns the chain a rule belongs in
+func (b *iptablesBackend) chainFor(r rule) iptablesChain {
+	switch {
+	case r.accept:
+		return iptablesChain{table: filterTable, name: b.filterChain, from: "FORWARD"}
+	case r.hairpin:
+		return iptablesChain{table: table, name: b.hairpinChain, from: "POSTROUTING"}
+	default:
+		return iptablesChain{table: table, name: b.chain, from: "PREROUTING"}
+	}
+}
+
+func chainExists(table string, chain string, ipt *iptables.IPTables) (bool, error) {
+	chains, err := ipt.ListChains(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range chains {
+		if c == chain {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func validateIPSet(name string) error {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	exists, err := ipsetExists(conn, name)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("an ipset named %s does not exist", name)
+	}
+
+	return nil
+}
+
+func ipsetExists(conn *ipset.Conn, name string) (bool, error) {
+	ipsets, err := conn.ListAll()
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range ipsets {
+		if p.Name.Get() == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// scaffold creates the chains and the jumps to them from PREROUTING and FORWARD in both iptables and ip6tables, and the hash:ip ipsets of the exits
+func (b *iptablesBackend) scaffold(exits []Exit) error {
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := b.ipt(protocol)
+
+		for _, c := range b.chains() {
+			exists, err := chainExists(c.table, c.name, ipt)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				err = ipt.NewChain(c.table, c.name)
+				if err != nil {
+					return fmt.Errorf("error creating iptables chain %s: %s", c.name, err.Error())
+				}
+			}
+
+			exists, err = ipt.Exists(c.table, c.from, "-j", c.name)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				err = ipt.Insert(c.table, c.from, 1, "-j", c.name)
+				if err != nil {
+					return fmt.Errorf("error adding iptables jump rule to %s: %s", c.name, err.Error())
+				}
+			}
+		}
+	}
+
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, exit := range exits {
+		ipv4, ipv6 := exit.addresses()
+
+		err = scaffoldIPSet(conn, exit.IPSetIPv4, netfilter.ProtoIPv4, ipv4)
+		if err != nil {
+			return err
+		}
+
+		err = scaffoldIPSet(conn, exit.IPSetIPv6, netfilter.ProtoIPv6, ipv6)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scaffoldIPSet creates a hash:ip ipset if it doesn't exist, and adds the addresses it's missing
+// Addresses already in the set are left alone, so that addresses added by someone else are kept
+func scaffoldIPSet(conn *ipset.Conn, name string, family netfilter.ProtoFamily, addresses []net.IP) error {
+	exists, err := ipsetExists(conn, name)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		// Use the latest revision supported by the kernel, like the ipset command does
+		t, err := conn.Type("hash:ip", family)
+		if err != nil {
+			return fmt.Errorf("error creating ipset %s: %s", name, err.Error())
+		}
+
+		err = conn.Create(name, "hash:ip", t.Revision.Get(), family)
+		if err != nil {
+			return fmt.Errorf("error creating ipset %s: %s", name, err.Error())
+		}
+	}
+
+	for _, address := range addresses {
+		// Adding an address that's already in the set is an error
+		if conn.Test(name, ipset.EntryIP(address)) == nil {
+			continue
+		}
+
+		err = conn.Add(name, ipset.NewEntry(ipset.EntryIP(address)))
+		if err != nil {
+			return fmt.Errorf("error adding %s to ipset %s: %s", address, name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// update computes the changes needed to make the chain match the given rules
+// The changes are applied in a single iptables-restore transaction per protocol and table, falling back to applying them one rule at a time if that fails
+// Each table is committed on its own, so that a failed table never makes the changes of a committed one get applied twice
+func (b *iptablesBackend) update(rules map[rule]struct{}) ([]rule, error) {
+	currentRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, fmt.Errorf("error getting current iptables rules %s", err.Error())
+	}
+
+	changes := map[iptables.Protocol]*ruleChanges{
+		iptables.ProtocolIPv4: {},
+		iptables.ProtocolIPv6: {},
+	}
+
+	// Add new portforwarding rules
+	for r := range rules {
+		if _, ok := currentRules[r]; !ok {
+			protocol := r.iptablesProtocol()
+			changes[protocol].add = append(changes[protocol].add, b.change(r, r.iptablesSpec()))
+		}
+	}
+
+	// Remove old portforwarding rules, using the rule as it was listed, since that's what iptables will match against
+	for r, spec := range currentRules {
+		if _, ok := rules[r]; !ok {
+			protocol := r.iptablesProtocol()
+			changes[protocol].remove = append(changes[protocol].remove, b.change(r, spec))
+		}
+	}
+
+	var removed []rule
+	var lastErr error
+	for protocol, changes := range changes {
+		for _, t := range []string{table, filterTable} {
+			c := changes.forTable(t)
+			if c.empty() {
+				continue
+			}
+
+			if !b.noRestore {
+				err := b.restore(protocol, t, c)
+				if err == nil {
+					for _, change := range c.remove {
+						removed = append(removed, change.rule)
+					}
+					continue
+				}
+
+				log.Printf("error applying iptables rules atomically, falling back to applying them one by one: %s", err.Error())
+			}
+
+			removedRules, err := b.applyRuleByRule(protocol, c)
+			removed = append(removed, removedRules...)
+			if err != nil {
+				lastErr = err
+			}
+		}
+	}
+
+	return removed, lastErr
+}
+
+// ruleChanges are the rules to add and remove for one protocol, or one table of it
+type ruleChanges struct {
+	add    []ruleChange
+	remove []ruleChange
+}
+
+// ruleChange is a rule spec along with the chain it's added to or removed from
+type ruleChange struct {
+	rule  rule
+	chain iptablesChain
+	spec  string
+}
+
+func (b *iptablesBackend) change(r rule, spec string) ruleChange {
+	return ruleChange{
+		rule:  r,
+		chain: b.chainFor(r),
+		spec:  spec,
+	}
+}
+
+func (c *ruleChanges) empty() bool {
+	return len(c.add) == 0 && len(c.remove) == 0
+}
+
+// forTable returns the changes to the chains in the given table
+func (c *ruleChanges) forTable(t string) *ruleChanges {
+	tc := &ruleChanges{}
+	for _, change := range c.add {
+		if change.chain.table == t {
+			tc.add = append(tc.add, change)
+		}
+	}
+
+	for _, change := range c.remove {
+		if change.chain.table == t {
+			tc.remove = append(tc.remove, change)
+		}
+	}
+
+	return tc
+}
+
+// restore applies the changes to one table in a single iptables-restore invocation, so that its chains are never left half updated
+// Using --noflush leaves everything but the changed rules alone
+func (b *iptablesBackend) restore(protocol iptables.Protocol, t string, c *ruleChanges) error {
+	command := "iptables-restore"
+	if protocol == iptables.ProtocolIPv6 {
+		command = "ip6tables-restore"
+	}
+
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", t)
+	for _, change := range c.remove {
+		fmt.Fprintf(&input, "-D %s %s\n", change.chain.name, change.spec)
+	}
+	for _, change := range c.add {
+		fmt.Fprintf(&input, "-A %s %s\n", change.chain.name, change.spec)
+	}
+	input.WriteString("COMMIT\n")
+
+	cmd := exec.Command(command, "--noflush")
+	cmd.Stdin = &input
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %s", command, err.Error(), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// applyRuleByRule applies the changes with one iptables invocation per rule, attempting every rule even if one fails
+// It returns the rules that were removed
+func (b *iptablesBackend) applyRuleByRule(protocol iptables.Protocol, c *ruleChanges) ([]rule, error) {
+	var removed []rule
+	var lastErr error
+
+	for _, change := range c.add {
+		err := b.ipt(protocol).Append(change.chain.table, change.chain.name, splitIPTablesRule(change.spec)...)
+		if err != nil {
+			lastErr = fmt.Errorf("error adding iptables rule: %s", err.Error())
+			log.Print(lastErr)
+			continue
+		}
+	}
+
+	for _, change := range c.remove {
+		err := b.ipt(protocol).Delete(change.chain.table, change.chain.name, splitIPTablesRule(change.spec)...)
+		if err != nil {
+			lastErr = fmt.Errorf("error deleting iptables rule: %s", err.Error())
+			log.Print(lastErr)
+			continue
+		}
+
+		removed = append(removed, change.rule)
+	}
+
+	return removed, lastErr
+}
+
+func (b *iptablesBackend) add(rules map[rule]struct{}) ([]rule, int, error) {
+	currentRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting current iptables rules %s", err.Error())
+	}
+
+	var added []rule
+	var lastErr error
+	existing := 0
+
+	for r := range rules {
+		// Adding the same peer twice would otherwise duplicate its rules
+		if _, ok := currentRules[r]; ok {
+			existing++
+			continue
+		}
+
+		c := b.chainFor(r)
+		err := b.ipt(r.iptablesProtocol()).Append(c.table, c.name, splitIPTablesRule(r.iptablesSpec())...)
+		if err != nil {
+			lastErr = fmt.Errorf("error adding iptables rule: %s", err.Error())
+			log.Print(lastErr)
+			continue
+		}
+
+		added = append(added, r)
+	}
+
+	return added, existing, lastErr
+}
+
+// remove looks up the given rules in the chains and deletes them
+func (b *iptablesBackend) remove(rules map[rule]struct{}) ([]rule, error) {
+	currentRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, fmt.Errorf("error getting current iptables rules %s", err.Error())
+	}
+
+	var removed []rule
+	var lastErr error
+
+	for r := range rules {
+		spec, ok := currentRules[r]
+		if !ok {
+			lastErr = fmt.Errorf("error deleting iptables rule: %s does not exist", r.iptablesSpec())
+			log.Print(lastErr)
+			continue
+		}
+
+		c := b.chainFor(r)
+		err := b.ipt(r.iptablesProtocol()).Delete(c.table, c.name, splitIPTablesRule(spec)...)
+		if err != nil {
+			lastErr = fmt.Errorf("error deleting iptables rule: %s", err.Error())
+			log.Print(lastErr)
+			continue
+		}
+
+		removed = append(removed, r)
+	}
+
+	return removed, lastErr
+}
+
+// counters lists the portforwarding chain with counters, which iptables adds to every rule as -c <packets> <bytes>
+func (b *iptablesBackend) counters() (map[rule]ruleCounters, error) {
+	counters := make(map[rule]ruleCounters)
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		listed, err := b.ipt(protocol).ListWithCounters(table, b.chain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range listed {
+			line, c, ok := splitIPTablesCounters(line)
+			if !ok {
+				continue
+			}
+
+			r, ok := parseIPTablesRule(b.chain, protocol == iptables.ProtocolIPv6, line)
+			if !ok || !r.forward() {
+				continue
+			}
+
+			counters[r] = c
+		}
+	}
+
+	return counters, nil
+}
+
+var iptablesCountersPattern = regexp.MustCompile(` -c (\d+) (\d+)`)
+
+// splitIPTablesCounters removes the counters from a rule listed with them, returning false if it has none
+func splitIPTablesCounters(line string) (string, ruleCounters, bool) {
+	match := iptablesCountersPattern.FindStringSubmatchIndex(line)
+	if match == nil {
+		return line, ruleCounters{}, false
+	}
+
+	packets, err := strconv.ParseUint(line[match[2]:match[3]], 10, 64)
+	if err != nil {
+		return line, ruleCounters{}, false
+	}
+
+	bytes, err := strconv.ParseUint(line[match[4]:match[5]], 10, 64)
+	if err != nil {
+		return line, ruleCounters{}, false
+	}
+
+	return line[:match[0]] + line[match[1]:], ruleCounters{packets: packets, bytes: bytes}, true
+}
+
+func (b *iptablesBackend) ipt(protocol iptables.Protocol) *iptables.IPTables {
+	if protocol == iptables.ProtocolIPv6 {
+		return b.ip6tables
+	}
+
+	return b.iptables
+}
+
+// Comment marking the rules we manage, so that other rules in the chain are left alone
+// It's made up of characters iptables doesn't quote, so that it's listed the same way it's added
+const iptablesComment = "wg-manager"
+
+// iptablesSpec renders the rule the same way iptables lists it, without the chain
+func (r rule) iptablesSpec() string {
+	if r.hairpin {
+		return fmt.Sprintf("-s %s -d %s -p %s -m multiport --dports %s -m conntrack --ctstate DNAT -m comment --comment %s -j MASQUERADE", r.destination, r.destination, r.protocol, r.ports, iptablesComment)
+	}
+
+	if r.accept {
+		return fmt.Sprintf("-d %s -p %s -m multiport --dports %s -m comment --comment %s -j ACCEPT", r.destination, r.protocol, r.ports, iptablesComment)
+	}
+
+	return fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -m comment --comment %s -j DNAT --to-destination %s", r.protocol, r.ipset, r.ports, iptablesComment, r.target())
+}
+
+func (r rule) iptablesProtocol() iptables.Protocol {
+	if r.ipv6 {
+		return iptables.ProtocolIPv6
+	}
+
+	return iptables.ProtocolIPv4
+}
+
+// getCurrentRules returns the rules we manage in the chains, mapped to their spec as listed by iptables
+func (b *iptablesBackend) getCurrentRules() (map[rule]string, error) {
+	rules := make(map[rule]string)
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		for _, c := range b.chains() {
+			listed, err := b.ipt(protocol).List(c.table, c.name)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, line := range listed {
+				r, ok := parseIPTablesRule(c.name, protocol == iptables.ProtocolIPv6, line)
+				if !ok || b.chainFor(r) != c {
+					continue
+				}
+
+				rules[r] = strings.TrimPrefix(line, fmt.Sprintf("-A %s ", c.name))
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// parseIPTablesRule parses a rule in the given chain, in the format listed by iptables -S and iptables-save
+// It returns false for anything that isn't a portforwarding, accept or hairpin rule managed by us, such as the chain definition or rules added by someone else
+// Rules without a comment are considered ours if they're in the exact format used before the comment was introduced, so that they're cleaned up
+func parseIPTablesRule(chain string, ipv6 bool, line string) (rule, bool) {
+	tokens := splitIPTablesRule(line)
+	if len(tokens) < 2 || tokens[0] != "-A" || tokens[1] != chain {
+		return rule{}, false
+	}
+
+	r := rule{ipv6: ipv6}
+	var ports, target, comment, source, state string
+	var hasComment, unknown bool
+
+	for i := 2; i < len(tokens); i++ {
+		option := tokens[i]
+
+		// All options we care about take a value
+		if i+1 >= len(tokens) {
+			unknown = true
+			break
+		}
+		i++
+		value := tokens[i]
+
+		switch option {
+		case "-p":
+			r.protocol = value
+		case "-s":
+			source = value
+		case "-d":
+			r.destination = value
+		case "--ctstate":
+			state = value
+		case "-m":
+			switch value {
+			case "set", "multiport", "comment", "tcp", "udp", "conntrack":
+			default:
+				unknown = true
+			}
+		case "--match-set":
+			r.ipset = value
+
+			// The direction follows the set name
+			if i+1 >= len(tokens) || tokens[i+1] != "dst" {
+				unknown = true
+				continue
+			}
+			i++
+		case "--dports", "--dport":
+			ports = value
+		case "--comment":
+			hasComment = true
+			comment = value
+		case "-j":
+			target = value
+		case "--to-destination":
+			r.destination = value
+		default:
+			unknown = true
+		}
+	}
+
+	if (hasComment && comment != iptablesComment) || (!hasComment && unknown) {
+		return rule{}, false
+	}
+
+	switch {
+	case r.protocol != "tcp" && r.protocol != "udp":
+		return rule{}, false
+	case target == "DNAT" && r.ipset != "" && source == "" && state == "":
+	case target == "ACCEPT" && hasComment && r.ipset == "" && source == "" && state == "":
+		// Accept rules were introduced after the comment, so they always have one
+		r.accept = true
+	case target == "MASQUERADE" && hasComment && r.ipset == "" && source == r.destination && state == "DNAT":
+		r.hairpin = true
+	default:
+		return rule{}, false
+	}
+
+	// Normalize the ports and address, in case iptables lists them differently from how they were added
+	var portList []int
+	for _, port := range strings.Split(ports, ",") {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return rule{}, false
+		}
+
+		portList = append(portList, p)
+	}
+	r.ports = getPortsString(portList)
+
+	var ok bool
+	r.destination, r.toPort, ok = parseTarget(strings.TrimSuffix(strings.TrimSuffix(r.destination, "/32"), "/128"))
+	if !ok {
+		return rule{}, false
+	}
+
+	// Ports were never mapped before the comment was introduced, and accept and hairpin rules match the destination without a port
+	if (!hasComment || !r.forward()) && r.toPort != 0 {
+		return rule{}, false
+	}
+
+	return r, true
+}
+
+// splitIPTablesRule splits a rule into arguments, removing the quotes iptables adds around values with special characters
+func splitIPTablesRule(line string) []string {
+	var args []string
+	var current strings.Builder
+	var inQuotes, inArg bool
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(line):
+			i++
+			current.WriteByte(line[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case c == ' ' && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
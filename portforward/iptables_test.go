@@ -0,0 +1,238 @@
+package portforward
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseIPTablesRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipv6     bool
+		line     string
+		expected rule
+		ok       bool
+	}{
+		{
+			name: "managed rule",
+			line: "-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1",
+			expected: rule{
+				protocol:    "tcp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "1234,4321",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "quoted comment",
+			line: `-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -m comment --comment "wg-manager" -j DNAT --to-destination 10.99.0.1`,
+			expected: rule{
+				protocol:    "udp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "1234",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "options in a different order",
+			line: "-A PORTFORWARDING -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager -m set --match-set PORTFORWARDING_IPV4 dst -j DNAT --to-destination 10.99.0.1",
+			expected: rule{
+				protocol:    "tcp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "1234,4321",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "unsorted ports and masked destination",
+			line: "-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 4321,1234 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1/32",
+			expected: rule{
+				protocol:    "tcp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "1234,4321",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "ipv6 rule",
+			ipv6: true,
+			line: "-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1/128",
+			expected: rule{
+				ipv6:        true,
+				protocol:    "udp",
+				ipset:       "PORTFORWARDING_IPV6",
+				ports:       "1234,4321",
+				destination: "fc00:bbbb:bbbb:bb01::1",
+			},
+			ok: true,
+		},
+		{
+			name: "mapped port",
+			line: "-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 51234 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1:8080",
+			expected: rule{
+				protocol:    "tcp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "51234",
+				destination: "10.99.0.1",
+				toPort:      8080,
+			},
+			ok: true,
+		},
+		{
+			name: "ipv6 mapped port",
+			ipv6: true,
+			line: "-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 51234 -m comment --comment wg-manager -j DNAT --to-destination [fc00:bbbb:bbbb:bb01::1]:8080",
+			expected: rule{
+				ipv6:        true,
+				protocol:    "udp",
+				ipset:       "PORTFORWARDING_IPV6",
+				ports:       "51234",
+				destination: "fc00:bbbb:bbbb:bb01::1",
+				toPort:      8080,
+			},
+			ok: true,
+		},
+		{
+			name: "accept rule",
+			line: "-A PORTFORWARDING -d 10.99.0.1/32 -p tcp -m multiport --dports 80,1234 -m comment --comment wg-manager -j ACCEPT",
+			expected: rule{
+				accept:      true,
+				protocol:    "tcp",
+				ports:       "80,1234",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "hairpin rule",
+			line: "-A PORTFORWARDING -s 10.99.0.1/32 -d 10.99.0.1/32 -p udp -m multiport --dports 80,1234 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+			expected: rule{
+				hairpin:     true,
+				protocol:    "udp",
+				ports:       "80,1234",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "masquerade rule for another source",
+			line: "-A PORTFORWARDING -s 10.99.0.2/32 -d 10.99.0.1/32 -p udp -m multiport --dports 80,1234 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+		},
+		{
+			name: "accept rule without comment",
+			line: "-A PORTFORWARDING -d 10.99.0.1/32 -p tcp -m multiport --dports 80,1234 -j ACCEPT",
+		},
+		{
+			name: "rule without comment in the legacy format",
+			line: "-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
+			expected: rule{
+				protocol:    "tcp",
+				ipset:       "PORTFORWARDING_IPV4",
+				ports:       "1234,4321",
+				destination: "10.99.0.1",
+			},
+			ok: true,
+		},
+		{
+			name: "chain definition",
+			line: "-N PORTFORWARDING",
+		},
+		{
+			name: "rule in another chain",
+			line: "-A PREROUTING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1",
+		},
+		{
+			name: "foreign rule without comment",
+			line: "-A PORTFORWARDING -d 192.0.2.1/32 -p tcp -m tcp --dport 22 -j DNAT --to-destination 10.0.0.1:22",
+		},
+		{
+			name: "foreign rule with another comment",
+			line: `-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -m comment --comment "added by hand" -j DNAT --to-destination 10.99.0.1`,
+		},
+		{
+			name: "foreign rule with another target",
+			line: "-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j ACCEPT",
+		},
+	}
+
+	for _, test := range tests {
+		r, ok := parseIPTablesRule("PORTFORWARDING", test.ipv6, test.line)
+		if ok != test.ok {
+			t.Errorf("%s: got %v, expected %v", test.name, ok, test.ok)
+			continue
+		}
+
+		if diff := cmp.Diff(test.expected, r, cmp.AllowUnexported(rule{})); diff != "" {
+			t.Errorf("%s: unexpected rule (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestIPTablesSpecRoundTrip(t *testing.T) {
+	rules := []rule{
+		{
+			protocol:    "tcp",
+			ipset:       "PORTFORWARDING_IPV4",
+			ports:       "1234,4321",
+			destination: "10.99.0.1",
+		},
+		{
+			ipv6:        true,
+			protocol:    "udp",
+			ipset:       "PORTFORWARDING_IPV6",
+			ports:       "51234",
+			destination: "fc00:bbbb:bbbb:bb01::1",
+			toPort:      8080,
+		},
+		{
+			ipv6:        true,
+			accept:      true,
+			protocol:    "tcp",
+			ports:       "80,1234",
+			destination: "fc00:bbbb:bbbb:bb01::1",
+		},
+		{
+			hairpin:     true,
+			protocol:    "udp",
+			ports:       "8080",
+			destination: "10.99.0.1",
+		},
+	}
+
+	for _, r := range rules {
+		parsed, ok := parseIPTablesRule("PORTFORWARDING", r.ipv6, "-A PORTFORWARDING "+r.iptablesSpec())
+		if !ok {
+			t.Fatalf("rendered rule %s not recognized as managed", r.iptablesSpec())
+		}
+
+		if diff := cmp.Diff(r, parsed, cmp.AllowUnexported(rule{})); diff != "" {
+			t.Fatalf("unexpected rule (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestSplitIPTablesCounters(t *testing.T) {
+	line, c, ok := splitIPTablesCounters(`-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -m comment --comment "wg-manager" -c 12 3456 -j DNAT --to-destination 10.99.0.1`)
+	if !ok {
+		t.Fatal("counters not found")
+	}
+
+	expected := `-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -m comment --comment "wg-manager" -j DNAT --to-destination 10.99.0.1`
+	if line != expected {
+		t.Errorf("got line %s, expected %s", line, expected)
+	}
+
+	if c != (ruleCounters{packets: 12, bytes: 3456}) {
+		t.Errorf("got counters %+v", c)
+	}
+
+	_, _, ok = splitIPTablesCounters("-N PORTFORWARDING")
+	if ok {
+		t.Error("found counters in a line without them")
+	}
+}
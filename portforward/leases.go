@@ -0,0 +1,52 @@
+package portforward
+
+import (
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// ExpireLeases removes the rules of ports whose leases ran out since the last update
+// This doesn't need the API, so leases are enforced even while it's unreachable
+func (p *Portforward) ExpireLeases(now time.Time) {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	if p.nextExpiry.IsZero() || now.Before(p.nextExpiry) {
+		return
+	}
+
+	p.update()
+}
+
+// withoutExpired returns the peers with the ports whose leases ran out left out, how many were left out, and when the next lease runs out
+// The next expiry is zero if none of the remaining ports have a lease
+func withoutExpired(peers api.WireguardPeerList, now time.Time) (api.WireguardPeerList, int, time.Time) {
+	var nextExpiry time.Time
+	expired := 0
+
+	result := make(api.WireguardPeerList, 0, len(peers))
+	for _, peer := range peers {
+		var ports []api.Port
+		for _, port := range peer.Ports {
+			if port.IsExpired(now) {
+				expired++
+				continue
+			}
+
+			if port.Expires != nil && (nextExpiry.IsZero() || port.Expires.Before(nextExpiry)) {
+				nextExpiry = *port.Expires
+			}
+
+			ports = append(ports, port)
+		}
+
+		if len(ports) != len(peer.Ports) {
+			peer.Ports = ports
+		}
+
+		result = append(result, peer)
+	}
+
+	return result, expired, nextExpiry
+}
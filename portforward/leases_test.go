@@ -0,0 +1,45 @@
+package portforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestWithoutExpired(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute)
+	soon := now.Add(time.Minute)
+	later := now.Add(time.Hour)
+
+	peers := api.WireguardPeerList{
+		{Pubkey: "aaaa", Ports: []api.Port{{External: 1234}, {External: 1235, Expires: &past}, {External: 1236, Expires: &later}}},
+		{Pubkey: "bbbb", Ports: []api.Port{{External: 4321, Expires: &soon}}},
+		{Pubkey: "cccc", Ports: []api.Port{{External: 5678, Expires: &now}}},
+	}
+
+	result, expired, nextExpiry := withoutExpired(peers, now)
+
+	expected := api.WireguardPeerList{
+		{Pubkey: "aaaa", Ports: []api.Port{{External: 1234}, {External: 1236, Expires: &later}}},
+		{Pubkey: "bbbb", Ports: []api.Port{{External: 4321, Expires: &soon}}},
+		{Pubkey: "cccc"},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if expired != 2 {
+		t.Errorf("got %d expired ports, expected 2", expired)
+	}
+
+	if !nextExpiry.Equal(soon) {
+		t.Errorf("got next expiry %s, expected %s", nextExpiry, soon)
+	}
+
+	if len(peers[0].Ports) != 3 {
+		t.Error("the given peers were modified")
+	}
+}
@@ -0,0 +1,177 @@
+package portforward
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// AddMapping forwards a port requested by a peer itself, on top of the ports assigned to it through the API
+// The mapping is kept across updates until it's removed, or the peer is no longer in the list of peers
+// Only the rules of the peer are changed, and if they can't be applied the mapping is dropped again
+func (p *Portforward) AddMapping(pubkey string, port api.Port) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	peer, ok := p.peer(pubkey)
+	if !ok {
+		return fmt.Errorf("unknown peer %s", pubkey)
+	}
+
+	for _, m := range p.mappings[pubkey] {
+		if m == port {
+			return nil
+		}
+	}
+
+	previous := p.withPeerMappings(peer)
+	if p.mappings == nil {
+		p.mappings = make(map[string][]api.Port)
+	}
+	p.mappings[pubkey] = append(p.mappings[pubkey], port)
+
+	err := p.applyPeer(p.withPeerMappings(peer), previous, true)
+	if err != nil {
+		current := p.withPeerMappings(peer)
+		p.dropMapping(pubkey, port)
+		p.applyPeer(previous, current, true)
+
+		return err
+	}
+
+	return nil
+}
+
+// RemoveMapping stops forwarding a port requested by a peer
+// Only the rules of the peer are changed
+func (p *Portforward) RemoveMapping(pubkey string, port api.Port) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	// The mappings of peers that are gone were dropped along with their rules
+	peer, ok := p.peer(pubkey)
+	if !ok {
+		return nil
+	}
+
+	previous := p.withPeerMappings(peer)
+	if !p.dropMapping(pubkey, port) {
+		return nil
+	}
+
+	return p.applyPeer(p.withPeerMappings(peer), previous, true)
+}
+
+// dropMapping removes a mapping of a peer, and returns whether it had it
+func (p *Portforward) dropMapping(pubkey string, port api.Port) bool {
+	var mappings []api.Port
+	for _, m := range p.mappings[pubkey] {
+		if m != port {
+			mappings = append(mappings, m)
+		}
+	}
+
+	if len(mappings) == len(p.mappings[pubkey]) {
+		return false
+	}
+
+	if len(mappings) == 0 {
+		delete(p.mappings, pubkey)
+	} else {
+		p.mappings[pubkey] = mappings
+	}
+
+	return true
+}
+
+// withMappings returns the peers with the ports they mapped themselves and the ports allocated to them added
+// The mappings of peers that are gone are dropped, while allocations are only reclaimed through ReclaimPorts
+func (p *Portforward) withMappings(peers api.WireguardPeerList) api.WireguardPeerList {
+	if len(p.mappings) == 0 && p.allocator == nil {
+		return peers
+	}
+
+	seen := make(map[string]struct{})
+	result := make(api.WireguardPeerList, 0, len(peers))
+	for _, peer := range peers {
+		seen[peer.Pubkey] = struct{}{}
+		result = append(result, p.withPeerMappings(peer))
+	}
+
+	for pubkey := range p.mappings {
+		if _, ok := seen[pubkey]; !ok {
+			delete(p.mappings, pubkey)
+		}
+	}
+
+	return result
+}
+
+// withPeerMappings returns the peer with the ports it mapped itself and the ports allocated to it added
+func (p *Portforward) withPeerMappings(peer api.WireguardPeer) api.WireguardPeer {
+	mappings := p.mappings[peer.Pubkey]
+	if p.allocator != nil {
+		mappings = append(p.allocator.ports(peer.Pubkey, peer.Exit), mappings...)
+	}
+
+	if len(mappings) == 0 {
+		return peer
+	}
+
+	ports := make([]api.Port, 0, len(peer.Ports)+len(mappings))
+	ports = append(ports, peer.Ports...)
+	peer.Ports = append(ports, mappings...)
+
+	return peer
+}
+
+// peer returns the peer with the given public key from the last applied list of peers
+func (p *Portforward) peer(pubkey string) (api.WireguardPeer, bool) {
+	for _, peer := range p.peers {
+		if peer.Pubkey == pubkey {
+			return peer, true
+		}
+	}
+
+	return api.WireguardPeer{}, false
+}
+
+// forgetPeer removes a peer from the last applied list of peers, keeping its mappings and pool ports
+func (p *Portforward) forgetPeer(pubkey string) {
+	peers := make(api.WireguardPeerList, 0, len(p.peers))
+	for _, existing := range p.peers {
+		if existing.Pubkey != pubkey {
+			peers = append(peers, existing)
+		}
+	}
+
+	p.peers = peers
+}
+
+// setPeer adds or replaces a peer in the last applied list of peers
+func (p *Portforward) setPeer(peer api.WireguardPeer) {
+	peers := make(api.WireguardPeerList, 0, len(p.peers)+1)
+	for _, existing := range p.peers {
+		if existing.Pubkey != peer.Pubkey {
+			peers = append(peers, existing)
+		}
+	}
+
+	p.peers = append(peers, peer)
+}
+
+// removePeer removes a peer from the last applied list of peers, along with its mappings and pool ports
+func (p *Portforward) removePeer(pubkey string) {
+	p.forgetPeer(pubkey)
+	delete(p.mappings, pubkey)
+
+	if p.allocator != nil {
+		released, err := p.allocator.release(pubkey, 0)
+		if err != nil {
+			log.Printf("error releasing the port pool allocations of peer %s %s", pubkey, err.Error())
+		}
+
+		p.metrics.Count("portforwarding_pool_reclaimed", released)
+	}
+}
@@ -0,0 +1,80 @@
+package portforward
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestWithMappings(t *testing.T) {
+	p := &Portforward{
+		mappings: map[string][]api.Port{
+			"aaaa": {{External: 50000, Internal: 8080, Protocol: "tcp"}},
+			"gone": {{External: 50001, Internal: 8080, Protocol: "tcp"}},
+		},
+	}
+
+	peers := api.WireguardPeerList{
+		{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234}}, Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", Pubkey: "bbbb"},
+	}
+
+	expected := api.WireguardPeerList{
+		{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234}, {External: 50000, Internal: 8080, Protocol: "tcp"}}, Pubkey: "aaaa"},
+		{IPv4: "10.99.0.2/32", Pubkey: "bbbb"},
+	}
+
+	if diff := cmp.Diff(expected, p.withMappings(peers)); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if len(peers[0].Ports) != 1 {
+		t.Error("the given peers were modified")
+	}
+
+	if _, ok := p.mappings["gone"]; ok {
+		t.Error("mappings of a peer that's gone were kept")
+	}
+}
+
+func TestMappingsAreIncremental(t *testing.T) {
+	p, b := newFakePortforward(t, ConflictPolicyPickOwner)
+
+	peer := api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []api.Port{{External: 1234, Protocol: "tcp"}}, Pubkey: "aaaa"}
+	if err := p.UpdatePortforwarding(api.WireguardPeerList{peer}); err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := api.Port{External: 50000, Internal: 8080, Protocol: "tcp"}
+	if err := p.AddMapping("aaaa", mapping); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[rule]struct{}{
+		{protocol: "tcp", ports: "1234", destination: "10.99.0.1"}:                {},
+		{protocol: "tcp", ports: "50000", destination: "10.99.0.1", toPort: 8080}: {},
+	}
+	if diff := cmp.Diff(expected, b.rules, cmp.AllowUnexported(rule{})); diff != "" {
+		t.Errorf("unexpected rules after adding the mapping (-want +got):\n%s", diff)
+	}
+
+	if err := p.RemoveMapping("aaaa", mapping); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = map[rule]struct{}{
+		{protocol: "tcp", ports: "1234", destination: "10.99.0.1"}: {},
+	}
+	if diff := cmp.Diff(expected, b.rules, cmp.AllowUnexported(rule{})); diff != "" {
+		t.Errorf("unexpected rules after removing the mapping (-want +got):\n%s", diff)
+	}
+
+	if b.updateCalls != 1 {
+		t.Errorf("all rules were updated %d times, expected only on the synchronization", b.updateCalls)
+	}
+
+	if err := p.AddMapping("unknown", mapping); err == nil {
+		t.Error("expected an error mapping a port for an unknown peer")
+	}
+}
@@ -0,0 +1,1201 @@
+package portforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftablesBackend manages portforwarding rules natively with nftables
+// The rules live in a chain in the ip and ip6 nat tables, and optionally the filter tables, and are told apart from other rules in the chains by their user data
+// The forwarded ports are kept in maps from the port to the destination address and port, so that there's a single rule per set of relay addresses and protocol,
+// looking up where to forward to, rather than a rule per peer
+type nftablesBackend struct {
+	conn *nftables.Conn
+	ipv4 nftablesFamily
+	ipv6 nftablesFamily
+}
+
+// nftablesFamily is the tables and chains for one address family
+type nftablesFamily struct {
+	table *nftables.Table
+	chain *nftables.Chain
+	// filterChain is nil if accept rules aren't managed
+	filterChain *nftables.Chain
+	// hairpinChain is nil if hairpin rules aren't managed
+	hairpinChain *nftables.Chain
+	// sets are the sets of relay addresses of the exits, each with its own maps
+	sets []string
+}
+
+// nftablesMap identifies the maps of the ports forwarded for one protocol on one set of relay addresses, and the rule looking ports up in them
+type nftablesMap struct {
+	ipv6     bool
+	ipset    string
+	protocol string
+}
+
+// nftablesMapSets are the maps of the destination addresses and ports, keyed by the forwarded port
+// They're always changed together, so a port is either in both or in neither
+type nftablesMapSets struct {
+	addresses *nftables.Set
+	ports     *nftables.Set
+}
+
+// nftablesElement is a forwarded port in the maps
+type nftablesElement struct {
+	nftablesMap
+	port int
+}
+
+// nftablesTarget is what a port is forwarded to, the destination or toPort is empty if the port is missing from that map
+type nftablesTarget struct {
+	destination string
+	toPort      int
+}
+
+// Prefix of the user data of the rules we manage
+const nftablesUserDataPrefix = "wg-manager:"
+
+// User data of the rule jumping to the chain, added when scaffolding
+const nftablesJumpUserData = nftablesUserDataPrefix + " jump"
+
+// Prefix of the user data of the rules looking the forwarded ports up in the maps
+const nftablesMapUserDataPrefix = nftablesUserDataPrefix + " map"
+
+// The conntrack status bit of connections that were destination NATed, IPS_DST_NAT in linux/netfilter/nf_conntrack_common.h
+const nftablesCtStatusDNAT = 1 << 5
+
+// Names of the base chains created when scaffolding, if the tables have no nat prerouting, filter forward or nat postrouting chain to add the jumps to
+const (
+	nftablesPreroutingChain  = "prerouting"
+	nftablesForwardChain     = "forward"
+	nftablesPostroutingChain = "postrouting"
+)
+
+func newNFTablesBackend(cfg Config) (*nftablesBackend, error) {
+	conn := &nftables.Conn{}
+
+	var ipv4Sets, ipv6Sets []string
+	for _, exit := range cfg.allExits() {
+		ipv4Sets = append(ipv4Sets, exit.IPSetIPv4)
+		ipv6Sets = append(ipv6Sets, exit.IPSetIPv6)
+	}
+
+	ipv4, err := newNFTablesFamily(conn, nftables.TableFamilyIPv4, cfg, ipv4Sets)
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6, err := newNFTablesFamily(conn, nftables.TableFamilyIPv6, cfg, ipv6Sets)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nftablesBackend{
+		conn: conn,
+		ipv4: ipv4,
+		ipv6: ipv6,
+	}, nil
+}
+
+// newNFTablesFamily validates that the chains and sets exist, unless they'll be created when scaffolding
+func newNFTablesFamily(conn *nftables.Conn, family nftables.TableFamily, cfg Config, sets []string) (nftablesFamily, error) {
+	t := &nftables.Table{
+		Name:   table,
+		Family: family,
+	}
+
+	f := nftablesFamily{
+		table: t,
+		chain: &nftables.Chain{
+			Name:  cfg.Chain,
+			Table: t,
+		},
+	}
+
+	seen := make(map[string]bool)
+	for _, set := range sets {
+		if !seen[set] {
+			seen[set] = true
+			f.sets = append(f.sets, set)
+		}
+	}
+
+	if cfg.FilterChain != "" {
+		f.filterChain = &nftables.Chain{
+			Name: cfg.FilterChain,
+			Table: &nftables.Table{
+				Name:   filterTable,
+				Family: family,
+			},
+		}
+	}
+
+	if cfg.HairpinChain != "" {
+		f.hairpinChain = &nftables.Chain{
+			Name:  cfg.HairpinChain,
+			Table: t,
+		}
+	}
+
+	if cfg.Create {
+		return f, nil
+	}
+
+	for _, chain := range f.chains() {
+		c, err := findNFTablesChain(conn, chain.Table, func(c *nftables.Chain) bool {
+			return c.Name == chain.Name
+		})
+		if err != nil {
+			return nftablesFamily{}, err
+		}
+
+		if c == nil {
+			return nftablesFamily{}, fmt.Errorf("an nftables chain named %s does not exist in the %s table", chain.Name, nftablesTableName(chain.Table))
+		}
+	}
+
+	for _, set := range sets {
+		_, err := conn.GetSetByName(t, set)
+		if err != nil {
+			return nftablesFamily{}, fmt.Errorf("an nftables set named %s does not exist in the %s table", set, nftablesTableName(t))
+		}
+	}
+
+	return f, nil
+}
+
+// chains returns the chains we manage rules in
+func (f nftablesFamily) chains() []*nftables.Chain {
+	chains := []*nftables.Chain{f.chain}
+	if f.filterChain != nil {
+		chains = append(chains, f.filterChain)
+	}
+	if f.hairpinChain != nil {
+		chains = append(chains, f.hairpinChain)
+	}
+
+	return chains
+}
+
+// chainFor returns the chain a rule belongs in, or nil if rules of its kind aren't managed
+func (f nftablesFamily) chainFor(r rule) *nftables.Chain {
+	switch {
+	case r.accept:
+		return f.filterChain
+	case r.hairpin:
+		return f.hairpinChain
+	default:
+		return f.chain
+	}
+}
+
+// findNFTablesChain returns the first chain in the table matching the given function, or nil if there is none
+func findNFTablesChain(conn *nftables.Conn, t *nftables.Table, match func(*nftables.Chain) bool) (*nftables.Chain, error) {
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range chains {
+		if c.Table.Name == t.Name && c.Table.Family == t.Family && match(c) {
+			return c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func nftablesTableName(t *nftables.Table) string {
+	if t.Family == nftables.TableFamilyIPv6 {
+		return "ip6 " + t.Name
+	}
+
+	return "ip " + t.Name
+}
+
+// scaffold creates the table, chain and the sets of the exits in both families, and jumps to the chain from a nat prerouting chain
+// Existing objects are left alone, and everything is created in a single transaction
+func (b *nftablesBackend) scaffold(exits []Exit) error {
+	ipv4 := make(map[string][]nftables.SetElement)
+	ipv6 := make(map[string][]nftables.SetElement)
+	for _, exit := range exits {
+		ipv4Addresses, ipv6Addresses := exit.addresses()
+
+		ipv4[exit.IPSetIPv4] = append(ipv4[exit.IPSetIPv4], nftablesSetElements(ipv4Addresses)...)
+		ipv6[exit.IPSetIPv6] = append(ipv6[exit.IPSetIPv6], nftablesSetElements(ipv6Addresses)...)
+	}
+
+	var lastErr error
+
+	err := b.scaffoldFamily(b.ipv4, nftables.TypeIPAddr, ipv4)
+	if err != nil {
+		lastErr = err
+	}
+
+	err = b.scaffoldFamily(b.ipv6, nftables.TypeIP6Addr, ipv6)
+	if err != nil {
+		lastErr = err
+	}
+
+	// Flush even if a family failed, so that nothing is left queued for the next transaction
+	err = b.flush()
+	if err != nil {
+		return err
+	}
+
+	return lastErr
+}
+
+// nftablesSetElements converts addresses to set elements, using the 4 byte form for ipv4 addresses
+func nftablesSetElements(addresses []net.IP) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, address := range addresses {
+		key := address.To4()
+		if key == nil {
+			key = address.To16()
+		}
+
+		elements = append(elements, nftables.SetElement{Key: key})
+	}
+
+	return elements
+}
+
+// scaffoldFamily queues the scaffolding for one family to be created on the next flush
+func (b *nftablesBackend) scaffoldFamily(f nftablesFamily, keyType nftables.SetDatatype, sets map[string][]nftables.SetElement) error {
+	// Adding objects that already exist is a no-op, as long as they're compatible
+	b.conn.AddTable(f.table)
+	b.conn.AddChain(f.chain)
+
+	for name, elements := range sets {
+		err := b.conn.AddSet(&nftables.Set{
+			Table:   f.table,
+			Name:    name,
+			KeyType: keyType,
+		}, elements)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.scaffoldJump(f.chain, &nftables.Chain{
+		Name:     nftablesPreroutingChain,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	if err != nil {
+		return err
+	}
+
+	if f.filterChain != nil {
+		b.conn.AddTable(f.filterChain.Table)
+		b.conn.AddChain(f.filterChain)
+
+		err = b.scaffoldJump(f.filterChain, &nftables.Chain{
+			Name:     nftablesForwardChain,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.hairpinChain == nil {
+		return nil
+	}
+
+	b.conn.AddChain(f.hairpinChain)
+
+	return b.scaffoldJump(f.hairpinChain, &nftables.Chain{
+		Name:     nftablesPostroutingChain,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+}
+
+// scaffoldJump queues a jump to the chain from the first base chain in its table with the same type and hook as the given one
+// If there is no such chain, the given one is created in the table
+func (b *nftablesBackend) scaffoldJump(target *nftables.Chain, base *nftables.Chain) error {
+	t := target.Table
+
+	from, err := findNFTablesChain(b.conn, t, func(c *nftables.Chain) bool {
+		return c.Type == base.Type && c.Hooknum == base.Hooknum
+	})
+	if err != nil {
+		return err
+	}
+
+	if from == nil {
+		base.Table = t
+		from = b.conn.AddChain(base)
+	} else {
+		from.Table = t
+
+		rules, err := b.conn.GetRule(t, from)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			if string(r.UserData) == nftablesJumpUserData {
+				return nil
+			}
+		}
+	}
+
+	b.conn.InsertRule(&nftables.Rule{
+		Table: t,
+		Chain: from,
+		Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: target.Name},
+		},
+		UserData: []byte(nftablesJumpUserData),
+	})
+
+	return nil
+}
+
+func (b *nftablesBackend) update(rules map[rule]struct{}) ([]rule, error) {
+	currentRules, mapRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, fmt.Errorf("error getting current nftables rules %s", err.Error())
+	}
+
+	maps := b.maps()
+	currentElements, err := b.getCurrentElements(maps)
+	if err != nil {
+		return nil, fmt.Errorf("error getting current nftables map elements %s", err.Error())
+	}
+
+	var removed []rule
+	var lastErr error
+
+	err = b.addMaps(maps, mapRules)
+	if err != nil {
+		lastErr = err
+	}
+
+	elements, rules, err := splitForwards(rules)
+	if err != nil {
+		lastErr = err
+	}
+
+	// Change the ports that are forwarded elsewhere, and add the new ones
+	changes := newNFTablesChanges()
+	for e, t := range elements {
+		current, ok := currentElements[e]
+		if ok && current == t {
+			continue
+		}
+
+		if ok {
+			changes.delete(e, current)
+			removed = append(removed, e.rule(current))
+		}
+
+		changes.add(e, t)
+	}
+
+	// Remove the ports that are no longer forwarded
+	for e, current := range currentElements {
+		if _, ok := elements[e]; !ok {
+			changes.delete(e, current)
+			removed = append(removed, e.rule(current))
+		}
+	}
+
+	err = changes.queue(b.conn, maps)
+	if err != nil {
+		lastErr = err
+	}
+
+	// Add new accept and hairpin rules
+	for r := range rules {
+		if _, ok := currentRules[r]; !ok {
+			err := b.addRule(r)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+		}
+	}
+
+	// Remove old accept and hairpin rules, along with portforwarding rules from before the ports were kept in maps
+	for r, existing := range currentRules {
+		if _, ok := rules[r]; !ok {
+			err := b.conn.DelRule(existing)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			// Ports that are still forwarded the same way are in the maps now, and their connections are kept
+			if r.forward() && forwardedBy(r, elements) {
+				continue
+			}
+
+			removed = append(removed, r)
+		}
+	}
+
+	// All changes are applied in a single transaction, so either all rules are removed or none are
+	err = b.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, lastErr
+}
+
+func (b *nftablesBackend) add(rules map[rule]struct{}) ([]rule, int, error) {
+	currentRules, mapRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting current nftables rules %s", err.Error())
+	}
+
+	maps := b.maps()
+	currentElements, err := b.getCurrentElements(maps)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting current nftables map elements %s", err.Error())
+	}
+
+	var added []rule
+	var lastErr error
+	existing := 0
+
+	err = b.addMaps(maps, mapRules)
+	if err != nil {
+		lastErr = err
+	}
+
+	changes := newNFTablesChanges()
+	for r := range rules {
+		if r.forward() {
+			elements, err := r.elements()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			exists := true
+			for e, t := range elements {
+				current, ok := currentElements[e]
+				if ok && current == t {
+					continue
+				}
+
+				// The port may be forwarded elsewhere, in which case it's the caller's decision that it belongs to this rule now
+				if ok {
+					changes.delete(e, current)
+				}
+
+				changes.add(e, t)
+				exists = false
+			}
+
+			if exists {
+				existing++
+			} else {
+				added = append(added, r)
+			}
+
+			continue
+		}
+
+		// Adding the same peer twice would otherwise duplicate its rules
+		if _, ok := currentRules[r]; ok {
+			existing++
+			continue
+		}
+
+		err := b.addRule(r)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		added = append(added, r)
+	}
+
+	err = changes.queue(b.conn, maps)
+	if err != nil {
+		lastErr = err
+	}
+
+	// Nothing is added if the transaction fails
+	err = b.flush()
+	if err != nil {
+		return nil, existing, err
+	}
+
+	return added, existing, lastErr
+}
+
+func (b *nftablesBackend) remove(rules map[rule]struct{}) ([]rule, error) {
+	currentRules, _, err := b.getCurrentRules()
+	if err != nil {
+		return nil, fmt.Errorf("error getting current nftables rules %s", err.Error())
+	}
+
+	maps := b.maps()
+	currentElements, err := b.getCurrentElements(maps)
+	if err != nil {
+		return nil, fmt.Errorf("error getting current nftables map elements %s", err.Error())
+	}
+
+	var removed []rule
+	var lastErr error
+
+	changes := newNFTablesChanges()
+	for r := range rules {
+		if r.forward() {
+			elements, err := r.elements()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			for e, t := range elements {
+				// Ports forwarded elsewhere belong to another rule
+				if current, ok := currentElements[e]; !ok || current != t {
+					lastErr = fmt.Errorf("error deleting nftables map element: port %d is not forwarded to %s", e.port, e.rule(t).target())
+					continue
+				}
+
+				changes.delete(e, t)
+				removed = append(removed, e.rule(t))
+			}
+
+			continue
+		}
+
+		existing, ok := currentRules[r]
+		if !ok {
+			lastErr = fmt.Errorf("error deleting nftables rule: %s does not exist", r.userData())
+			continue
+		}
+
+		err := b.conn.DelRule(existing)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		removed = append(removed, r)
+	}
+
+	err = changes.queue(b.conn, maps)
+	if err != nil {
+		lastErr = err
+	}
+
+	err = b.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, lastErr
+}
+
+func (b *nftablesBackend) flush() error {
+	err := b.conn.Flush()
+	if err != nil {
+		return fmt.Errorf("error applying nftables rules: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (b *nftablesBackend) family(ipv6 bool) nftablesFamily {
+	if ipv6 {
+		return b.ipv6
+	}
+
+	return b.ipv4
+}
+
+// getCurrentRules returns the rules we manage in both families, keyed by their parsed user data, and the rules looking ports up in the maps
+func (b *nftablesBackend) getCurrentRules() (map[rule]*nftables.Rule, map[nftablesMap]*nftables.Rule, error) {
+	rules := make(map[rule]*nftables.Rule)
+	mapRules := make(map[nftablesMap]*nftables.Rule)
+
+	for _, f := range []nftablesFamily{b.ipv4, b.ipv6} {
+		for _, c := range f.chains() {
+			existing, err := b.conn.GetRule(c.Table, c)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, e := range existing {
+				// The returned rules don't carry the table family, which is needed to delete them
+				e.Table = c.Table
+				e.Chain = c
+
+				if m, ok := parseMapUserData(e.UserData, f.table.Family == nftables.TableFamilyIPv6); ok && c == f.chain {
+					mapRules[m] = e
+					continue
+				}
+
+				r, ok := parseUserData(e.UserData)
+				if !ok {
+					continue
+				}
+
+				// Whether it's an accept or hairpin rule is given by the chain it's in
+				r.accept = c == f.filterChain
+				r.hairpin = c == f.hairpinChain
+
+				rules[r] = e
+			}
+		}
+	}
+
+	return rules, mapRules, nil
+}
+
+// counters returns the counters of the rules looking the forwarded ports up in the maps
+// The ports forwarded on a set of relay addresses share a rule per protocol, so the counters are per rule rather than per peer
+func (b *nftablesBackend) counters() (map[rule]ruleCounters, error) {
+	_, mapRules, err := b.getCurrentRules()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[rule]ruleCounters)
+	for m, existing := range mapRules {
+		var c ruleCounters
+		for _, e := range existing.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				c = ruleCounters{packets: counter.Packets, bytes: counter.Bytes}
+			}
+		}
+
+		counters[rule{ipv6: m.ipv6, protocol: m.protocol, ipset: m.ipset}] = c
+	}
+
+	return counters, nil
+}
+
+// maps returns the maps of every set of relay addresses and protocol, in both families
+func (b *nftablesBackend) maps() map[nftablesMap]nftablesMapSets {
+	maps := make(map[nftablesMap]nftablesMapSets)
+	for _, f := range []nftablesFamily{b.ipv4, b.ipv6} {
+		ipv6 := f.table.Family == nftables.TableFamilyIPv6
+
+		addressType := nftables.TypeIPAddr
+		if ipv6 {
+			addressType = nftables.TypeIP6Addr
+		}
+
+		for _, ipset := range f.sets {
+			for _, protocol := range []string{"tcp", "udp"} {
+				m := nftablesMap{ipv6: ipv6, ipset: ipset, protocol: protocol}
+				maps[m] = nftablesMapSets{
+					addresses: &nftables.Set{
+						Table:    f.table,
+						Name:     m.name("addr"),
+						IsMap:    true,
+						KeyType:  nftables.TypeInetService,
+						DataType: addressType,
+					},
+					ports: &nftables.Set{
+						Table:    f.table,
+						Name:     m.name("port"),
+						IsMap:    true,
+						KeyType:  nftables.TypeInetService,
+						DataType: nftables.TypeInetService,
+					},
+				}
+			}
+		}
+	}
+
+	return maps
+}
+
+// getCurrentElements returns the ports in the maps that exist, along with what they're forwarded to
+func (b *nftablesBackend) getCurrentElements(maps map[nftablesMap]nftablesMapSets) (map[nftablesElement]nftablesTarget, error) {
+	existing := make(map[nftables.TableFamily]map[string]bool)
+	for _, f := range []nftablesFamily{b.ipv4, b.ipv6} {
+		sets, err := b.conn.GetSets(f.table)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make(map[string]bool)
+		for _, s := range sets {
+			names[s.Name] = true
+		}
+
+		existing[f.table.Family] = names
+	}
+
+	elements := make(map[nftablesElement]nftablesTarget)
+	for m, sets := range maps {
+		names := existing[sets.addresses.Table.Family]
+
+		if names[sets.addresses.Name] {
+			addresses, err := b.conn.GetSetElements(sets.addresses)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, a := range addresses {
+				if len(a.Key) != 2 {
+					continue
+				}
+
+				e := nftablesElement{nftablesMap: m, port: int(binary.BigEndian.Uint16(a.Key))}
+				t := elements[e]
+				t.destination = net.IP(a.Val).String()
+				elements[e] = t
+			}
+		}
+
+		if names[sets.ports.Name] {
+			ports, err := b.conn.GetSetElements(sets.ports)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, p := range ports {
+				if len(p.Key) != 2 || len(p.Val) != 2 {
+					continue
+				}
+
+				e := nftablesElement{nftablesMap: m, port: int(binary.BigEndian.Uint16(p.Key))}
+				t := elements[e]
+				t.toPort = int(binary.BigEndian.Uint16(p.Val))
+				elements[e] = t
+			}
+		}
+	}
+
+	return elements, nil
+}
+
+// addMaps queues the maps, and the rules looking the forwarded ports up in them, that are missing
+// Adding maps that already exist is a no-op, so they're added along with their rule in case only the rule was deleted
+func (b *nftablesBackend) addMaps(maps map[nftablesMap]nftablesMapSets, existing map[nftablesMap]*nftables.Rule) error {
+	for m, sets := range maps {
+		if _, ok := existing[m]; ok {
+			continue
+		}
+
+		for _, s := range []*nftables.Set{sets.addresses, sets.ports} {
+			err := b.conn.AddSet(s, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.conn.AddRule(b.mapRule(m, sets))
+	}
+
+	return nil
+}
+
+// mapRule returns the rule forwarding the ports in the maps to the address and port they map to
+func (b *nftablesBackend) mapRule(m nftablesMap, sets nftablesMapSets) *nftables.Rule {
+	f := b.family(m.ipv6)
+
+	addressOffset, addressLength, natFamily := uint32(16), uint32(4), uint32(unix.NFPROTO_IPV4)
+	if m.ipv6 {
+		addressOffset, addressLength, natFamily = 24, 16, unix.NFPROTO_IPV6
+	}
+
+	return &nftables.Rule{
+		Table: f.table,
+		Chain: f.chain,
+		Exprs: []expr.Any{
+			// daddr @ipset
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: addressOffset, Len: addressLength},
+			&expr.Lookup{SourceRegister: 1, SetName: m.ipset},
+			// meta l4proto tcp/udp
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocolByte(m.protocol)}},
+			// th dport, once for each map
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Payload{DestRegister: 2, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			// th dport map @addresses, ports that aren't in the maps don't match
+			&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: sets.addresses.Name, SetID: sets.addresses.ID},
+			// th dport map @ports
+			&expr.Lookup{SourceRegister: 2, DestRegister: 2, IsDestRegSet: true, SetName: sets.ports.Name, SetID: sets.ports.ID},
+			// Count the traffic, for the usage metrics
+			&expr.Counter{},
+			// dnat to the looked up address and port
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: natFamily, RegAddrMin: 1, RegProtoMin: 2},
+		},
+		UserData: []byte(m.userData()),
+	}
+}
+
+// addRule queues an accept or hairpin rule to be added on the next flush
+func (b *nftablesBackend) addRule(r rule) error {
+	f := b.family(r.ipv6)
+
+	chain := f.chainFor(r)
+	if chain == nil || r.forward() {
+		return fmt.Errorf("error adding nftables rule: accept or hairpin rules aren't managed")
+	}
+
+	destination := net.ParseIP(r.destination)
+	if destination == nil {
+		return fmt.Errorf("error adding nftables rule: invalid destination %s", r.destination)
+	}
+
+	// Match on the destination address of the peer
+	sourceOffset, addressOffset, addressLength := uint32(12), uint32(16), uint32(4)
+	if r.ipv6 {
+		sourceOffset, addressOffset, addressLength = 8, 24, 16
+	} else {
+		destination = destination.To4()
+	}
+
+	// The ports are matched with an anonymous set, created in the same transaction as the rule
+	ports := &nftables.Set{
+		Table:     chain.Table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeInetService,
+	}
+
+	var elements []nftables.SetElement
+	for _, port := range strings.Split(r.ports, ",") {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("error adding nftables rule: invalid port %s", port)
+		}
+
+		elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(uint16(p))})
+	}
+
+	err := b.conn.AddSet(ports, elements)
+	if err != nil {
+		return err
+	}
+
+	nftRule := &nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// daddr destination
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: addressOffset, Len: addressLength},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: destination},
+			// meta l4proto tcp/udp
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocolByte(r.protocol)}},
+			// th dport { ports }
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, SetName: ports.Name, SetID: ports.ID},
+		},
+		UserData: []byte(r.userData()),
+	}
+
+	if r.hairpin {
+		nftRule.Exprs = append(nftRule.Exprs,
+			// saddr destination
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: sourceOffset, Len: addressLength},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: destination},
+			// ct status dnat
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(nftablesCtStatusDNAT),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			// masquerade
+			&expr.Counter{},
+			&expr.Masq{},
+		)
+		b.conn.AddRule(nftRule)
+		return nil
+	}
+
+	// accept
+	nftRule.Exprs = append(nftRule.Exprs, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept})
+	b.conn.AddRule(nftRule)
+
+	return nil
+}
+
+func protocolByte(protocol string) byte {
+	if protocol == "udp" {
+		return unix.IPPROTO_UDP
+	}
+
+	return unix.IPPROTO_TCP
+}
+
+// nftablesChanges are the map elements to delete and add in a transaction
+type nftablesChanges struct {
+	deletes map[nftablesElement]nftablesTarget
+	adds    map[nftablesElement]nftablesTarget
+}
+
+func newNFTablesChanges() *nftablesChanges {
+	return &nftablesChanges{
+		deletes: make(map[nftablesElement]nftablesTarget),
+		adds:    make(map[nftablesElement]nftablesTarget),
+	}
+}
+
+// delete deletes a port as it currently is in the maps
+func (c *nftablesChanges) delete(e nftablesElement, current nftablesTarget) {
+	c.deletes[e] = current
+}
+
+// add adds a port to the maps, it must have been deleted first if it's already in them
+func (c *nftablesChanges) add(e nftablesElement, t nftablesTarget) {
+	c.adds[e] = t
+}
+
+// queue queues the changes to be applied on the next flush, with a message per map, deleting before adding so that ports can be changed
+func (c *nftablesChanges) queue(conn *nftables.Conn, maps map[nftablesMap]nftablesMapSets) error {
+	type mapElements map[*nftables.Set][]nftables.SetElement
+	deletes, adds := make(mapElements), make(mapElements)
+
+	var lastErr error
+	for _, changes := range []struct {
+		elements map[nftablesElement]nftablesTarget
+		sets     mapElements
+		// Elements are deleted by their key alone
+		withData bool
+	}{{c.deletes, deletes, false}, {c.adds, adds, true}} {
+		for e, t := range changes.elements {
+			sets, ok := maps[e.nftablesMap]
+			if !ok {
+				lastErr = fmt.Errorf("error changing nftables map element: set %s isn't the set of an exit", e.ipset)
+				continue
+			}
+
+			key := binaryutil.BigEndian.PutUint16(uint16(e.port))
+
+			// Ports missing from one of the maps, eg after someone changed them, are only deleted from the other
+			if t.destination != "" {
+				element := nftables.SetElement{Key: key}
+				if changes.withData {
+					destination := net.ParseIP(t.destination)
+					if !e.ipv6 {
+						destination = destination.To4()
+					}
+
+					element.Val = destination
+				}
+
+				changes.sets[sets.addresses] = append(changes.sets[sets.addresses], element)
+			}
+
+			if t.toPort != 0 {
+				element := nftables.SetElement{Key: key}
+				if changes.withData {
+					element.Val = binaryutil.BigEndian.PutUint16(uint16(t.toPort))
+				}
+
+				changes.sets[sets.ports] = append(changes.sets[sets.ports], element)
+			}
+		}
+	}
+
+	for s, elements := range deletes {
+		err := conn.SetDeleteElements(s, elements)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	for s, elements := range adds {
+		err := conn.SetAddElements(s, elements)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// splitForwards splits the portforwarding rules into the ports to put in the maps, and returns them along with the rest of the rules
+// A port forwarded to more than one destination is only forwarded to the first one, as a map can only hold one
+func splitForwards(rules map[rule]struct{}) (map[nftablesElement]nftablesTarget, map[rule]struct{}, error) {
+	elements := make(map[nftablesElement]nftablesTarget)
+	others := make(map[rule]struct{})
+
+	var lastErr error
+	for _, r := range sortedRules(rules) {
+		if !r.forward() {
+			others[r] = struct{}{}
+			continue
+		}
+
+		ruleElements, err := r.elements()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for e, t := range ruleElements {
+			if existing, ok := elements[e]; ok && existing != t {
+				lastErr = fmt.Errorf("error adding nftables map element: port %d is forwarded to both %s and %s", e.port, e.rule(existing).target(), e.rule(t).target())
+				continue
+			}
+
+			elements[e] = t
+		}
+	}
+
+	return elements, others, lastErr
+}
+
+// sortedRules returns the rules in a stable order, so that the same rule wins every time when rules collide
+func sortedRules(rules map[rule]struct{}) []rule {
+	sorted := make([]rule, 0, len(rules))
+	for r := range rules {
+		sorted = append(sorted, r)
+	}
+
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].userData() < sorted[j].userData()
+	})
+
+	return sorted
+}
+
+// forwardedBy checks whether all the ports of a portforwarding rule are forwarded the same way by the map elements
+func forwardedBy(r rule, elements map[nftablesElement]nftablesTarget) bool {
+	ruleElements, err := r.elements()
+	if err != nil {
+		return false
+	}
+
+	for e, t := range ruleElements {
+		if elements[e] != t {
+			return false
+		}
+	}
+
+	return true
+}
+
+// elements returns the map elements of a portforwarding rule, one per port
+func (r rule) elements() (map[nftablesElement]nftablesTarget, error) {
+	destination := net.ParseIP(r.destination)
+	if destination == nil {
+		return nil, fmt.Errorf("error adding nftables map element: invalid destination %s", r.destination)
+	}
+
+	elements := make(map[nftablesElement]nftablesTarget)
+	for _, port := range strings.Split(r.ports, ",") {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("error adding nftables map element: invalid port %s", port)
+		}
+
+		toPort := int(p)
+		if r.toPort != 0 {
+			toPort = r.toPort
+		}
+
+		e := nftablesElement{
+			nftablesMap: nftablesMap{ipv6: r.ipv6, ipset: r.ipset, protocol: r.protocol},
+			port:        int(p),
+		}
+		elements[e] = nftablesTarget{destination: destination.String(), toPort: toPort}
+	}
+
+	return elements, nil
+}
+
+// rule returns the portforwarding rule forwarding just the port to the target
+func (e nftablesElement) rule(t nftablesTarget) rule {
+	toPort := t.toPort
+	if toPort == e.port {
+		toPort = 0
+	}
+
+	return rule{
+		ipv6:        e.ipv6,
+		protocol:    e.protocol,
+		ipset:       e.ipset,
+		ports:       strconv.Itoa(e.port),
+		destination: t.destination,
+		toPort:      toPort,
+	}
+}
+
+// name returns the name of one of the maps
+func (m nftablesMap) name(kind string) string {
+	return m.ipset + "_" + m.protocol + "_" + kind
+}
+
+// userData identifies the rule looking the ports up in the maps, the family is given by the table it's in
+func (m nftablesMap) userData() string {
+	return strings.Join([]string{nftablesMapUserDataPrefix, m.ipset, m.protocol}, " ")
+}
+
+func parseMapUserData(data []byte, ipv6 bool) (nftablesMap, bool) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 4 || strings.Join(fields[:2], " ") != nftablesMapUserDataPrefix {
+		return nftablesMap{}, false
+	}
+
+	return nftablesMap{ipv6: ipv6, ipset: fields[2], protocol: fields[3]}, true
+}
+
+// userData identifies a rule in nftables, since rules can't be compared by their expressions once they've been added
+func (r rule) userData() string {
+	family := "ipv4"
+	if r.ipv6 {
+		family = "ipv6"
+	}
+
+	// Accept rules have no ipset
+	ipset := r.ipset
+	if ipset == "" {
+		ipset = "-"
+	}
+
+	return strings.Join([]string{nftablesUserDataPrefix, family, r.protocol, ipset, r.ports, r.target()}, " ")
+}
+
+func parseUserData(data []byte) (rule, bool) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 6 || fields[0] != nftablesUserDataPrefix {
+		return rule{}, false
+	}
+
+	destination, toPort, ok := parseTarget(fields[5])
+	if !ok {
+		return rule{}, false
+	}
+
+	ipset := fields[3]
+	if ipset == "-" {
+		ipset = ""
+	}
+
+	return rule{
+		ipv6:        fields[1] == "ipv6",
+		protocol:    fields[2],
+		ipset:       ipset,
+		ports:       fields[4],
+		destination: destination,
+		toPort:      toPort,
+	}, true
+}
@@ -0,0 +1,53 @@
+package portforward
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitForwards(t *testing.T) {
+	rules := map[rule]struct{}{
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4", ports: "1234,4321", destination: "10.99.0.1"}:               {},
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4", ports: "51234", destination: "10.99.0.1", toPort: 8080}:     {},
+		{ipv6: true, protocol: "udp", ipset: "PORTFORWARDING_IPV6", ports: "1234", destination: "fc00::1"}:          {},
+		{protocol: "tcp", ports: "1234,4321,8080", destination: "10.99.0.1", accept: true}:                          {},
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4", ports: "4321", destination: "10.99.0.2"}:                    {},
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4", ports: "not-a-port", destination: "10.99.0.3"}:              {},
+		{protocol: "tcp", ipset: "PORTFORWARDING_IPV4_EXIT", ports: "1234", destination: "10.99.0.4", toPort: 1234}: {},
+	}
+
+	elements, others, err := splitForwards(rules)
+	if err == nil {
+		t.Error("expected an error for the invalid and the colliding port")
+	}
+
+	ipv4 := nftablesMap{ipset: "PORTFORWARDING_IPV4", protocol: "tcp"}
+	expected := map[nftablesElement]nftablesTarget{
+		{ipv4, 1234}: {destination: "10.99.0.1", toPort: 1234},
+		// The first rule in a stable order wins the colliding port
+		{ipv4, 4321}:  {destination: "10.99.0.1", toPort: 4321},
+		{ipv4, 51234}: {destination: "10.99.0.1", toPort: 8080},
+		{nftablesMap{ipv6: true, ipset: "PORTFORWARDING_IPV6", protocol: "udp"}, 1234}: {destination: "fc00::1", toPort: 1234},
+		{nftablesMap{ipset: "PORTFORWARDING_IPV4_EXIT", protocol: "tcp"}, 1234}:        {destination: "10.99.0.4", toPort: 1234},
+	}
+	if diff := cmp.Diff(expected, elements, cmp.AllowUnexported(nftablesElement{}, nftablesMap{}, nftablesTarget{})); diff != "" {
+		t.Errorf("unexpected elements (-want +got):\n%s", diff)
+	}
+
+	if len(others) != 1 {
+		t.Errorf("expected only the accept rule to be left, got %v", others)
+	}
+
+	// Ports forwarded to themselves are reported as rules without a port to forward to
+	for e, target := range elements {
+		r := e.rule(target)
+		if r.toPort == e.port {
+			t.Errorf("rule %+v forwards to the same port explicitly", r)
+		}
+
+		if !forwardedBy(r, elements) {
+			t.Errorf("rule %+v isn't forwarded by the elements it came from", r)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package portforward_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+)
+
+// Integration tests for the nftables backend, not ran in short mode
+// The chain and sets are created by the test in the ip and ip6 nat tables, and removed again afterwards,
+// along with the tables if they didn't exist before
+
+const (
+	nftablesChain     = "NFT_PORTFORWARDING"
+	nftablesIPSetIPv4 = "NFT_PF_IPV4"
+	nftablesIPSetIPv6 = "NFT_PF_IPV6"
+)
+
+// The rules looking the ports up in the maps, which stay in place when there are no ports
+var nftablesMapRules = []string{
+	"ipv4 wg-manager: map NFT_PF_IPV4 tcp",
+	"ipv4 wg-manager: map NFT_PF_IPV4 udp",
+	"ipv6 wg-manager: map NFT_PF_IPV6 tcp",
+	"ipv6 wg-manager: map NFT_PF_IPV6 udp",
+}
+
+// The ports in the maps, and what they're forwarded to
+var nftablesFixture = []string{
+	"ipv4 NFT_PF_IPV4_tcp 1234 10.99.0.1:1234",
+	"ipv4 NFT_PF_IPV4_tcp 4321 10.99.0.1:4321",
+	"ipv4 NFT_PF_IPV4_tcp 51234 10.99.0.1:8080",
+	"ipv4 NFT_PF_IPV4_udp 1234 10.99.0.1:1234",
+	"ipv4 NFT_PF_IPV4_udp 4321 10.99.0.1:4321",
+	"ipv6 NFT_PF_IPV6_tcp 1234 [fc00:bbbb:bbbb:bb01::1]:1234",
+	"ipv6 NFT_PF_IPV6_tcp 4321 [fc00:bbbb:bbbb:bb01::1]:4321",
+	"ipv6 NFT_PF_IPV6_tcp 51234 [fc00:bbbb:bbbb:bb01::1]:8080",
+	"ipv6 NFT_PF_IPV6_udp 1234 [fc00:bbbb:bbbb:bb01::1]:1234",
+	"ipv6 NFT_PF_IPV6_udp 4321 [fc00:bbbb:bbbb:bb01::1]:4321",
+}
+
+func TestPortforwardNFTables(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	defer setupNFTables(t)()
+
+	pf, err := portforward.NewWithConfig(portforward.Config{
+		Backend:        portforward.BackendNFTables,
+		Chain:          nftablesChain,
+		IPSetIPv4:      nftablesIPSetIPv4,
+		IPSetIPv6:      nftablesIPSetIPv6,
+		Create:         true,
+		RelayAddresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("add rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+		compareNFTablesRules(t, nftablesFixture)
+	})
+
+	t.Run("update rules is idempotent", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+		compareNFTablesRules(t, nftablesFixture)
+	})
+
+	t.Run("move port to another peer", func(t *testing.T) {
+		moved := api.WireguardPeer{
+			IPv4:   "10.99.0.2/32",
+			IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+			Ports:  []api.Port{{External: 4321, Protocol: "udp"}},
+			Pubkey: "moved",
+		}
+
+		pf.UpdatePortforwarding(api.WireguardPeerList{moved})
+		compareNFTablesRules(t, []string{
+			"ipv4 NFT_PF_IPV4_udp 4321 10.99.0.2:4321",
+			"ipv6 NFT_PF_IPV6_udp 4321 [fc00:bbbb:bbbb:bb01::2]:4321",
+		})
+	})
+
+	t.Run("remove rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+		compareNFTablesRules(t, []string{})
+	})
+
+	t.Run("add rules for single peer", func(t *testing.T) {
+		err := pf.AddPortforwarding(apiFixture[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compareNFTablesRules(t, nftablesFixture)
+	})
+
+	t.Run("remove rules for single peer", func(t *testing.T) {
+		err := pf.RemovePortforwarding(apiFixture[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compareNFTablesRules(t, []string{})
+	})
+}
+
+// compareNFTablesRules compares the ports in the maps with the expected ones, and checks that there's a single rule per map
+func compareNFTablesRules(t *testing.T, expected []string) {
+	t.Helper()
+
+	conn := &nftables.Conn{}
+	rules := []string{}
+	elements := []string{}
+	for _, family := range []struct {
+		name   string
+		family nftables.TableFamily
+		ipset  string
+	}{{"ipv4", nftables.TableFamilyIPv4, nftablesIPSetIPv4}, {"ipv6", nftables.TableFamilyIPv6, nftablesIPSetIPv6}} {
+		nat := &nftables.Table{Name: table, Family: family.family}
+		existing, err := conn.GetRule(nat, &nftables.Chain{Name: nftablesChain, Table: nat})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range existing {
+			if strings.HasPrefix(string(r.UserData), "wg-manager:") {
+				rules = append(rules, family.name+" "+string(r.UserData))
+			}
+		}
+
+		for _, protocol := range []string{"tcp", "udp"} {
+			name := family.ipset + "_" + protocol
+
+			addresses, err := conn.GetSetElements(&nftables.Set{Table: nat, Name: name + "_addr"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ports, err := conn.GetSetElements(&nftables.Set{Table: nat, Name: name + "_port"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			toPorts := make(map[uint16]uint16)
+			for _, e := range ports {
+				toPorts[binary.BigEndian.Uint16(e.Key)] = binary.BigEndian.Uint16(e.Val)
+			}
+
+			for _, e := range addresses {
+				port := binary.BigEndian.Uint16(e.Key)
+				target := net.JoinHostPort(net.IP(e.Val).String(), strconv.Itoa(int(toPorts[port])))
+				elements = append(elements, fmt.Sprintf("%s %s %d %s", family.name, name, port, target))
+			}
+		}
+	}
+
+	if diff := cmp.Diff(nftablesMapRules, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+		t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(expected, elements, cmpopts.SortSlices(stringCompare)); diff != "" {
+		t.Fatalf("unexpected ports (-want +got):\n%s", diff)
+	}
+}
+
+// setupNFTables skips the test if nftables isn't available, and returns a function removing what the test created
+// Tables that existed before the test are left in place, with only the chain, the sets, the maps and the jump to the chain removed from them
+func setupNFTables(t *testing.T) func() {
+	t.Helper()
+
+	conn := &nftables.Conn{}
+	tables, err := conn.ListTables()
+	if err != nil {
+		t.Skipf("nftables isn't available: %s", err)
+	}
+
+	existed := make(map[nftables.TableFamily]bool)
+	for _, t := range tables {
+		if t.Name == table {
+			existed[t.Family] = true
+		}
+	}
+
+	return func() {
+		for _, family := range []struct {
+			family nftables.TableFamily
+			ipset  string
+		}{{nftables.TableFamilyIPv4, nftablesIPSetIPv4}, {nftables.TableFamilyIPv6, nftablesIPSetIPv6}} {
+			nat := &nftables.Table{Name: table, Family: family.family}
+			if !existed[family.family] {
+				conn.DelTable(nat)
+				if err := conn.Flush(); err != nil {
+					t.Errorf("error deleting the %s table: %s", table, err)
+				}
+
+				continue
+			}
+
+			chains, err := conn.ListChains()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range chains {
+				if c.Table.Name != table || c.Table.Family != family.family {
+					continue
+				}
+
+				rules, err := conn.GetRule(nat, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, r := range rules {
+					for _, e := range r.Exprs {
+						if v, ok := e.(*expr.Verdict); ok && v.Kind == expr.VerdictJump && v.Chain == nftablesChain {
+							r.Table, r.Chain = nat, c
+							conn.DelRule(r)
+						}
+					}
+				}
+			}
+
+			c := &nftables.Chain{Name: nftablesChain, Table: nat}
+			conn.FlushChain(c)
+			conn.DelChain(c)
+
+			for _, name := range []string{"_tcp_addr", "_tcp_port", "_udp_addr", "_udp_port", ""} {
+				conn.DelSet(&nftables.Set{Table: nat, Name: family.ipset + name})
+			}
+
+			if err := conn.Flush(); err != nil {
+				t.Errorf("error deleting the nftables scaffolding: %s", err)
+			}
+		}
+	}
+}
@@ -7,283 +7,750 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/coreos/go-iptables/iptables"
-	"github.com/digineo/go-ipset/v2"
-	"github.com/mdlayher/netlink"
+	"github.com/infosum/statsd"
 	"github.com/mullvad/wg-manager/api"
-	"github.com/ti-mo/netfilter"
+	"github.com/mullvad/wg-manager/iputil"
 )
 
 // Portforward is a utility for managing portforwarding
 type Portforward struct {
-	iptables  *iptables.IPTables
-	ip6tables *iptables.IPTables
-	chain     string
-	ipsetIPv4 string
-	ipsetIPv6 string
+	backend        backend
+	defaultExit    Exit
+	exits          map[string]Exit
+	create         bool
+	conflictPolicy ConflictPolicy
+	filter         bool
+	hairpin        bool
+	metrics        *statsd.Client
+
+	mu        sync.Mutex
+	conflicts []Conflict
+	// forwards are the ports forwarded by the last applied rules, keyed by public key
+	forwards map[string][]Forward
+
+	// apply serializes changes to the rules, since mappings are made outside of synchronization
+	apply sync.Mutex
+	// peers is the last applied list of peers, which mappings are applied on top of
+	peers api.WireguardPeerList
+	// mappings are the ports peers requested themselves, keyed by public key
+	mappings map[string][]api.Port
+	// allocator hands out ports from the port pools, nil if there are none
+	allocator *allocator
+	// nextExpiry is when the next lease of the applied ports runs out, zero if none of them have one
+	nextExpiry time.Time
+
+	// counters are the rule counters as of the last update, nil before the first one
+	counters map[rule]ruleCounters
 }
 
-// Iptables table to operate against
-const table = "nat"
+// Backend is a firewall implementation to manage portforwarding rules with
+type Backend string
+
+const (
+	// BackendIPTables manages the rules with iptables and ip6tables, matching relay addresses with ipsets
+	BackendIPTables Backend = "iptables"
+	// BackendNFTables manages the rules natively with nftables, matching relay addresses with nftables sets, and forwarding ports through nftables maps
+	BackendNFTables Backend = "nftables"
+)
+
+// Config is the configuration for portforwarding
+type Config struct {
+	Backend Backend
+	// Chain is the chain in the nat table to manage the rules in
+	Chain string
+	// FilterChain is a chain in the filter table to manage rules accepting the forwarded traffic in, empty to not manage them
+	// The rules are reconciled together with the portforwarding rules, so that they always match
+	FilterChain string
+	// HairpinChain is a chain in the nat table to manage rules masquerading forwarded traffic from a peer to itself in, empty to not manage them
+	// Without them, a peer can't reach its own forwarded ports through the relay address
+	HairpinChain string
+	// IPSetIPv4 and IPSetIPv6 are the sets containing the relay addresses that ports are forwarded on
+	IPSetIPv4 string
+	IPSetIPv6 string
+	// NoRestore applies iptables rules one at a time, instead of in a single iptables-restore transaction
+	NoRestore bool
+	// Create creates the chain, the jump to it from PREROUTING and the sets if they're missing, and adds the relay addresses to the sets
+	// This is verified on every update, so that the scaffolding is repaired if someone flushed it
+	Create bool
+	// RelayAddresses are the addresses added to the sets when Create is set, if empty the public addresses of the host are used
+	RelayAddresses []net.IP
+	// Exits are the sets of relay addresses that only some peers have their ports forwarded on, keyed by the exit the peers are assigned to
+	// Peers without an exit have their ports forwarded on IPSetIPv4 and IPSetIPv6
+	Exits map[string]Exit
+	// PortPools are the ports handed out to peers locally with AllocatePort, keyed by exit, with an empty key for the default one
+	PortPools map[string]PortRange
+	// ReservedPorts are ports that no port pool may include
+	ReservedPorts []PortRange
+	// StateDir is the directory the port pool allocations are persisted in, needed if there are port pools
+	StateDir string
+	// ConflictPolicy decides what happens to ports assigned to more than one peer, defaults to ConflictPolicyPickOwner
+	ConflictPolicy ConflictPolicy
+	// Metrics is the client to send metrics to, if nil no metrics are sent
+	Metrics *statsd.Client
+}
+
+// Exit is a relay address, or a group of them, that ports can be forwarded on
+type Exit struct {
+	IPSetIPv4 string
+	IPSetIPv6 string
+	// Addresses are added to the sets when Create is set
+	Addresses []net.IP
+}
+
+// addresses splits the addresses of the exit by family
+func (e Exit) addresses() ([]net.IP, []net.IP) {
+	var ipv4, ipv6 []net.IP
+	for _, address := range e.Addresses {
+		if address.To4() != nil {
+			ipv4 = append(ipv4, address)
+		} else {
+			ipv6 = append(ipv6, address)
+		}
+	}
+
+	return ipv4, ipv6
+}
+
+// allExits returns the default exit followed by the other exits, in a stable order
+func (cfg Config) allExits() []Exit {
+	exits := []Exit{{
+		IPSetIPv4: cfg.IPSetIPv4,
+		IPSetIPv6: cfg.IPSetIPv6,
+		Addresses: cfg.RelayAddresses,
+	}}
+
+	keys := make([]string, 0, len(cfg.Exits))
+	for key := range cfg.Exits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		exits = append(exits, cfg.Exits[key])
+	}
+
+	return exits
+}
+
+// backend applies portforwarding rules to the firewall
+// All methods attempt every rule even if one fails, and return the last error
+type backend interface {
+	// update makes the managed rules match the given rules, and returns the rules that were removed
+	update(rules map[rule]struct{}) ([]rule, error)
+	// add adds the given rules that don't exist yet, and returns the rules it added and how many already existed
+	add(rules map[rule]struct{}) ([]rule, int, error)
+	// remove removes the given rules without checking existing ones, and returns the rules that were removed
+	remove(rules map[rule]struct{}) ([]rule, error)
+	// scaffold creates the chain, the jump to it and the sets of the exits if they're missing, and makes sure the sets contain the addresses of the exits
+	scaffold(exits []Exit) error
+	// counters returns the packet and byte counters of the managed portforwarding rules, excluding accept and hairpin rules
+	counters() (map[rule]ruleCounters, error)
+}
+
+// rule is a single portforwarding rule, forwarding a set of ports for one protocol to a peer
+// If toPort is set, the ports are forwarded to that port on the peer instead of to the same ports
+// If accept is set, it's instead a rule in the filter chain accepting the forwarded traffic to the ports on the peer, without an ipset
+// If hairpin is set, it's instead a rule in the hairpin chain masquerading forwarded traffic from the peer to the ports on itself, without an ipset
+type rule struct {
+	ipv6        bool
+	accept      bool
+	hairpin     bool
+	protocol    string
+	ipset       string
+	ports       string
+	destination string
+	toPort      int
+}
+
+// Tables to operate against, named the same in both iptables and nftables
+const (
+	table       = "nat"
+	filterTable = "filter"
+)
 
 // New validates the addresses, ensures that the iptables portforwarding chain exists, and returns a new Portforward instance
 func New(chain string, ipsetTableIPv4 string, ipsetTableIPv6 string) (*Portforward, error) {
-	ipt, err := newIPTables(chain, iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
+	return NewWithConfig(Config{
+		Backend:   BackendIPTables,
+		Chain:     chain,
+		IPSetIPv4: ipsetTableIPv4,
+		IPSetIPv6: ipsetTableIPv6,
+	})
+}
+
+// NewWithConfig validates the configuration, ensures that the portforwarding chain and sets exist in the given backend, and returns a new Portforward instance
+func NewWithConfig(cfg Config) (*Portforward, error) {
+	var b backend
+	var err error
+
+	for key, exit := range cfg.Exits {
+		if key == "" || exit.IPSetIPv4 == "" || exit.IPSetIPv6 == "" {
+			return nil, fmt.Errorf("invalid portforwarding exit %s, it needs both an ipv4 and an ipv6 set", key)
+		}
 	}
 
-	ip6t, err := newIPTables(chain, iptables.ProtocolIPv6)
-	if err != nil {
-		return nil, err
+	switch cfg.Backend {
+	case BackendIPTables, "":
+		b, err = newIPTablesBackend(cfg)
+	case BackendNFTables:
+		b, err = newNFTablesBackend(cfg)
+	default:
+		err = fmt.Errorf("unknown portforwarding backend %s", cfg.Backend)
 	}
 
-	err = validateIPSet(ipsetTableIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	err = validateIPSet(ipsetTableIPv6)
-	if err != nil {
-		return nil, err
+	switch cfg.ConflictPolicy {
+	case "":
+		cfg.ConflictPolicy = ConflictPolicyPickOwner
+	case ConflictPolicyPickOwner, ConflictPolicySkip:
+	default:
+		return nil, fmt.Errorf("unknown portforwarding conflict policy %s", cfg.ConflictPolicy)
+	}
+
+	if cfg.Metrics == nil {
+		cfg.Metrics, err = statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &Portforward{
-		iptables:  ipt,
-		ip6tables: ip6t,
-		chain:     chain,
-		ipsetIPv4: ipsetTableIPv4,
-		ipsetIPv6: ipsetTableIPv6,
-	}, nil
+	p := &Portforward{
+		backend:        b,
+		defaultExit:    cfg.allExits()[0],
+		exits:          cfg.Exits,
+		create:         cfg.Create,
+		conflictPolicy: cfg.ConflictPolicy,
+		filter:         cfg.FilterChain != "",
+		hairpin:        cfg.HairpinChain != "",
+		metrics:        cfg.Metrics,
+	}
+
+	if len(cfg.PortPools) > 0 {
+		for exit := range cfg.PortPools {
+			if _, ok := cfg.Exits[exit]; exit != "" && !ok {
+				return nil, fmt.Errorf("port pool for unknown portforwarding exit %s", exit)
+			}
+		}
+
+		p.allocator, err = newAllocator(cfg.StateDir, cfg.PortPools, cfg.ReservedPorts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.create {
+		err = p.scaffold()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
 }
 
-func newIPTables(chain string, protocol iptables.Protocol) (*iptables.IPTables, error) {
-	ipt, err := iptables.NewWithProtocol(protocol)
+// scaffold creates the chain, jump rules and sets, and populates the sets with the relay addresses
+func (p *Portforward) scaffold() error {
+	defaultExit := p.defaultExit
+	var err error
+	defaultExit.Addresses, err = p.DefaultExitAddresses()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	exists, err := chainExists(chain, ipt)
-	if err != nil {
-		return nil, err
+	exits := []Exit{defaultExit}
+	for _, exit := range p.exits {
+		exits = append(exits, exit)
 	}
 
-	if !exists {
-		return nil, fmt.Errorf("an iptables chain named %s does not exist", chain)
+	err = p.backend.scaffold(exits)
+	if err != nil {
+		return fmt.Errorf("error creating portforwarding scaffolding %s", err.Error())
 	}
 
-	return ipt, nil
+	return nil
 }
 
-func chainExists(chain string, ipt *iptables.IPTables) (bool, error) {
-	chains, err := ipt.ListChains("nat")
+// exitAddresses returns the relay addresses of the exits by ipset, leaving out exits whose addresses aren't known
+// The default exit falls back to the public addresses of the host, like when its sets are created
+func (p *Portforward) exitAddresses() map[string][]net.IP {
+	addresses := make(map[string][]net.IP)
+	for _, exit := range p.exits {
+		ipv4, ipv6 := exit.addresses()
+		addresses[exit.IPSetIPv4] = append(addresses[exit.IPSetIPv4], ipv4...)
+		addresses[exit.IPSetIPv6] = append(addresses[exit.IPSetIPv6], ipv6...)
+	}
 
+	defaultExit := p.defaultExit
+	var err error
+	defaultExit.Addresses, err = p.DefaultExitAddresses()
 	if err != nil {
-		return false, err
+		log.Print(err)
 	}
 
-	for _, c := range chains {
-		if c == chain {
-			return true, nil
-		}
-	}
+	ipv4, ipv6 := defaultExit.addresses()
+	addresses[defaultExit.IPSetIPv4] = append(addresses[defaultExit.IPSetIPv4], ipv4...)
+	addresses[defaultExit.IPSetIPv6] = append(addresses[defaultExit.IPSetIPv6], ipv6...)
 
-	return false, nil
+	return addresses
 }
 
-func validateIPSet(name string) error {
-	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+// DefaultExitAddresses returns the relay addresses of the default exit, which are the public addresses of the host unless they're configured
+func (p *Portforward) DefaultExitAddresses() ([]net.IP, error) {
+	if len(p.defaultExit.Addresses) > 0 {
+		return p.defaultExit.Addresses, nil
+	}
+
+	addresses, err := publicAddresses()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error discovering relay addresses %s", err.Error())
 	}
 
-	ipsets, err := conn.ListAll()
+	return addresses, nil
+}
 
-	for _, p := range ipsets {
-		if p.Name.Get() == name {
-			return nil
+// publicAddresses returns the public addresses of the host, discovered on every call since they may change
+func publicAddresses() ([]net.IP, error) {
+	interfaceAddresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IP
+	for _, a := range interfaceAddresses {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || !iputil.IsPublic(ipNet.IP) {
+			continue
 		}
+
+		addresses = append(addresses, ipNet.IP)
 	}
 
-	return fmt.Errorf("an ipset named %s does not exist", name)
+	return addresses, nil
 }
 
-// UpdatePortforwarding updates the iptables rules for portforwarding to match the given list of peers
-func (p *Portforward) UpdatePortforwarding(peers api.WireguardPeerList) {
-	rules := make(map[string]iptables.Protocol)
+// UpdatePortforwarding updates the portforwarding rules to match the given list of peers, along with the mappings the peers requested
+// Ports assigned to more than one peer are handled according to the conflict policy, and reported through Conflicts
+// The error of applying the rules is returned, errors only affecting a single peer are logged
+func (p *Portforward) UpdatePortforwarding(peers api.WireguardPeerList) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	p.peers = peers
+	err := p.update()
+	p.reportCounters()
+
+	return err
+}
+
+// update reconciles the rules with the last applied list of peers and the mappings, leaving out ports whose leases ran out
+func (p *Portforward) update() error {
+	peers, invalid := withoutInvalid(p.withMappings(p.peers))
+	p.metrics.Gauge("portforwarding_invalid_ports", invalid)
+
+	peers, expired, nextExpiry := withoutExpired(peers, time.Now())
+	p.nextExpiry = nextExpiry
+	p.metrics.Gauge("portforwarding_expired_leases", expired)
+
+	if p.create {
+		err := p.scaffold()
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	owners, conflicts := p.detectConflicts(peers)
+	p.reportConflicts(conflicts)
+
+	rules := make(map[rule]struct{})
+	forwards := make(map[string][]Forward)
+	unknownExits := 0
 	for _, peer := range peers {
 		if len(peer.Ports) < 1 {
 			continue
 		}
 
-		p.createPeerRules(peer, rules)
+		owns := func(claim portClaim) bool {
+			owner, conflicted := owners[claim]
+			return !conflicted || owner == peer.Pubkey
+		}
+
+		err := p.createPeerRules(peer, rules, owns)
+		if err != nil {
+			unknownExits++
+			log.Printf("not forwarding ports for peer %s: %s", peer.Pubkey, err.Error())
+			continue
+		}
+
+		forwards[peer.Pubkey] = p.peerForwards(peer, owns)
 	}
+	p.metrics.Gauge("portforwarding_unknown_exit", unknownExits)
 
-	currentRules, err := p.getCurrentRules()
+	removed, err := p.backend.update(rules)
 	if err != nil {
-		log.Printf("error getting current iptables rules %s", err.Error())
-		return
+		err = fmt.Errorf("error updating portforwarding rules %s", err.Error())
+		log.Print(err)
+	} else {
+		p.mu.Lock()
+		p.forwards = forwards
+		p.mu.Unlock()
 	}
 
-	// Add new portforwarding rules
-	for rule, protocol := range rules {
-		if _, ok := currentRules[rule]; !ok {
-			ipt := p.iptables
-			if protocol == iptables.ProtocolIPv6 {
-				ipt = p.ip6tables
-			}
+	p.flushConntrack(removed)
 
-			err := ipt.Append(table, p.chain, strings.Split(rule, " ")...)
-			if err != nil {
-				log.Printf("error adding iptables rule")
-				continue
-			}
+	return err
+}
+
+// AddPortforwarding adds the portforwarding rules for a peer, skipping the rules that already exist
+// If the peer was already added, the rules it no longer needs are removed, so that adding a peer again only applies what changed
+// If the peer claims a port another peer claims too, all rules are updated instead, so that the conflict policy is applied
+// All rules are attempted even if one fails, and the last error is returned
+// If a new peer fails, the rules that were added for it are removed again and the peer is left out, keeping its mappings and pool ports
+func (p *Portforward) AddPortforwarding(peer api.WireguardPeer) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	previous, existed := p.peer(peer.Pubkey)
+	p.setPeer(peer)
+
+	return p.applyPeer(p.withPeerMappings(peer), p.withPeerMappings(previous), existed)
+}
+
+// applyPeer adds the rules of a peer, and removes the rules it had before that it no longer needs, if it existed
+// Both the peer and the previous one include the mappings, and only the rules of the peer are changed, unless it shares a port with another peer
+// A peer that didn't exist is rolled back if it fails, so that it's never partially forwarded to
+func (p *Portforward) applyPeer(peer api.WireguardPeer, previous api.WireguardPeer, existed bool) error {
+	peers, invalid := withoutInvalid(api.WireguardPeerList{peer})
+	p.metrics.Count("portforwarding_invalid_ports", invalid)
+
+	now := time.Now()
+	peers, _, nextExpiry := withoutExpired(peers, now)
+	peer = peers[0]
+	if !nextExpiry.IsZero() && (p.nextExpiry.IsZero() || nextExpiry.Before(p.nextExpiry)) {
+		p.nextExpiry = nextExpiry
+	}
+
+	// The policy settles ports claimed by other peers too, which may take them from their current owner, so all rules are updated
+	if p.conflicted(peer.Pubkey) {
+		err := p.update()
+		if err != nil && !existed {
+			p.rollback(peer.Pubkey, nil)
+			p.update()
 		}
+
+		return err
 	}
 
-	// Remove old portforwarding rules
-	for rule, protocol := range currentRules {
-		if _, ok := rules[rule]; !ok {
-			ipt := p.iptables
-			if protocol == iptables.ProtocolIPv6 {
-				ipt = p.ip6tables
-			}
+	// Peers without ports need no rules, whatever their exit is
+	var lastErr error
+	rules := make(map[rule]struct{})
+	if len(peer.Ports) > 0 {
+		lastErr = p.createPeerRules(peer, rules, nil)
+	}
+
+	if existed {
+		previousPeers, _ := withoutInvalid(api.WireguardPeerList{previous})
+		previousPeers, _, _ = withoutExpired(previousPeers, now)
+
+		// The exit of the previous peer may be gone, in which case it had no rules
+		stale := make(map[rule]struct{})
+		p.createPeerRules(previousPeers[0], stale, nil)
+		for r := range rules {
+			delete(stale, r)
+		}
 
-			err := ipt.Delete(table, p.chain, strings.Split(rule, " ")...)
+		// Stale rules that are missing, eg because they lost a conflict, are cleaned up by the next update anyway
+		if len(stale) > 0 {
+			removed, err := p.backend.remove(stale)
+			p.flushConntrack(removed)
 			if err != nil {
-				log.Printf("error deleting iptables rule")
-				continue
+				lastErr = err
 			}
 		}
 	}
-}
 
-// AddPortforwarding tries to add portforwarding rules for a peer without checking existing ones
-func (p *Portforward) AddPortforwarding(peer api.WireguardPeer) {
-	if len(peer.Ports) < 1 {
-		return
+	var added []rule
+	var addErr error
+	if len(rules) > 0 {
+		var existing int
+		added, existing, addErr = p.backend.add(rules)
+		p.metrics.Count("portforwarding_existing_rules", existing)
+		if addErr != nil {
+			lastErr = addErr
+		}
 	}
 
-	rules := make(map[string]iptables.Protocol)
-	p.createPeerRules(peer, rules)
+	if lastErr != nil && !existed {
+		p.rollback(peer.Pubkey, added)
+		return lastErr
+	}
 
-	// Add new portforwarding rules
-	for rule, protocol := range rules {
-		ipt := p.iptables
-		if protocol == iptables.ProtocolIPv6 {
-			ipt = p.ip6tables
-		}
+	if addErr != nil {
+		return addErr
+	}
 
-		err := ipt.Append(table, p.chain, strings.Split(rule, " ")...)
-		if err != nil {
-			log.Printf("error adding iptables rule")
-			continue
-		}
+	p.setForwards(peer.Pubkey, p.peerForwards(peer, nil))
+
+	return lastErr
+}
+
+// rollback leaves out a new peer that failed, and removes the rules that were added for it
+// Only the added rules are removed, since the rest were never there, and the mappings and pool ports of the peer are kept for when it's added again
+func (p *Portforward) rollback(pubkey string, added []rule) {
+	p.forgetPeer(pubkey)
+	if len(added) == 0 {
+		return
 	}
 
-	return
+	rules := make(map[rule]struct{})
+	for _, r := range added {
+		rules[r] = struct{}{}
+	}
+
+	removed, err := p.backend.remove(rules)
+	p.flushConntrack(removed)
+	if err != nil {
+		log.Printf("error removing the portforwarding rules of peer %s after it failed %s", pubkey, err.Error())
+	}
 }
 
 // RemovePortforwarding tries to remove portforwarding rules for a peer without checking existing ones
-func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) {
+// If the peer was part of a conflict, all rules are updated instead, so that the other peers get the ports the policy allows them
+// All rules are attempted even if one fails, and the last error is returned
+func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) error {
+	p.apply.Lock()
+	defer p.apply.Unlock()
+
+	// The mappings of the peer go away with it
+	peer = p.withPeerMappings(peer)
+	p.removePeer(peer.Pubkey)
+
+	// Ports the peer won or blocked in a conflict may go to the other peers now
+	if p.conflicted(peer.Pubkey) {
+		return p.update()
+	}
+
+	// The rules of expired ports are already gone, or go away on the next expiry, and invalid ports never had any
+	peers, _ := withoutInvalid(api.WireguardPeerList{peer})
+	peers, _, _ = withoutExpired(peers, time.Now())
+	peer = peers[0]
+
 	if len(peer.Ports) < 1 {
+		p.setForwards(peer.Pubkey, nil)
+		return nil
+	}
+
+	rules := make(map[rule]struct{})
+	err := p.createPeerRules(peer, rules, nil)
+	if err != nil {
+		// The peer had no rules, since its exit isn't configured
+		p.setForwards(peer.Pubkey, nil)
+		return err
+	}
+
+	removed, err := p.backend.remove(rules)
+	p.flushConntrack(removed)
+	if err != nil {
+		return err
+	}
+
+	p.setForwards(peer.Pubkey, nil)
+
+	return nil
+}
+
+// flushConntrack deletes the conntrack entries of removed rules, so that established connections stop reaching the peer
+// Errors are logged rather than returned, since the rules themselves were removed
+func (p *Portforward) flushConntrack(removed []rule) {
+	if len(removed) == 0 {
 		return
 	}
 
-	rules := make(map[string]iptables.Protocol)
-	p.createPeerRules(peer, rules)
+	flushed, err := flushConntrack(removed, p.exitAddresses())
+	if err != nil {
+		p.metrics.Increment("portforwarding_conntrack_error")
+		log.Printf("error flushing conntrack entries of removed portforwarding rules %s", err.Error())
+	}
 
-	// Remove old portforwarding rules
-	for rule, protocol := range rules {
-		ipt := p.iptables
-		if protocol == iptables.ProtocolIPv6 {
-			ipt = p.ip6tables
-		}
+	p.metrics.Count("portforwarding_conntrack_flushed", flushed)
+}
 
-		err := ipt.Delete(table, p.chain, strings.Split(rule, " ")...)
-		if err != nil {
-			log.Printf("error deleting iptables rule")
-			continue
-		}
+// createPeerRules adds the rules for a peer, skipping ports the owns function returns false for, if it's not nil
+// It returns an error if the peer is assigned to an exit that isn't configured
+func (p *Portforward) createPeerRules(peer api.WireguardPeer, rules map[rule]struct{}, owns func(portClaim) bool) error {
+	exit, err := p.exit(peer)
+	if err != nil {
+		return err
+	}
+
+	ipv4, ipv6 := peerAddresses(peer)
+
+	if ipv4 != "" {
+		p.addPeerRules(rule{
+			ipset:       exit.IPSetIPv4,
+			destination: ipv4,
+		}, peer.Ports, rules, owns)
+	}
+
+	if ipv6 != "" {
+		p.addPeerRules(rule{
+			ipv6:        true,
+			ipset:       exit.IPSetIPv6,
+			destination: ipv6,
+		}, peer.Ports, rules, owns)
 	}
+
+	return nil
 }
 
-func (p *Portforward) createPeerRules(peer api.WireguardPeer, rules map[string]iptables.Protocol) {
+// exit returns the exit the ports of a peer are forwarded on
+func (p *Portforward) exit(peer api.WireguardPeer) (Exit, error) {
+	if peer.Exit == "" {
+		return p.defaultExit, nil
+	}
+
+	exit, ok := p.exits[peer.Exit]
+	if !ok {
+		return Exit{}, fmt.Errorf("unknown portforwarding exit %s", peer.Exit)
+	}
+
+	return exit, nil
+}
+
+// peerAddresses returns the addresses of a peer that ports are forwarded to, or empty strings for addresses that can't be used
+func peerAddresses(peer api.WireguardPeer) (string, string) {
 	// Ignore ip's with errors, in-case we get bad data from the API
 	ipv4, _, err := net.ParseCIDR(peer.IPv4)
 	if err != nil {
-		return
+		return "", ""
 	}
 
-	tcpRule := fmt.Sprintf("-p tcp -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", p.ipsetIPv4, getPortsString(peer.Ports), ipv4)
-	udpRule := fmt.Sprintf("-p udp -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", p.ipsetIPv4, getPortsString(peer.Ports), ipv4)
-	rules[tcpRule] = iptables.ProtocolIPv4
-	rules[udpRule] = iptables.ProtocolIPv4
-
 	ipv6, _, err := net.ParseCIDR(peer.IPv6)
 	if err != nil {
-		return
+		return ipv4.String(), ""
 	}
 
-	tcpRule = fmt.Sprintf("-p tcp -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", p.ipsetIPv6, getPortsString(peer.Ports), ipv6)
-	udpRule = fmt.Sprintf("-p udp -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", p.ipsetIPv6, getPortsString(peer.Ports), ipv6)
-	rules[tcpRule] = iptables.ProtocolIPv6
-	rules[udpRule] = iptables.ProtocolIPv6
+	return ipv4.String(), ipv6.String()
 }
 
-func getPortsString(ports []int) string {
-	sort.Ints(ports)
+// addPeerRules adds the rules forwarding the ports for both protocols, based on a rule with the family, ipset and destination filled in
+// Ports forwarded to the same port on the peer share a single rule per protocol, while mapped ports need a rule each
+// The traffic to the peer is accepted by a single filter rule per protocol, and hairpinned by a single rule per protocol, if enabled
+func (p *Portforward) addPeerRules(base rule, ports []api.Port, rules map[rule]struct{}, owns func(portClaim) bool) {
+	for _, protocol := range []string{"tcp", "udp"} {
+		var unmapped []int
+		internal := make(map[int]struct{})
 
-	slice := make([]string, len(ports))
-	for i, v := range ports {
-		slice[i] = strconv.Itoa(v)
-	}
+		for _, port := range ports {
+			if !port.HasProtocol(protocol) {
+				continue
+			}
 
-	return strings.Join(slice, ",")
-}
+			if owns != nil && !owns(portClaim{ipv6: base.ipv6, ipset: base.ipset, protocol: protocol, port: port.External}) {
+				continue
+			}
 
-func (p *Portforward) getCurrentRules() (map[string]iptables.Protocol, error) {
-	rules := make(map[string]iptables.Protocol)
+			internal[port.InternalPort()] = struct{}{}
 
-	ipv4Rules, err := p.iptables.List("nat", p.chain)
-	if err != nil {
-		return nil, err
+			if !port.IsMapped() {
+				unmapped = append(unmapped, port.External)
+				continue
+			}
+
+			r := base
+			r.protocol = protocol
+			r.ports = strconv.Itoa(port.External)
+			r.toPort = port.InternalPort()
+			rules[r] = struct{}{}
+		}
+
+		if len(unmapped) > 0 {
+			r := base
+			r.protocol = protocol
+			r.ports = getPortsString(unmapped)
+			rules[r] = struct{}{}
+		}
+
+		if len(internal) == 0 {
+			continue
+		}
+
+		internalPorts := make([]int, 0, len(internal))
+		for port := range internal {
+			internalPorts = append(internalPorts, port)
+		}
+
+		r := rule{
+			ipv6:        base.ipv6,
+			protocol:    protocol,
+			ports:       getPortsString(internalPorts),
+			destination: base.destination,
+		}
+
+		if p.filter {
+			accept := r
+			accept.accept = true
+			rules[accept] = struct{}{}
+		}
+
+		if p.hairpin {
+			hairpin := r
+			hairpin.hairpin = true
+			rules[hairpin] = struct{}{}
+		}
 	}
+}
+
+// forward checks whether the rule forwards ports, rather than accepting or hairpinning the forwarded traffic
+func (r rule) forward() bool {
+	return !r.accept && !r.hairpin
+}
 
-	for _, rule := range p.filterRules(ipv4Rules) {
-		rules[rule] = iptables.ProtocolIPv4
+// target returns the address to forward to, including the port if the ports are mapped
+func (r rule) target() string {
+	if r.toPort == 0 {
+		return r.destination
 	}
 
-	ipv6Rules, err := p.ip6tables.List("nat", p.chain)
+	return net.JoinHostPort(r.destination, strconv.Itoa(r.toPort))
+}
+
+// parseTarget parses an address as returned by target, normalizing it
+func parseTarget(target string) (destination string, toPort int, ok bool) {
+	host, port, err := net.SplitHostPort(target)
 	if err != nil {
-		return nil, err
+		// No port
+		host = target
+		port = ""
 	}
 
-	for _, rule := range p.filterRules(ipv6Rules) {
-		rules[rule] = iptables.ProtocolIPv6
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", 0, false
 	}
 
-	return rules, nil
-}
-
-func (p *Portforward) filterRules(rules []string) []string {
-	// Remove the first entry as it's the rule for creating the chain
-	if len(rules) > 0 {
-		rules = rules[1:]
+	if port != "" {
+		toPort, err = strconv.Atoi(port)
+		if err != nil {
+			return "", 0, false
+		}
 	}
 
-	var filteredRules []string
-	for _, rule := range rules {
-		// Remove the chain name
-		rule = strings.TrimPrefix(rule, fmt.Sprintf("-A %s ", p.chain))
+	return ip.String(), toPort, true
+}
 
-		// Remove the ip masks
-		rule = strings.Replace(rule, "/32", "", -1)
-		rule = strings.Replace(rule, "/128", "", -1)
+func getPortsString(ports []int) string {
+	sort.Ints(ports)
 
-		filteredRules = append(filteredRules, rule)
+	slice := make([]string, len(ports))
+	for i, v := range ports {
+		slice[i] = strconv.Itoa(v)
 	}
 
-	return filteredRules
+	return strings.Join(slice, ",")
 }
@@ -2,6 +2,9 @@ package portforward_test
 
 import (
 	"encoding/base64"
+	"fmt"
+	"net"
+	"os/exec"
 	"strings"
 	"testing"
 
@@ -13,22 +16,24 @@ import (
 )
 
 // Integration tests for portforwarding, not ran in short mode
-// Requires an iptables nat chain named PORTFORWARDING in both iptables and ip6tables
+// Requires an iptables nat chain named PORTFORWARDING in both iptables and ip6tables, and the ipset command
 
 var apiFixture = api.WireguardPeerList{
 	api.WireguardPeer{
 		IPv4:   "10.99.0.1/32",
 		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
-		Ports:  []int{4321, 1234},
+		Ports:  []api.Port{{External: 4321}, {External: 1234}, {External: 51234, Internal: 8080, Protocol: "tcp"}},
 		Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
 	},
 }
 
 var rulesFixture = []string{
-	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
-	"-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 51234 -m comment --comment wg-manager -j DNAT --to-destination 10.99.0.1:8080",
+	"-A PORTFORWARDING -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 51234 -m comment --comment wg-manager -j DNAT --to-destination [fc00:bbbb:bbbb:bb01::1]:8080",
 }
 
 const (
@@ -68,6 +73,23 @@ func TestPortforward(t *testing.T) {
 		}
 	})
 
+	t.Run("leave foreign rules alone", func(t *testing.T) {
+		foreignRule := []string{"-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "DNAT", "--to-destination", "10.0.0.1:22"}
+
+		err := ipts[0].Append(table, chain, foreignRule...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ipts[0].Delete(table, chain, foreignRule...)
+
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{"-A PORTFORWARDING -p tcp -m tcp --dport 22 -j DNAT --to-destination 10.0.0.1:22"}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
 	t.Run("add rules for single peer", func(t *testing.T) {
 		pf.AddPortforwarding(apiFixture[0])
 
@@ -87,6 +109,145 @@ func TestPortforward(t *testing.T) {
 	})
 }
 
+func TestScaffolding(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	const (
+		scaffoldChain     = "PORTFORWARDING_SCAFFOLD"
+		scaffoldIPSetIPv4 = "PORTFORWARDING_SCAFFOLD_IPV4"
+		scaffoldIPSetIPv6 = "PORTFORWARDING_SCAFFOLD_IPV6"
+		scaffoldFilter    = "PORTFORWARDING_SCAFFOLD_ACCEPT"
+		scaffoldHairpin   = "PORTFORWARDING_SCAFFOLD_HAIRPIN"
+	)
+
+	ipts := setupIptables(t)
+	defer func() {
+		for _, ipt := range ipts {
+			ipt.Delete(table, "PREROUTING", "-j", scaffoldChain)
+			ipt.ClearChain(table, scaffoldChain)
+			ipt.DeleteChain(table, scaffoldChain)
+			ipt.Delete("filter", "FORWARD", "-j", scaffoldFilter)
+			ipt.ClearChain("filter", scaffoldFilter)
+			ipt.DeleteChain("filter", scaffoldFilter)
+			ipt.Delete(table, "POSTROUTING", "-j", scaffoldHairpin)
+			ipt.ClearChain(table, scaffoldHairpin)
+			ipt.DeleteChain(table, scaffoldHairpin)
+		}
+		exec.Command("ipset", "destroy", scaffoldIPSetIPv4).Run()
+		exec.Command("ipset", "destroy", scaffoldIPSetIPv6).Run()
+	}()
+
+	pf, err := portforward.NewWithConfig(portforward.Config{
+		Chain:          scaffoldChain,
+		FilterChain:    scaffoldFilter,
+		HairpinChain:   scaffoldHairpin,
+		IPSetIPv4:      scaffoldIPSetIPv4,
+		IPSetIPv6:      scaffoldIPSetIPv6,
+		Create:         true,
+		RelayAddresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkScaffolding := func(t *testing.T) {
+		t.Helper()
+
+		for _, ipt := range ipts {
+			exists, err := ipt.Exists(table, "PREROUTING", "-j", scaffoldChain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !exists {
+				t.Fatal("jump rule does not exist")
+			}
+		}
+
+		for set, address := range map[string]string{scaffoldIPSetIPv4: "192.0.2.1", scaffoldIPSetIPv6: "2001:db8::1"} {
+			err := exec.Command("ipset", "test", set, address).Run()
+			if err != nil {
+				t.Fatalf("%s is not in ipset %s", address, set)
+			}
+		}
+	}
+
+	t.Run("create scaffolding", func(t *testing.T) {
+		checkScaffolding(t)
+	})
+
+	t.Run("repair scaffolding", func(t *testing.T) {
+		for _, ipt := range ipts {
+			err := ipt.Delete(table, "PREROUTING", "-j", scaffoldChain)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := exec.Command("ipset", "flush", scaffoldIPSetIPv4).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+		checkScaffolding(t)
+	})
+
+	t.Run("accept forwarded ports", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+
+		var rules []string
+		for _, ipt := range ipts {
+			listed, err := ipt.List("filter", scaffoldFilter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules = append(rules, listed[1:]...)
+		}
+
+		expected := []string{
+			"-A PORTFORWARDING_SCAFFOLD_ACCEPT -d 10.99.0.1/32 -p tcp -m multiport --dports 1234,4321,8080 -m comment --comment wg-manager -j ACCEPT",
+			"-A PORTFORWARDING_SCAFFOLD_ACCEPT -d 10.99.0.1/32 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager -j ACCEPT",
+			"-A PORTFORWARDING_SCAFFOLD_ACCEPT -d fc00:bbbb:bbbb:bb01::1/128 -p tcp -m multiport --dports 1234,4321,8080 -m comment --comment wg-manager -j ACCEPT",
+			"-A PORTFORWARDING_SCAFFOLD_ACCEPT -d fc00:bbbb:bbbb:bb01::1/128 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager -j ACCEPT",
+		}
+		if diff := cmp.Diff(expected, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+	})
+
+	t.Run("hairpin forwarded ports", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+
+		var rules []string
+		for _, ipt := range ipts {
+			listed, err := ipt.List(table, scaffoldHairpin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules = append(rules, listed[1:]...)
+		}
+
+		expected := []string{
+			"-A PORTFORWARDING_SCAFFOLD_HAIRPIN -s 10.99.0.1/32 -d 10.99.0.1/32 -p tcp -m multiport --dports 1234,4321,8080 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+			"-A PORTFORWARDING_SCAFFOLD_HAIRPIN -s 10.99.0.1/32 -d 10.99.0.1/32 -p udp -m multiport --dports 1234,4321 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+			"-A PORTFORWARDING_SCAFFOLD_HAIRPIN -s fc00:bbbb:bbbb:bb01::1/128 -d fc00:bbbb:bbbb:bb01::1/128 -p tcp -m multiport --dports 1234,4321,8080 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+			"-A PORTFORWARDING_SCAFFOLD_HAIRPIN -s fc00:bbbb:bbbb:bb01::1/128 -d fc00:bbbb:bbbb:bb01::1/128 -p udp -m multiport --dports 1234,4321 -m conntrack --ctstate DNAT -m comment --comment wg-manager -j MASQUERADE",
+		}
+		if diff := cmp.Diff(expected, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+	})
+}
+
 func stringCompare(i string, j string) bool {
 	return i < j
 }
@@ -146,3 +307,58 @@ func TestInvalidIPSet(t *testing.T) {
 		t.Fatal("no error")
 	}
 }
+
+func TestInvalidBackend(t *testing.T) {
+	_, err := portforward.NewWithConfig(portforward.Config{
+		Backend:   "nonexistant",
+		Chain:     chain,
+		IPSetIPv4: ipsetIPv4,
+		IPSetIPv6: ipsetIPv6,
+	})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+// Benchmarks a full reconcile of a large number of peers, alternating between adding and removing all of them
+func BenchmarkUpdatePortforwarding(b *testing.B) {
+	peers := api.WireguardPeerList{}
+	for i := 0; i < 1000; i++ {
+		peers = append(peers, api.WireguardPeer{
+			IPv4:   fmt.Sprintf("10.99.%d.%d/32", i/256, i%256),
+			IPv6:   fmt.Sprintf("fc00:bbbb:bbbb:bb01::%x/128", i),
+			Ports:  []api.Port{{External: 10000 + i}},
+			Pubkey: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%032d", i))),
+		})
+	}
+
+	for _, bm := range []struct {
+		name      string
+		noRestore bool
+	}{
+		{"restore", false},
+		{"rule by rule", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			pf, err := portforward.NewWithConfig(portforward.Config{
+				Chain:     chain,
+				IPSetIPv4: ipsetIPv4,
+				IPSetIPv6: ipsetIPv6,
+				NoRestore: bm.noRestore,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pf.UpdatePortforwarding(api.WireguardPeerList{})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					pf.UpdatePortforwarding(peers)
+				} else {
+					pf.UpdatePortforwarding(api.WireguardPeerList{})
+				}
+			}
+		})
+	}
+}
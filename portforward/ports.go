@@ -0,0 +1,34 @@
+package portforward
+
+import (
+	"log"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// withoutInvalid returns the peers with the ports that fail validation left out, logging them, and how many were left out
+func withoutInvalid(peers api.WireguardPeerList) (api.WireguardPeerList, int) {
+	invalid := 0
+
+	result := make(api.WireguardPeerList, 0, len(peers))
+	for _, peer := range peers {
+		var ports []api.Port
+		for _, port := range peer.Ports {
+			if err := port.Validate(); err != nil {
+				invalid++
+				log.Printf("not forwarding invalid port for peer %s: %s", peer.Pubkey, err.Error())
+				continue
+			}
+
+			ports = append(ports, port)
+		}
+
+		if len(ports) != len(peer.Ports) {
+			peer.Ports = ports
+		}
+
+		result = append(result, peer)
+	}
+
+	return result, invalid
+}
@@ -0,0 +1,35 @@
+package portforward
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestWithoutInvalid(t *testing.T) {
+	peers := api.WireguardPeerList{
+		{Pubkey: "aaaa", Ports: []api.Port{{External: 1234}, {External: 1235, Protocol: "sctp"}, {External: 1236, Protocol: "udp"}}},
+		{Pubkey: "bbbb", Ports: []api.Port{{External: 0}, {External: 65536}, {External: 4321, Internal: 70000}}},
+		{Pubkey: "cccc", Ports: []api.Port{{External: 65535, Internal: 1}}},
+	}
+
+	result, invalid := withoutInvalid(peers)
+
+	expected := api.WireguardPeerList{
+		{Pubkey: "aaaa", Ports: []api.Port{{External: 1234}, {External: 1236, Protocol: "udp"}}},
+		{Pubkey: "bbbb"},
+		{Pubkey: "cccc", Ports: []api.Port{{External: 65535, Internal: 1}}},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if invalid != 4 {
+		t.Errorf("got %d invalid ports, expected 4", invalid)
+	}
+
+	if len(peers[0].Ports) != 3 {
+		t.Error("the given peers were modified")
+	}
+}
@@ -0,0 +1,438 @@
+// Package reconcile applies peers to the wireguard interfaces and the portforwarding rules together,
+// so that a peer never has ports forwarded without a tunnel, or a tunnel without its forwarded ports
+package reconcile
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Actions a peer can be pending for
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+	ActionSync   = "sync"
+)
+
+// Tunnels configures the peers on the wireguard interfaces, which is implemented by wireguard.Wireguard
+type Tunnels interface {
+	UpdatePeers(peers api.WireguardPeerList) (failed map[string]error, invalid map[string]error)
+	AddPeer(peer api.WireguardPeer) error
+	RemovePeer(peer api.WireguardPeer) error
+}
+
+// Forwards configures the portforwarding rules of the peers, which is implemented by portforward.Portforward
+// AddPortforwarding leaves nothing of a peer it didn't have behind if it fails, so such a peer only needs its tunnel rolled back
+type Forwards interface {
+	UpdatePortforwarding(peers api.WireguardPeerList) error
+	AddPortforwarding(peer api.WireguardPeer) error
+	RemovePortforwarding(peer api.WireguardPeer) error
+}
+
+// Backoff between retries of a pending peer, doubling with every failed attempt
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Pending is a peer that was left partially applied, and is retried with backoff until it's applied,
+// or until a synchronization applies it
+// An empty public key stands for the rules of all peers, when they couldn't be applied during a synchronization
+type Pending struct {
+	Pubkey string `json:"pubkey"`
+	// Action is what was being done to the peer when it failed
+	Action string    `json:"action"`
+	Error  string    `json:"error"`
+	Since  time.Time `json:"since"`
+	// Attempts is the number of times applying the peer failed
+	Attempts  int       `json:"attempts"`
+	NextRetry time.Time `json:"next_retry"`
+
+	// peer is the peer as it should be applied, or as it was applied if it's being removed
+	peer api.WireguardPeer
+}
+
+// Reconciler applies the peers to both the tunnels and the forwards, and keeps track of the peers that failed
+type Reconciler struct {
+	tunnels  Tunnels
+	forwards Forwards
+	metrics  *statsd.Client
+
+	mu sync.Mutex
+	// applied are the peers last applied to the tunnels, keyed by public key
+	applied map[string]api.WireguardPeer
+	pending map[string]Pending
+	// synchronized is whether the full list of peers was applied, before which peers not in applied may still be configured
+	synchronized bool
+	// forwardsPending is set when the rules of all peers couldn't be applied, which is retried as a single full update rather than per peer
+	forwardsPending *Pending
+}
+
+// New returns a new Reconciler, if metrics is nil no metrics are sent
+func New(tunnels Tunnels, forwards Forwards, metrics *statsd.Client) (*Reconciler, error) {
+	if metrics == nil {
+		var err error
+		metrics, err = statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Reconciler{
+		tunnels:  tunnels,
+		forwards: forwards,
+		metrics:  metrics,
+		applied:  make(map[string]api.WireguardPeer),
+		pending:  make(map[string]Pending),
+	}, nil
+}
+
+// Synchronize applies the full list of peers, and returns the peers that have a working tunnel
+// Peers whose tunnel couldn't be configured keep the ports they had forwarded before, or get none if they're new,
+// and are marked as pending, while the rules of all peers are retried together if they couldn't be applied
+func (r *Reconciler) Synchronize(peers api.WireguardPeerList) api.WireguardPeerList {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.metrics.NewTiming()
+	failed, invalid := r.tunnels.UpdatePeers(peers)
+	t.Send("update_peers_time")
+
+	now := time.Now()
+	wanted := make(map[string]api.WireguardPeer)
+	applied := make(map[string]api.WireguardPeer)
+	var forwarded, tunneled api.WireguardPeerList
+	for _, peer := range peers {
+		// Peers that can't be parsed are never configured, retrying them wouldn't help
+		if _, ok := invalid[peer.Pubkey]; ok {
+			continue
+		}
+
+		wanted[peer.Pubkey] = peer
+
+		if _, ok := failed[peer.Pubkey]; !ok {
+			applied[peer.Pubkey] = peer
+			forwarded = append(forwarded, peer)
+			tunneled = append(tunneled, peer)
+			continue
+		}
+
+		// The tunnel is left as it was, so the forwards are too
+		if previous, ok := r.applied[peer.Pubkey]; ok {
+			applied[peer.Pubkey] = previous
+			forwarded = append(forwarded, previous)
+			tunneled = append(tunneled, previous)
+		}
+	}
+
+	pending := make(map[string]Pending)
+	for pubkey, err := range failed {
+		if peer, ok := wanted[pubkey]; ok {
+			r.markPending(pending, peer, ActionSync, err, now)
+			continue
+		}
+
+		// Peers that couldn't be removed still have their tunnel, but their forwards are removed along with the rest of the peer
+		peer, ok := r.applied[pubkey]
+		if !ok {
+			peer = api.WireguardPeer{Pubkey: pubkey}
+		}
+
+		r.markPending(pending, peer, ActionRemove, err, now)
+	}
+
+	t = r.metrics.NewTiming()
+	err := r.forwards.UpdatePortforwarding(forwarded)
+	t.Send("update_portforwarding_time")
+	if err != nil {
+		r.markForwardsPending(err, now)
+	} else {
+		r.forwardsPending = nil
+	}
+
+	r.applied = applied
+	r.pending = pending
+	r.synchronized = true
+	r.report()
+
+	return tunneled
+}
+
+// AddPeer applies a single peer to the tunnels, and then to the forwards, unless it's already applied as it is
+// If the tunnel can't be configured it's rolled back to how it was, and no ports are forwarded
+// If the ports of a new peer can't be forwarded, the peer is removed again, while an existing peer keeps its tunnel
+// The peer is marked as pending, and retried, whenever it fails, even if it was rolled back
+// The peer whose tunnel is left configured is returned, which is the previous one after a rollback,
+// and configured is false only if the peer has no tunnel at all
+func (r *Reconciler) AddPeer(peer api.WireguardPeer) (applied api.WireguardPeer, configured bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, existed := r.applied[peer.Pubkey]
+
+	// Events can be delivered more than once, and a peer that's fully applied as it is needs nothing done
+	if _, pending := r.pending[peer.Pubkey]; existed && !pending && reflect.DeepEqual(previous, peer) {
+		r.metrics.Increment("event_noop_add")
+		return peer, true, nil
+	}
+
+	err = r.tunnels.AddPeer(peer)
+	if err != nil {
+		// Other interfaces may have been configured
+		var rollbackErr error
+		if existed {
+			rollbackErr = r.tunnels.AddPeer(previous)
+		} else {
+			rollbackErr = r.tunnels.RemovePeer(peer)
+		}
+
+		r.markPending(r.pending, peer, ActionAdd, err, time.Now())
+		r.report()
+
+		// A peer that couldn't be rolled back may be configured on some of the interfaces
+		if rollbackErr != nil {
+			return peer, true, err
+		}
+
+		r.metrics.Increment("reconcile_rollbacks")
+		return previous, existed, err
+	}
+
+	err = r.forwards.AddPortforwarding(peer)
+	if err != nil {
+		if !existed {
+			// The rules that were added were removed again by the forwards, keeping the mappings and pool ports of the peer
+			rollbackErr := r.tunnels.RemovePeer(peer)
+			if rollbackErr == nil {
+				r.metrics.Increment("reconcile_rollbacks")
+				r.markPending(r.pending, peer, ActionAdd, err, time.Now())
+				r.report()
+				return api.WireguardPeer{}, false, err
+			}
+		}
+
+		r.applied[peer.Pubkey] = peer
+		r.markPending(r.pending, peer, ActionAdd, err, time.Now())
+		r.report()
+		return peer, true, err
+	}
+
+	r.applied[peer.Pubkey] = peer
+	delete(r.pending, peer.Pubkey)
+	r.report()
+
+	return peer, true, nil
+}
+
+// RemovePeer removes a single peer from the forwards, and then from the tunnels, unless it's already removed
+// The tunnel is removed even if the forwards couldn't be, so that the peer loses access right away,
+// and the peer is marked as pending if either is left behind
+func (r *Reconciler) RemovePeer(peer api.WireguardPeer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The peer is removed as it was applied, in case it changed since
+	previous, existed := r.applied[peer.Pubkey]
+	if _, pending := r.pending[peer.Pubkey]; !existed && !pending && r.synchronized {
+		r.metrics.Increment("event_noop_remove")
+		return nil
+	}
+
+	if existed {
+		peer = previous
+	}
+
+	forwardsErr := r.forwards.RemovePortforwarding(peer)
+	tunnelErr := r.tunnels.RemovePeer(peer)
+
+	err := forwardsErr
+	if tunnelErr != nil {
+		err = tunnelErr
+	}
+
+	delete(r.applied, peer.Pubkey)
+	if err != nil {
+		r.markPending(r.pending, peer, ActionRemove, err, time.Now())
+	} else {
+		delete(r.pending, peer.Pubkey)
+	}
+
+	r.report()
+
+	return err
+}
+
+// Retry applies the pending peers whose backoff has passed at the given time,
+// and returns the peers that now have a working tunnel and the peers that are now fully removed
+// Pending peers are applied to the tunnels and then the forwards, or removed from both, without rolling back,
+// as the peer is already partially applied, and the ones that fail again are retried after a longer backoff
+// Peers are only applied again if claim accepts them, as their addresses may have been taken since they failed,
+// and the ones it rejects are no longer retried
+// Rules that couldn't be applied during a synchronization are then updated for all applied peers at once
+func (r *Reconciler) Retry(now time.Time, claim func(peer api.WireguardPeer) error) (tunneled api.WireguardPeerList, removed api.WireguardPeerList) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for pubkey, pending := range r.pending {
+		if now.Before(pending.NextRetry) {
+			continue
+		}
+
+		var err error
+		if pending.Action == ActionRemove {
+			err = r.forwards.RemovePortforwarding(pending.peer)
+			if tunnelErr := r.tunnels.RemovePeer(pending.peer); tunnelErr != nil {
+				err = tunnelErr
+			}
+		} else {
+			err = claim(pending.peer)
+			if err != nil {
+				r.metrics.Increment("retry_rejected")
+				log.Printf("not retrying peer %s: %s", pubkey, err.Error())
+				delete(r.pending, pubkey)
+				continue
+			}
+
+			err = r.tunnels.AddPeer(pending.peer)
+			if err == nil {
+				r.applied[pubkey] = pending.peer
+				tunneled = append(tunneled, pending.peer)
+				err = r.forwards.AddPortforwarding(pending.peer)
+			}
+		}
+
+		if err != nil {
+			r.metrics.Increment("retry_failure")
+			r.markPending(r.pending, pending.peer, pending.Action, err, now)
+			continue
+		}
+
+		r.metrics.Increment("retry_success")
+		log.Printf("peer %s applied after %d failed attempts", pubkey, pending.Attempts)
+		delete(r.pending, pubkey)
+
+		if pending.Action == ActionRemove {
+			removed = append(removed, pending.peer)
+		}
+	}
+
+	if r.forwardsPending != nil && !now.Before(r.forwardsPending.NextRetry) {
+		peers := make(api.WireguardPeerList, 0, len(r.applied))
+		for _, peer := range r.applied {
+			peers = append(peers, peer)
+		}
+
+		sort.Slice(peers, func(i int, j int) bool {
+			return peers[i].Pubkey < peers[j].Pubkey
+		})
+
+		err := r.forwards.UpdatePortforwarding(peers)
+		if err != nil {
+			r.metrics.Increment("retry_failure")
+			r.markForwardsPending(err, now)
+		} else {
+			r.metrics.Increment("retry_success")
+			log.Printf("portforwarding rules applied after %d failed attempts", r.forwardsPending.Attempts)
+			r.forwardsPending = nil
+		}
+	}
+
+	r.report()
+
+	return tunneled, removed
+}
+
+// Pending returns the peers that were left partially applied, ordered by public key, after the rules of all peers if they're pending
+func (r *Reconciler) Pending() []Pending {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending := make([]Pending, 0, len(r.pending)+1)
+	for _, p := range r.pending {
+		pending = append(pending, p)
+	}
+
+	if r.forwardsPending != nil {
+		pending = append(pending, *r.forwardsPending)
+	}
+
+	sort.Slice(pending, func(i int, j int) bool {
+		return pending[i].Pubkey < pending[j].Pubkey
+	})
+
+	return pending
+}
+
+// markPending marks a peer as pending, keeping the time it first became pending, and schedules its next retry
+func (r *Reconciler) markPending(pending map[string]Pending, peer api.WireguardPeer, action string, err error, now time.Time) {
+	since := now
+	attempts := 1
+	if previous, ok := r.pending[peer.Pubkey]; ok {
+		since = previous.Since
+		attempts = previous.Attempts + 1
+	}
+
+	backoff := backoff(attempts)
+	log.Printf("peer %s is partially applied, retrying in %s: %s", peer.Pubkey, backoff, err.Error())
+
+	pending[peer.Pubkey] = Pending{
+		Pubkey:    peer.Pubkey,
+		Action:    action,
+		Error:     err.Error(),
+		Since:     since,
+		Attempts:  attempts,
+		NextRetry: now.Add(backoff),
+		peer:      peer,
+	}
+}
+
+// markForwardsPending marks the rules of all peers as pending, keeping the time they first became pending, and schedules the next retry
+func (r *Reconciler) markForwardsPending(err error, now time.Time) {
+	since := now
+	attempts := 1
+	if r.forwardsPending != nil {
+		since = r.forwardsPending.Since
+		attempts = r.forwardsPending.Attempts + 1
+	}
+
+	backoff := backoff(attempts)
+	log.Printf("portforwarding rules are partially applied, retrying in %s: %s", backoff, err.Error())
+
+	r.forwardsPending = &Pending{
+		Action:    ActionSync,
+		Error:     err.Error(),
+		Since:     since,
+		Attempts:  attempts,
+		NextRetry: now.Add(backoff),
+	}
+}
+
+// backoff returns how long to wait before the next retry, after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	return backoff
+}
+
+func (r *Reconciler) report() {
+	r.metrics.Gauge("reconcile_pending_peers", len(r.pending))
+
+	forwardsPending := 0
+	if r.forwardsPending != nil {
+		forwardsPending = 1
+	}
+	r.metrics.Gauge("reconcile_pending_forwards", forwardsPending)
+}
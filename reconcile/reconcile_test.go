@@ -0,0 +1,418 @@
+package reconcile_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/reconcile"
+)
+
+var errFailed = errors.New("failed")
+
+// accept lets every peer be retried
+func accept(peer api.WireguardPeer) error {
+	return nil
+}
+
+// fakeTunnels and fakeForwards keep the peers they were given, and fail for the peers in fail
+// fakeTunnels never configures the peers in invalid, like peers that can't be parsed, and fails to add the peers in failOnce once
+type fakeTunnels struct {
+	peers    map[string]api.WireguardPeer
+	fail     map[string]bool
+	failOnce map[string]bool
+	invalid  map[string]bool
+	calls    int
+}
+
+func (f *fakeTunnels) UpdatePeers(peers api.WireguardPeerList) (map[string]error, map[string]error) {
+	failed := make(map[string]error)
+	invalid := make(map[string]error)
+	next := make(map[string]api.WireguardPeer)
+	for pubkey, peer := range f.peers {
+		if f.fail[pubkey] {
+			next[pubkey] = peer
+		}
+	}
+
+	for _, peer := range peers {
+		if f.invalid[peer.Pubkey] {
+			invalid[peer.Pubkey] = errFailed
+			continue
+		}
+
+		if f.fail[peer.Pubkey] {
+			failed[peer.Pubkey] = errFailed
+			continue
+		}
+
+		next[peer.Pubkey] = peer
+	}
+
+	f.peers = next
+	return failed, invalid
+}
+
+func (f *fakeTunnels) AddPeer(peer api.WireguardPeer) error {
+	f.calls++
+	if f.fail[peer.Pubkey] {
+		return errFailed
+	}
+
+	if f.failOnce[peer.Pubkey] {
+		delete(f.failOnce, peer.Pubkey)
+		return errFailed
+	}
+
+	f.peers[peer.Pubkey] = peer
+	return nil
+}
+
+func (f *fakeTunnels) RemovePeer(peer api.WireguardPeer) error {
+	f.calls++
+	delete(f.peers, peer.Pubkey)
+	return nil
+}
+
+type fakeForwards struct {
+	peers map[string]api.WireguardPeer
+	fail  map[string]bool
+	// failUpdate fails every update of all peers, which are counted in updates
+	failUpdate bool
+	updates    int
+}
+
+func (f *fakeForwards) UpdatePortforwarding(peers api.WireguardPeerList) error {
+	f.updates++
+	if f.failUpdate {
+		return errFailed
+	}
+
+	f.peers = make(map[string]api.WireguardPeer)
+	for _, peer := range peers {
+		f.peers[peer.Pubkey] = peer
+	}
+
+	return nil
+}
+
+func (f *fakeForwards) AddPortforwarding(peer api.WireguardPeer) error {
+	// The rules are partially added before failing, unless the peer is new, whose rules are removed again
+	_, existed := f.peers[peer.Pubkey]
+	f.peers[peer.Pubkey] = peer
+	if f.fail[peer.Pubkey] {
+		if !existed {
+			delete(f.peers, peer.Pubkey)
+		}
+
+		return errFailed
+	}
+
+	return nil
+}
+
+func (f *fakeForwards) RemovePortforwarding(peer api.WireguardPeer) error {
+	if f.fail[peer.Pubkey] {
+		return errFailed
+	}
+
+	delete(f.peers, peer.Pubkey)
+	return nil
+}
+
+var (
+	peerA = api.WireguardPeer{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::1/128", Ports: []api.Port{{External: 1234}}, Pubkey: "aaaa"}
+	peerB = api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Ports: []api.Port{{External: 5678}}, Pubkey: "bbbb"}
+)
+
+func newTestReconciler(t *testing.T) (*reconcile.Reconciler, *fakeTunnels, *fakeForwards) {
+	tunnels := &fakeTunnels{peers: make(map[string]api.WireguardPeer), fail: make(map[string]bool), failOnce: make(map[string]bool), invalid: make(map[string]bool)}
+	forwards := &fakeForwards{peers: make(map[string]api.WireguardPeer), fail: make(map[string]bool)}
+
+	r, err := reconcile.New(tunnels, forwards, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, tunnels, forwards
+}
+
+func pubkeys(peers map[string]api.WireguardPeer) []string {
+	var keys []string
+	for _, pubkey := range []string{"aaaa", "bbbb"} {
+		if _, ok := peers[pubkey]; ok {
+			keys = append(keys, pubkey)
+		}
+	}
+
+	return keys
+}
+
+func TestSynchronize(t *testing.T) {
+	r, tunnels, forwards := newTestReconciler(t)
+
+	r.Synchronize(api.WireguardPeerList{peerA})
+
+	// The tunnel of a peer that fails keeps its previous configuration, and so do its forwards, while a new peer gets none
+	tunnels.fail["aaaa"] = true
+	tunnels.fail["bbbb"] = true
+	changed := peerA
+	changed.Ports = []api.Port{{External: 4321}}
+
+	tunneled := r.Synchronize(api.WireguardPeerList{changed, peerB})
+	if diff := cmp.Diff(api.WireguardPeerList{peerA}, tunneled); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]api.WireguardPeer{"aaaa": peerA}, forwards.peers); diff != "" {
+		t.Errorf("unexpected forwards (-want +got):\n%s", diff)
+	}
+
+	if pending := r.Pending(); len(pending) != 2 || pending[0].Action != reconcile.ActionSync {
+		t.Errorf("unexpected pending peers %v", pending)
+	}
+
+	// The next synchronization clears the peers that succeed
+	tunnels.fail = map[string]bool{}
+	r.Synchronize(api.WireguardPeerList{changed, peerB})
+	if pending := r.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending peers %v", pending)
+	}
+
+	// Peers that can't be parsed are neither tunneled nor retried
+	tunnels.invalid["bbbb"] = true
+	tunneled = r.Synchronize(api.WireguardPeerList{changed, peerB})
+	if diff := cmp.Diff(api.WireguardPeerList{changed}, tunneled); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if pending := r.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending peers %v", pending)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	r, tunnels, forwards := newTestReconciler(t)
+
+	// A new peer whose tunnel fails gets no forwards, and is retried
+	tunnels.fail["aaaa"] = true
+	if _, configured, err := r.AddPeer(peerA); err == nil || configured {
+		t.Errorf("got error %v, and the peer configured %t", err, configured)
+	}
+
+	if pending := r.Pending(); len(forwards.peers) != 0 || len(pending) != 1 || pending[0].Action != reconcile.ActionAdd {
+		t.Errorf("unexpected forwards %v and pending peers %v", forwards.peers, pending)
+	}
+
+	// A new peer whose forwards fail is rolled back completely, and is retried
+	tunnels.fail = map[string]bool{}
+	forwards.fail["aaaa"] = true
+	if _, configured, err := r.AddPeer(peerA); err == nil || configured {
+		t.Errorf("got error %v, and the peer configured %t", err, configured)
+	}
+
+	if pending := r.Pending(); len(tunnels.peers) != 0 || len(forwards.peers) != 0 || len(pending) != 1 || pending[0].Action != reconcile.ActionAdd {
+		t.Errorf("peer left behind, tunnels %v, forwards %v, pending %v", pubkeys(tunnels.peers), pubkeys(forwards.peers), pending)
+	}
+
+	// An existing peer whose forwards fail keeps its tunnel, and is marked as pending
+	forwards.fail = map[string]bool{}
+	if _, _, err := r.AddPeer(peerA); err != nil {
+		t.Fatal(err)
+	}
+
+	forwards.fail["aaaa"] = true
+	changed := peerA
+	changed.Ports = []api.Port{{External: 4321}}
+	applied, configured, err := r.AddPeer(changed)
+	if err == nil || !configured {
+		t.Errorf("got error %v, and the peer configured %t", err, configured)
+	}
+
+	if diff := cmp.Diff(changed, applied); diff != "" {
+		t.Errorf("unexpected applied peer (-want +got):\n%s", diff)
+	}
+
+	pending := r.Pending()
+	if len(pending) != 1 || pending[0].Pubkey != "aaaa" || pending[0].Action != reconcile.ActionAdd {
+		t.Errorf("unexpected pending peers %v", pending)
+	}
+
+	if _, ok := tunnels.peers["aaaa"]; !ok {
+		t.Error("the tunnel of an existing peer was removed")
+	}
+
+	// An existing peer whose tunnel fails is rolled back to how it was applied
+	forwards.fail = map[string]bool{}
+	tunnels.failOnce["aaaa"] = true
+	applied, configured, err = r.AddPeer(peerA)
+	if err == nil || !configured {
+		t.Errorf("got error %v, and the peer configured %t", err, configured)
+	}
+
+	if diff := cmp.Diff(changed, applied); diff != "" {
+		t.Errorf("unexpected applied peer (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(changed, tunnels.peers["aaaa"]); diff != "" {
+		t.Errorf("unexpected tunnel (-want +got):\n%s", diff)
+	}
+
+	// Removing the peer removes it as it was applied, and clears it
+	if err := r.RemovePeer(api.WireguardPeer{Pubkey: "aaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tunnels.peers) != 0 || len(forwards.peers) != 0 || len(r.Pending()) != 0 {
+		t.Errorf("peer left behind, tunnels %v, forwards %v, pending %v", pubkeys(tunnels.peers), pubkeys(forwards.peers), r.Pending())
+	}
+}
+
+func TestIdempotentEvents(t *testing.T) {
+	r, tunnels, _ := newTestReconciler(t)
+
+	// Before the first synchronization, peers that aren't known may still be configured
+	if err := r.RemovePeer(peerB); err != nil || tunnels.calls != 1 {
+		t.Errorf("got %d calls and error %v removing an unknown peer before synchronizing", tunnels.calls, err)
+	}
+
+	r.Synchronize(api.WireguardPeerList{peerA})
+	tunnels.calls = 0
+
+	if _, _, err := r.AddPeer(peerA); err != nil || tunnels.calls != 0 {
+		t.Errorf("got %d calls and error %v adding an applied peer", tunnels.calls, err)
+	}
+
+	if err := r.RemovePeer(peerB); err != nil || tunnels.calls != 0 {
+		t.Errorf("got %d calls and error %v removing an unknown peer", tunnels.calls, err)
+	}
+
+	if _, _, err := r.AddPeer(peerB); err != nil || tunnels.calls != 1 {
+		t.Errorf("got %d calls and error %v adding a new peer", tunnels.calls, err)
+	}
+
+	if err := r.RemovePeer(peerB); err != nil || tunnels.calls != 2 {
+		t.Errorf("got %d calls and error %v removing an applied peer", tunnels.calls, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r, tunnels, forwards := newTestReconciler(t)
+	r.Synchronize(api.WireguardPeerList{peerA})
+
+	// The tunnel fails along with its rollback, so the peer is left pending
+	tunnels.fail["aaaa"] = true
+	changed := peerA
+	changed.Ports = []api.Port{{External: 4321}}
+	if applied, configured, err := r.AddPeer(changed); err == nil || !configured || applied.Ports[0].External != 4321 {
+		t.Errorf("got error %v, and the peer %v configured %t", err, applied, configured)
+	}
+
+	pending := r.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected pending peers %v", pending)
+	}
+
+	// Nothing is retried before the backoff has passed
+	start := pending[0].NextRetry.Add(-time.Second)
+	if tunneled, _ := r.Retry(start.Add(-time.Millisecond), accept); len(tunneled) != 0 || r.Pending()[0].Attempts != 1 {
+		t.Errorf("retried before the backoff passed, got %v", r.Pending())
+	}
+
+	// A failed retry backs off for longer
+	if tunneled, _ := r.Retry(start.Add(time.Second), accept); len(tunneled) != 0 {
+		t.Errorf("unexpected peers %v", tunneled)
+	}
+
+	pending = r.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 2 || !pending[0].NextRetry.Equal(start.Add(3*time.Second)) {
+		t.Errorf("unexpected pending peers %v", pending)
+	}
+
+	// Once the tunnel works, the peer is applied to both the tunnels and the forwards
+	tunnels.fail = map[string]bool{}
+	tunneled, _ := r.Retry(start.Add(time.Hour), accept)
+	if diff := cmp.Diff(api.WireguardPeerList{changed}, tunneled); diff != "" {
+		t.Errorf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	if len(r.Pending()) != 0 {
+		t.Errorf("unexpected pending peers %v", r.Pending())
+	}
+
+	if diff := cmp.Diff(changed, tunnels.peers["aaaa"]); diff != "" {
+		t.Errorf("unexpected tunnel (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(changed, forwards.peers["aaaa"]); diff != "" {
+		t.Errorf("unexpected forwards (-want +got):\n%s", diff)
+	}
+}
+
+func TestRetryClaims(t *testing.T) {
+	r, tunnels, forwards := newTestReconciler(t)
+	r.Synchronize(api.WireguardPeerList{peerA})
+
+	// A peer whose addresses were taken since it failed is no longer retried
+	tunnels.fail["bbbb"] = true
+	if _, _, err := r.AddPeer(peerB); err == nil {
+		t.Error("expected an error")
+	}
+
+	tunnels.fail = map[string]bool{}
+	reject := func(peer api.WireguardPeer) error {
+		return errFailed
+	}
+
+	tunneled, _ := r.Retry(r.Pending()[0].NextRetry, reject)
+	if len(tunneled) != 0 || len(r.Pending()) != 0 {
+		t.Errorf("unexpected peers %v and pending peers %v", tunneled, r.Pending())
+	}
+
+	if _, ok := tunnels.peers["bbbb"]; ok {
+		t.Error("a rejected peer was configured")
+	}
+
+	// A peer that's removed by a retry is returned, so its addresses can be released
+	forwards.fail["aaaa"] = true
+	if err := r.RemovePeer(peerA); err == nil {
+		t.Error("expected an error")
+	}
+
+	forwards.fail = map[string]bool{}
+	_, removed := r.Retry(r.Pending()[0].NextRetry, accept)
+	if diff := cmp.Diff(api.WireguardPeerList{peerA}, removed); diff != "" {
+		t.Errorf("unexpected removed peers (-want +got):\n%s", diff)
+	}
+}
+
+func TestRetryForwards(t *testing.T) {
+	r, _, forwards := newTestReconciler(t)
+
+	// The rules of all peers are retried together, rather than once per peer
+	forwards.failUpdate = true
+	r.Synchronize(api.WireguardPeerList{peerA, peerB})
+
+	pending := r.Pending()
+	if len(pending) != 1 || pending[0].Pubkey != "" || pending[0].Action != reconcile.ActionSync {
+		t.Fatalf("unexpected pending peers %v", pending)
+	}
+
+	forwards.updates = 0
+	r.Retry(pending[0].NextRetry, accept)
+	if pending := r.Pending(); forwards.updates != 1 || len(pending) != 1 || pending[0].Attempts != 2 {
+		t.Errorf("got %d updates and pending peers %v", forwards.updates, pending)
+	}
+
+	forwards.failUpdate = false
+	r.Retry(r.Pending()[0].NextRetry, accept)
+	if len(r.Pending()) != 0 {
+		t.Errorf("unexpected pending peers %v", r.Pending())
+	}
+
+	if diff := cmp.Diff([]string{"aaaa", "bbbb"}, pubkeys(forwards.peers)); diff != "" {
+		t.Errorf("unexpected forwards (-want +got):\n%s", diff)
+	}
+}
@@ -43,15 +43,27 @@ func New(interfaces []string, metrics *statsd.Client) (*Wireguard, error) {
 }
 
 // UpdatePeers updates the configuration of the wireguard interfaces to match the given list of peers
-func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
-	peerMap := w.mapPeers(peers)
+// The peers that couldn't be configured on every interface are returned, keyed by public key, along with the last error for each
+// Peers that can't be parsed are never configured, and are returned separately, since retrying them would never succeed
+func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) (failed map[string]error, invalid map[string]error) {
+	peerMap, invalid := w.mapPeers(peers)
+	for _, err := range invalid {
+		log.Print(err)
+	}
+	w.metrics.Gauge("invalid_peers", len(invalid))
+
+	failed = make(map[string]error)
 
 	var connectedPeers int
 	for _, d := range w.interfaces {
 		device, err := w.client.Device(d)
 		// Log an error, but move on, so that one broken wireguard interface doesn't prevent us from configuring the rest
 		if err != nil {
-			log.Printf("error connecting to wireguard interface %s: %s", d, err.Error())
+			err = fmt.Errorf("error connecting to wireguard interface %s: %s", d, err.Error())
+			log.Print(err)
+			for key := range peerMap {
+				failed[key.String()] = err
+			}
 			continue
 		}
 
@@ -66,11 +78,11 @@ func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
 		// Update peers that exist in the wireguard config but has changed
 		for key, allowedIPs := range peerMap {
 			existingPeer, ok := existingPeerMap[key]
-			if !ok || !iputil.EqualIPNet(allowedIPs, existingPeer.AllowedIPs) {
+			if !ok || !equalAllowedIPs(allowedIPs, existingPeer.AllowedIPs) {
 				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
 					PublicKey:         key,
 					ReplaceAllowedIPs: true,
-					AllowedIPs:        allowedIPs,
+					AllowedIPs:        allowedIPs.IPNets(),
 				})
 			}
 		}
@@ -121,7 +133,11 @@ func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			err = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Print(err)
+			for _, peer := range cfgPeers {
+				failed[peer.PublicKey.String()] = err
+			}
 			continue
 		}
 
@@ -136,35 +152,57 @@ func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			err = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Print(err)
+			for _, peer := range resetPeers {
+				failed[peer.PublicKey.String()] = err
+			}
 			continue
 		}
 	}
 
 	// Send metrics
 	w.metrics.Gauge("connected_peers", connectedPeers)
+
+	return failed, invalid
 }
 
 // Take the wireguard peers and convert them into a map for easier comparison
-func (w *Wireguard) mapPeers(peers api.WireguardPeerList) (peerMap map[wgtypes.Key][]net.IPNet) {
-	peerMap = make(map[wgtypes.Key][]net.IPNet)
+// Peers with errors are left out, in-case we get bad data from the API, and returned keyed by their public key as given
+func (w *Wireguard) mapPeers(peers api.WireguardPeerList) (peerMap map[wgtypes.Key]iputil.PrefixSet, invalid map[string]error) {
+	peerMap = make(map[wgtypes.Key]iputil.PrefixSet)
+	invalid = make(map[string]error)
 
-	// Ignore peers with errors, in-case we get bad data from the API
 	for _, peer := range peers {
 		key, ipv4, ipv6, err := parsePeer(peer)
 		if err != nil {
+			invalid[peer.Pubkey] = fmt.Errorf("invalid peer %s: %s", peer.Pubkey, err.Error())
 			continue
 		}
 
-		peerMap[key] = []net.IPNet{
-			*ipv4,
-			*ipv6,
+		allowedIPs, err := iputil.PrefixSetFromIPNets([]net.IPNet{*ipv4, *ipv6})
+		if err != nil {
+			invalid[peer.Pubkey] = fmt.Errorf("invalid peer %s: %s", peer.Pubkey, err.Error())
+			continue
 		}
+
+		peerMap[key] = allowedIPs
 	}
 
 	return
 }
 
+// Whether the allowed IPs of an existing peer match the ones from the API
+// Allowed IPs that can't be parsed never match, so that they're replaced
+func equalAllowedIPs(allowedIPs iputil.PrefixSet, existing []net.IPNet) bool {
+	existingSet, err := iputil.PrefixSetFromIPNets(existing)
+	if err != nil {
+		return false
+	}
+
+	return allowedIPs.Equal(existingSet)
+}
+
 // Take the existing wireguard peers and convert them into a map for easier comparison
 func mapExistingPeers(peers []wgtypes.Peer) (peerMap map[wgtypes.Key]wgtypes.Peer) {
 	peerMap = make(map[wgtypes.Key]wgtypes.Peer)
@@ -204,12 +242,20 @@ func needsReset(peer wgtypes.Peer) bool {
 }
 
 // AddPeer adds the given peer to the wireguard interfaces, without checking the existing configuration
-func (w *Wireguard) AddPeer(peer api.WireguardPeer) {
+// Peers that are already applied are skipped by the caller, which keeps track of what it applied
+// All interfaces are configured even if one fails, and the last error is returned
+func (w *Wireguard) AddPeer(peer api.WireguardPeer) error {
 	key, ipv4, ipv6, err := parsePeer(peer)
 	if err != nil {
-		return
+		return err
+	}
+
+	allowedIPs, err := iputil.PrefixSetFromIPNets([]net.IPNet{*ipv4, *ipv6})
+	if err != nil {
+		return err
 	}
 
+	var lastErr error
 	for _, d := range w.interfaces {
 		// Add the peer
 		err := w.client.ConfigureDevice(d, wgtypes.Config{
@@ -217,28 +263,30 @@ func (w *Wireguard) AddPeer(peer api.WireguardPeer) {
 				wgtypes.PeerConfig{
 					PublicKey:         key,
 					ReplaceAllowedIPs: true,
-					AllowedIPs: []net.IPNet{
-						*ipv4,
-						*ipv6,
-					},
+					AllowedIPs:        allowedIPs.IPNets(),
 				},
 			},
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			lastErr = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Print(lastErr)
 			continue
 		}
 	}
+
+	return lastErr
 }
 
 // RemovePeer removes the given peer from the wireguard interfaces, without checking the existing configuration
-func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
-	key, _, _, err := parsePeer(peer)
+// All interfaces are configured even if one fails, and the last error is returned
+func (w *Wireguard) RemovePeer(peer api.WireguardPeer) error {
+	key, err := wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {
-		return
+		return err
 	}
 
+	var lastErr error
 	for _, d := range w.interfaces {
 		// Remove the peer
 		err := w.client.ConfigureDevice(d, wgtypes.Config{
@@ -251,10 +299,13 @@ func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			lastErr = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Print(lastErr)
 			continue
 		}
 	}
+
+	return lastErr
 }
 
 func parsePeer(peer api.WireguardPeer) (key wgtypes.Key, ipv4 *net.IPNet, ipv6 *net.IPNet, err error) {
@@ -26,7 +26,7 @@ var apiFixture = api.WireguardPeerList{
 	api.WireguardPeer{
 		IPv4:   "10.99.0.1/32",
 		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
-		Ports:  []int{1234, 4321},
+		Ports:  []api.Port{{External: 1234}, {External: 4321}},
 		Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
 	},
 }
@@ -119,6 +119,26 @@ func TestWireguard(t *testing.T) {
 		}
 	})
 
+	t.Run("invalid peers", func(t *testing.T) {
+		failed, invalid := wg.UpdatePeers(api.WireguardPeerList{{IPv4: "10.99.0.3/32", IPv6: "fc00:bbbb:bbbb:bb01::3/128", Pubkey: "invalid"}})
+		if _, ok := invalid["invalid"]; !ok {
+			t.Fatal("expected a peer with an invalid key to be reported as invalid")
+		}
+
+		if len(failed) != 0 {
+			t.Fatalf("expected no failed peers, got %v", failed)
+		}
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+	})
+
 	t.Run("add single peer", func(t *testing.T) {
 		wg.AddPeer(apiFixture[0])
 